@@ -0,0 +1,264 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	// DEFAULT_SUBSCRIBERS_LIMIT is number of subscribers returned if limit is not specified
+	DEFAULT_SUBSCRIBERS_LIMIT = 100
+	MAX_SUBSCRIBERS_LIMIT     = 1000
+)
+
+type ApiKeyDetails struct {
+	model.ApiKey
+	Usage *model.ApiKeyUsage `json:"usage"`
+}
+
+func (api Api) HandleCreateApiKey(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "can not read request"})
+		return
+	}
+
+	name := r.Form.Get("name")
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "name not specified"})
+		return
+	}
+
+	keyScopes := r.Form["scope"]
+	if len(keyScopes) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "scope not specified"})
+		return
+	}
+
+	for _, scope := range keyScopes {
+		if !slices.Contains(scopes, scope) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "scope is wrong"})
+			return
+		}
+	}
+
+	var quota int64
+	if param := r.Form.Get("quota"); param != "" {
+		var err error
+		if quota, err = strconv.ParseInt(param, 10, 64); err != nil || quota < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "quota is wrong"})
+			return
+		}
+	}
+
+	key, raw := NewApiKey(name, keyScopes, quota)
+	if err := api.db.SetApiKey(r.Context(), &key); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to create api key", "err", err)
+		return
+	}
+
+	logger.InfoContext(r.Context(), "created api key", "key", key.Id, "scopes", key.Scopes, "by", ApiKeyFromContext(r.Context()).Id)
+	key.Hash = ""
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		model.ApiKey
+		// Key is shown only once
+		Key string `json:"key"`
+	}{ApiKey: key, Key: raw})
+}
+
+func (api Api) HandleGetApiKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := api.db.GetApiKeys(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to get api keys", "err", err)
+		return
+	}
+
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (api Api) HandleGetApiKey(w http.ResponseWriter, r *http.Request) {
+	key, err := api.db.GetApiKey(r.Context(), r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to get api key", "err", err)
+		return
+	}
+
+	if key == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "api key not found"})
+		return
+	}
+
+	usage, err := api.db.GetApiKeyUsage(r.Context(), key.Id, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to get api key usage", "err", err)
+		return
+	}
+
+	key.Hash = ""
+	json.NewEncoder(w).Encode(ApiKeyDetails{ApiKey: *key, Usage: usage})
+}
+
+func (api Api) HandleDeleteApiKey(w http.ResponseWriter, r *http.Request) {
+	isDeleted, err := api.db.DeleteApiKey(r.Context(), r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to delete api key", "err", err)
+		return
+	}
+
+	if !isDeleted {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "api key not found"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct{ Message string }{Message: "ok"})
+}
+
+// HandleGetSubscribers searches subscribers by ?q= substring of email or bank
+func (api Api) HandleGetSubscribers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := DEFAULT_SUBSCRIBERS_LIMIT
+	if param := query.Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit <= 0 || limit > MAX_SUBSCRIBERS_LIMIT {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "limit is wrong"})
+			return
+		}
+	}
+
+	subscribers, err := api.db.SearchSubscribers(r.Context(), query.Get("q"), limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to search subscribers", "err", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(subscribers)
+}
+
+// HandleDeleteSubscriber unsubscribes ?email= from ?bank=, the default bank if not specified
+func (api Api) HandleDeleteSubscriber(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	email := query.Get("email")
+	if email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "email not specified"})
+		return
+	}
+
+	bank := query.Get("bank")
+	if bank == "" {
+		bank = DEFAULT_BANK
+	}
+
+	isDeleted, err := api.db.DeleteSubscriber(r.Context(), email, bank)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to delete subscriber", "err", err)
+		return
+	}
+
+	if !isDeleted {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "subscriber not found"})
+		return
+	}
+
+	logger.InfoContext(r.Context(), "deleted subscriber", "email", email, "bank", bank, "by", ApiKeyFromContext(r.Context()).Id)
+	json.NewEncoder(w).Encode(struct{ Message string }{Message: "ok"})
+}
+
+// HandleGetStream describes scraper stream, its consumer group, consumers and pending entries
+func (api Api) HandleGetStream(w http.ResponseWriter, r *http.Request) {
+	info, err := api.db.GetStreamInfo(r.Context(), api.conf.Stream, api.conf.Group)
+	if err != nil {
+		if errors.Is(err, shared.ErrStreamNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "stream not found"})
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to get stream info", "err", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(info)
+}
+
+// HandleCreateMailRun asks mailer listening for runs to send emails, digests if ?digest=true, only logs them if ?dry_run=true
+func (api Api) HandleCreateMailRun(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "can not read request"})
+		return
+	}
+
+	var digest bool
+	if param := r.Form.Get("digest"); param != "" {
+		var err error
+		if digest, err = strconv.ParseBool(param); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "digest is wrong"})
+			return
+		}
+	}
+
+	var dryRun bool
+	if param := r.Form.Get("dry_run"); param != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(param); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "dry_run is wrong"})
+			return
+		}
+	}
+
+	run := model.MailRun{
+		Digest:      digest,
+		DryRun:      dryRun,
+		RequestedBy: ApiKeyFromContext(r.Context()).Id,
+		RequestedAt: time.Now(),
+	}
+
+	var err error
+	if run.Id, err = api.db.RequestMailRun(r.Context(), &run); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to request mail run", "err", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(run)
+}
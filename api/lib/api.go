@@ -3,65 +3,257 @@ package lib
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/health"
+	"github.com/charkpep/usd_rate_api/shared/logging"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
-	"log"
+	"net"
 	"net/http"
 	"net/mail"
-	"os"
+	"slices"
+	"strings"
 	"time"
 )
 
-var logger = log.New(os.Stdout, "api: ", log.LstdFlags)
+var logger = logging.New("api")
 
 const DEFAULT_BANK = "Приватбанк"
 
+// DEFAULT_HISTORY_PERIOD is used when history range is not specified
+const DEFAULT_HISTORY_PERIOD = 7 * 24 * time.Hour
+
+type Config struct {
+	SubscribeLimits SubscribeLimits
+	// TrustProxy takes client ip from X-Forwarded-For, only set it behind a proxy which overwrites the header
+	TrustProxy bool
+	// ChallengeSecret enables proof of work challenge on subscription if set
+	ChallengeSecret     string
+	ChallengeDifficulty int
+	// RequireApiKey rejects anonymous requests, otherwise only admin routes need a key
+	RequireApiKey bool
+	// AdminKey is accepted with admin scope without being stored, e.g. to create the first keys
+	AdminKey string
+	// Stream and Group are scraper stream and consumer group shown to admins
+	Stream string
+	Group  string
+}
+
+// DefaultConfig limits subscriptions, challenge is disabled
+func DefaultConfig() Config {
+	return Config{
+		SubscribeLimits: SubscribeLimits{
+			Ip:     Limit{Count: 5, Window: time.Hour},
+			Domain: Limit{Count: 100, Window: time.Hour},
+			Global: Limit{Count: 1000, Window: time.Hour},
+		},
+		ChallengeDifficulty: DEFAULT_CHALLENGE_DIFFICULTY,
+		Stream:              "rate:usd",
+		Group:               "usd-rate",
+	}
+}
+
 type Api struct {
 	handler http.Handler
 	db      *shared.Database
-	done    <-chan struct{}
+	health  *health.Checker
+	server  *http.Server
+	conf    Config
+	// updates shares reading of rate updates between stream clients
+	updates *rateHub
 }
 
-func NewApi(rdb *redis.Client) *Api {
+func NewApi(rdb *redis.Client, conf Config) *Api {
 	h := http.NewServeMux()
+	// cancelled on shutdown to end long living requests
+	baseCtx, cancel := context.WithCancel(context.Background())
 	api := Api{
 		handler: h,
 		db:      shared.NewDb(rdb),
+		health:  health.NewChecker(),
+		conf:    conf,
+		server: &http.Server{
+			Handler:           h,
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			BaseContext: func(net.Listener) context.Context {
+				return baseCtx
+			},
+		},
 	}
 
-	h.Handle("GET /rate", LoggerWrapper{
-		h:      api.HandlerGetRate,
-		logger: logger,
+	api.updates = newRateHub(baseCtx, api.db)
+	api.server.RegisterOnShutdown(cancel)
+	api.health.Add("redis", health.RedisCheck(rdb))
+	api.health.Register(h)
+	h.Handle("GET /metrics", promhttp.Handler())
+
+	h.Handle("GET /rate", InstrumentWrapper{
+		route: "/rate",
+		h:     api.withScope(SCOPE_READ, ConditionalWrapper{h: api.HandlerGetRate, maxAge: CACHE_MAX_AGE}.ServeHTTP),
+	})
+
+	h.Handle("GET /rate/{bank}", InstrumentWrapper{
+		route: "/rate/{bank}",
+		h:     api.withScope(SCOPE_READ, ConditionalWrapper{h: api.HandlerGetRate, maxAge: CACHE_MAX_AGE}.ServeHTTP),
+	})
+
+	h.Handle("GET /rate/stream", InstrumentWrapper{
+		route: "/rate/stream",
+		h:     api.withScope(SCOPE_READ, api.HandleRateStream),
+	})
+
+	h.Handle("GET /rate/{bank}/stream", InstrumentWrapper{
+		route: "/rate/{bank}/stream",
+		h:     api.withScope(SCOPE_READ, api.HandleRateStream),
+	})
+
+	h.Handle("GET /rate/{bank}/history", InstrumentWrapper{
+		route: "/rate/{bank}/history",
+		h:     api.withScope(SCOPE_READ, ConditionalWrapper{h: api.HandleGetRateHistory, maxAge: CACHE_MAX_AGE}.ServeHTTP),
+	})
+
+	h.Handle("GET /rates", InstrumentWrapper{
+		route: "/rates",
+		h:     api.withScope(SCOPE_READ, ConditionalWrapper{h: api.HandleGetRates, maxAge: CACHE_MAX_AGE}.ServeHTTP),
 	})
 
-	h.Handle("GET /rate/{bank}", LoggerWrapper{
-		h:      api.HandlerGetRate,
-		logger: logger,
+	h.Handle("GET /rates/best", InstrumentWrapper{
+		route: "/rates/best",
+		h:     api.withScope(SCOPE_READ, ConditionalWrapper{h: api.HandleGetBestRates, maxAge: CACHE_MAX_AGE}.ServeHTTP),
 	})
 
-	h.Handle("POST /subscribe", LoggerWrapper{
-		h:      api.HandleSubscribe,
-		logger: logger,
+	h.Handle("GET /rates/summary", InstrumentWrapper{
+		route: "/rates/summary",
+		h:     api.withScope(SCOPE_READ, ConditionalWrapper{h: api.HandleGetRatesSummary, maxAge: CACHE_MAX_AGE}.ServeHTTP),
+	})
+
+	h.Handle("GET /convert", InstrumentWrapper{
+		route: "/convert",
+		h:     api.withScope(SCOPE_READ, ConditionalWrapper{h: api.HandleConvert, maxAge: CACHE_MAX_AGE}.ServeHTTP),
+	})
+
+	h.Handle("POST /subscribe", InstrumentWrapper{
+		route: "/subscribe",
+		h:     api.withScope(SCOPE_SUBSCRIBE, RateLimitWrapper{h: api.HandleSubscribe, db: api.db, limits: api.subscribeIpLimits}.ServeHTTP),
+	})
+
+	h.Handle("GET /subscribe/challenge", InstrumentWrapper{
+		route: "/subscribe/challenge",
+		h:     api.withScope(SCOPE_SUBSCRIBE, api.HandleGetChallenge),
+	})
+
+	h.Handle("POST /webhooks", InstrumentWrapper{
+		route: "/webhooks",
+		h:     api.withRequiredScope(SCOPE_SUBSCRIBE, api.HandleCreateWebhook),
+	})
+
+	h.Handle("GET /webhooks/{id}", InstrumentWrapper{
+		route: "/webhooks/{id}",
+		h:     api.withRequiredScope(SCOPE_SUBSCRIBE, api.HandleGetWebhook),
+	})
+
+	h.Handle("DELETE /webhooks/{id}", InstrumentWrapper{
+		route: "/webhooks/{id}",
+		h:     api.withRequiredScope(SCOPE_SUBSCRIBE, api.HandleDeleteWebhook),
+	})
+
+	h.Handle("POST /webhooks/{id}/enable", InstrumentWrapper{
+		route: "/webhooks/{id}/enable",
+		h:     api.withRequiredScope(SCOPE_SUBSCRIBE, api.HandleEnableWebhook),
+	})
+
+	h.Handle("GET /webhooks/{id}/deliveries", InstrumentWrapper{
+		route: "/webhooks/{id}/deliveries",
+		h:     api.withRequiredScope(SCOPE_SUBSCRIBE, api.HandleGetWebhookDeliveries),
+	})
+
+	h.Handle("POST /admin/keys", InstrumentWrapper{
+		route: "/admin/keys",
+		h:     api.withScope(SCOPE_ADMIN, api.HandleCreateApiKey),
+	})
+
+	h.Handle("GET /admin/keys", InstrumentWrapper{
+		route: "/admin/keys",
+		h:     api.withScope(SCOPE_ADMIN, api.HandleGetApiKeys),
+	})
+
+	h.Handle("GET /admin/keys/{id}", InstrumentWrapper{
+		route: "/admin/keys/{id}",
+		h:     api.withScope(SCOPE_ADMIN, api.HandleGetApiKey),
+	})
+
+	h.Handle("DELETE /admin/keys/{id}", InstrumentWrapper{
+		route: "/admin/keys/{id}",
+		h:     api.withScope(SCOPE_ADMIN, api.HandleDeleteApiKey),
+	})
+
+	h.Handle("GET /admin/subscribers", InstrumentWrapper{
+		route: "/admin/subscribers",
+		h:     api.withScope(SCOPE_ADMIN, api.HandleGetSubscribers),
+	})
+
+	h.Handle("DELETE /admin/subscribers", InstrumentWrapper{
+		route: "/admin/subscribers",
+		h:     api.withScope(SCOPE_ADMIN, api.HandleDeleteSubscriber),
+	})
+
+	h.Handle("GET /admin/stream", InstrumentWrapper{
+		route: "/admin/stream",
+		h:     api.withScope(SCOPE_ADMIN, api.HandleGetStream),
+	})
+
+	h.Handle("POST /admin/mail-runs", InstrumentWrapper{
+		route: "/admin/mail-runs",
+		h:     api.withScope(SCOPE_ADMIN, api.HandleCreateMailRun),
 	})
 
 	return &api
 }
 
 func (api Api) ListenAndServer(addr string) error {
-	if err := http.ListenAndServe(addr, api.handler); err != nil {
+	api.server.Addr = addr
+	if err := api.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
 
 	return nil
 }
 
+// Serve accepts requests on l, e.g. a listener on a random port in tests
+func (api Api) Serve(l net.Listener) error {
+	if err := api.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// Shutdown stops accepting requests and waits for the active ones until ctx is done
+func (api Api) Shutdown(ctx context.Context) error {
+	api.health.SetDraining()
+	return api.server.Shutdown(ctx)
+}
+
 func (api Api) HandlerGetRate(w http.ResponseWriter, r *http.Request) {
 	var bank string
 	if bank = r.PathValue("bank"); bank == "" {
 		bank = DEFAULT_BANK
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	format, ok := negotiateFormat(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "format is not supported"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
 	defer cancel()
 	price, err := api.db.GetBankPrice(ctx, bank)
 	if err != nil {
@@ -76,13 +268,84 @@ func (api Api) HandlerGetRate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(price); err != nil {
+	setLastModified(w, price.LastUpdated)
+	if err := renderRates(w, format, []model.BankRate{*price}, false); err != nil {
+		logger.ErrorContext(r.Context(), "failed to render rate", "err", err)
+	}
+
+	return
+}
+
+func (api Api) HandleGetRates(w http.ResponseWriter, r *http.Request) {
+	format, ok := negotiateFormat(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "format is not supported"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+	rates, err := api.db.GetBankPrices(ctx)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
-		logger.Println(err)
+		logger.ErrorContext(r.Context(), "failed to get rates", "err", err)
+		return
 	}
 
-	return
+	slices.SortFunc(rates, func(a, b model.BankRate) int {
+		return strings.Compare(a.Bank, b.Bank)
+	})
+
+	if err := renderRates(w, format, rates, true); err != nil {
+		logger.ErrorContext(r.Context(), "failed to render rates", "err", err)
+	}
+}
+
+func (api Api) HandleGetRateHistory(w http.ResponseWriter, r *http.Request) {
+	bank := r.PathValue("bank")
+	format, ok := negotiateFormat(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "format is not supported"})
+		return
+	}
+
+	to := time.Now()
+	if param := r.URL.Query().Get("to"); param != "" {
+		var err error
+		if to, err = time.Parse(time.RFC3339, param); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "to is not RFC3339 time"})
+			return
+		}
+	}
+
+	from := to.Add(-DEFAULT_HISTORY_PERIOD)
+	if param := r.URL.Query().Get("from"); param != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, param); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "from is not RFC3339 time"})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+	history, err := api.db.GetBankPriceHistory(ctx, bank, from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to get rate history", "bank", bank, "err", err)
+		return
+	}
+
+	// history has no Last-Modified, out of order rates are added with older times than the latest one
+	if err := renderRates(w, format, history, true); err != nil {
+		logger.ErrorContext(r.Context(), "failed to render rate history", "err", err)
+	}
 }
 
 func (api Api) HandleSubscribe(w http.ResponseWriter, r *http.Request) {
@@ -105,20 +368,55 @@ func (api Api) HandleSubscribe(w http.ResponseWriter, r *http.Request) {
 	}
 
 	email := params[0]
-	logger.Println(email)
-	if _, err := mail.ParseAddress(email); err != nil {
+	logger.InfoContext(r.Context(), "subscribing", "email", email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(struct{ Message string }{Message: "email is wrong"})
 		return
 	}
 
-	isAdded, err := api.db.AddSubscriber(context.Background(), email, DEFAULT_BANK)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(struct{ Message string }{Message: "email is wrong"})
+	// banks are listed as repeated bank params, the default bank is subscribed to if none is
+	banks := r.Form["bank"]
+	if len(banks) == 0 {
+		banks = []string{DEFAULT_BANK}
+	} else {
+		unknown, err := api.unknownBank(r.Context(), banks)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+			logger.ErrorContext(r.Context(), "failed to get banks", "err", err)
+			return
+		}
+
+		if unknown != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: fmt.Sprintf("bank %s is unknown", unknown)})
+			return
+		}
+	}
+
+	if api.conf.ChallengeSecret != "" && !api.checkChallenge(w, r) {
+		return
+	}
+
+	if !allowRequest(w, r, api.db, api.subscribeEmailLimits(addr.Address)) {
 		return
 	}
 
+	isAdded := false
+	for _, bank := range banks {
+		added, err := api.db.AddSubscriber(r.Context(), email, bank)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "email is wrong"})
+			return
+		}
+
+		isAdded = isAdded || added
+	}
+
+	// request is rejected only if email is subscribed to all of banks already
 	if !isAdded {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(struct{ Message string }{Message: "email already added"})
@@ -129,3 +427,60 @@ func (api Api) HandleSubscribe(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(struct{ Message string }{Message: "ok"})
 	return
 }
+
+// unknownBank returns the first of banks which has no rate, empty if all of them have
+func (api Api) unknownBank(ctx context.Context, banks []string) (string, error) {
+	iter, err := api.db.GetBanks(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	known := map[string]bool{}
+	for iter.Next(ctx) {
+		known[iter.Val()] = true
+	}
+
+	if iter.Err() != nil {
+		return "", iter.Err()
+	}
+
+	for _, bank := range banks {
+		if !known[bank] {
+			return bank, nil
+		}
+	}
+
+	return "", nil
+}
+
+// checkChallenge writes error response and returns false unless request has a solved unused challenge
+func (api Api) checkChallenge(w http.ResponseWriter, r *http.Request) bool {
+	challenge, nonce := r.Form.Get("challenge"), r.Form.Get("nonce")
+	if challenge == "" || nonce == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "challenge not specified"})
+		return false
+	}
+
+	if err := VerifyChallenge(api.conf.ChallengeSecret, api.conf.ChallengeDifficulty, challenge, nonce, time.Now()); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: err.Error()})
+		return false
+	}
+
+	isUnused, err := api.db.UseChallenge(r.Context(), challenge, CHALLENGE_TTL)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to use challenge", "err", err)
+		return false
+	}
+
+	if !isUnused {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "challenge is already used"})
+		return false
+	}
+
+	return true
+}
@@ -4,115 +4,382 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/charkpep/usd_rate_api/shared"
 	"github.com/charkpep/usd_rate_api/shared/model"
-	"github.com/redis/go-redis/v9"
-	"github.com/testcontainers/testcontainers-go"
-	"github.com/testcontainers/testcontainers-go/wait"
-	"log"
+	"github.com/charkpep/usd_rate_api/shared/testenv"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
 
-func SpinUpRedis(t *testing.T) string {
-	req := testcontainers.ContainerRequest{
-		Image:        "redis:latest",
-		ExposedPorts: []string{"6379/tcp"},
-		WaitingFor:   wait.ForLog("Ready to accept connections"),
-	}
-	redisC, err := testcontainers.GenericContainer(context.Background(), testcontainers.GenericContainerRequest{
-		ContainerRequest: req,
-		Started:          true,
-	})
-	if err != nil {
-		log.Fatalf("Could not start redis: %s", err)
-	}
-
-	t.Cleanup(func() {
-		if err := redisC.Terminate(context.Background()); err != nil {
-			log.Fatalf("Could not container redis: %s", err)
-		}
-	})
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	endpoint, err := redisC.Endpoint(ctx, "")
+// startApi serves api on a random port until test ends, returns its base url
+func startApi(t *testing.T, api *Api) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		log.Fatalf("Could get redis endpoint: %s", err)
-	}
-
-	t.Log(endpoint)
-	return endpoint
-}
-
-func GetFreePort(t *testing.T) int {
-	var (
-		a   *net.TCPAddr
-		err error
-	)
-
-	if a, err = net.ResolveTCPAddr("tcp", "localhost:0"); err == nil {
-		var l *net.TCPListener
-		if l, err = net.ListenTCP("tcp", a); err == nil {
-			defer l.Close()
-			return l.Addr().(*net.TCPAddr).Port
-		}
+		t.Fatal(err)
 	}
 
-	t.Fatalf("can not get a free port")
-	return 0
+	go api.Serve(l)
+	t.Cleanup(func() { api.Shutdown(context.Background()) })
+	return "http://" + l.Addr().String()
 }
 
 func TestApi(t *testing.T) {
 	type tt struct {
-		addr   string
+		method string
+		path   string
+		form   url.Values
 		status int
 		res    string
 	}
-	opt, err := redis.ParseURL(fmt.Sprintf("redis://%s", SpinUpRedis(t)))
-	if err != nil {
-		t.Fatal(err)
-	}
 
-	rdb := redis.NewClient(opt)
+	rdb, _ := testenv.NewRedis(t)
 	rate := model.BankRate{
 		Bank:        "bank",
 		Buy:         10,
 		BuyOnline:   10,
 		Sell:        11,
 		SellOnline:  11,
-		LastUpdated: time.Time{},
+		LastUpdated: time.Date(2024, time.June, 10, 12, 0, 0, 0, time.UTC),
 		Source:      "source.com",
 		SiteUrl:     "/bank.com",
 	}
 
-	rateBuff, _ := json.Marshal(rate)
-	rdb.Set(context.Background(), "rate:usd:bank", string(rateBuff), 0)
+	official := model.BankRate{Bank: "official", Buy: 10.5, Sell: 10.5, LastUpdated: rate.LastUpdated, Official: true}
+	for _, r := range []model.BankRate{rate, official} {
+		if err := shared.NewDb(rdb).SetBankPrice(context.Background(), &r); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	api := NewApi(rdb)
-	addr := fmt.Sprintf(":%d", GetFreePort(t))
-	go api.ListenAndServer(addr)
+	rateBuff, _ := json.Marshal(rate)
+	officialBuff, _ := json.Marshal(official)
+	ratesBuff, _ := json.Marshal([]model.BankRate{rate})
+	addr := startApi(t, NewApi(rdb, DefaultConfig()))
 	ts := []tt{
 		{
-			addr:   fmt.Sprintf("%s/%s", addr, "rate/bank"),
+			method: http.MethodGet,
+			path:   "/rate/bank",
 			status: 200,
 			res:    string(rateBuff),
 		},
 		{
-			addr:   fmt.Sprintf("%s/%s", addr, "rate/private"),
+			method: http.MethodGet,
+			path:   "/rate/private",
 			status: 204,
-			res:    "not found",
 		},
+		{
+			method: http.MethodGet,
+			path:   "/rate/official",
+			status: 200,
+			res:    string(officialBuff),
+		},
+		{
+			method: http.MethodGet,
+			path:   "/rates",
+			status: 200,
+			res:    string(ratesBuff),
+		},
+		{
+			method: http.MethodPost,
+			path:   "/subscribe",
+			form:   url.Values{"email": {"user@example.com"}},
+			status: 200,
+			res:    `{"Message":"ok"}`,
+		},
+		{
+			method: http.MethodPost,
+			path:   "/subscribe",
+			form:   url.Values{"email": {"user@example.com"}},
+			status: 400,
+			res:    `{"Message":"email already added"}`,
+		},
+		{
+			method: http.MethodPost,
+			path:   "/subscribe",
+			form:   url.Values{"email": {"user"}},
+			status: 400,
+			res:    `{"Message":"email is wrong"}`,
+		},
+		{
+			method: http.MethodGet,
+			path:   "/convert?amount=NaN&from=USD&to=UAH",
+			status: 400,
+			res:    `{"Message":"amount is wrong"}`,
+		},
+		{
+			method: http.MethodGet,
+			path:   "/admin/subscribers",
+			status: 401,
+			res:    `{"Message":"api key not specified"}`,
+		},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			req, err := http.NewRequest(test.method, addr+test.path, strings.NewReader(test.form.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.form != nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Errorf("expected status %d, got %d\n", test.status, res.StatusCode)
+			}
+
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.TrimSpace(string(body)) != test.res {
+				t.Errorf("expected %s, got %s\n", test.res, body)
+			}
+		})
+	}
+}
+
+func TestSubscribeLimits(t *testing.T) {
+	type tt struct {
+		email  string
+		status int
+	}
+
+	rdb, _ := testenv.NewRedis(t)
+	conf := DefaultConfig()
+	conf.SubscribeLimits = SubscribeLimits{Ip: Limit{Count: 5, Window: time.Hour}, Global: Limit{Count: 1, Window: time.Hour}}
+	addr := startApi(t, NewApi(rdb, conf))
+	// invalid requests are counted only by the ip limit
+	ts := []tt{
+		{email: "user", status: 400},
+		{email: "user", status: 400},
+		{email: "user@example.com", status: 200},
+		{email: "other@example.com", status: 429},
+		{email: "user", status: 400},
+		{email: "user", status: 429},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			res, err := http.PostForm(addr+"/subscribe", url.Values{"email": {test.email}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Errorf("expected status %d, got %d\n", test.status, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestSubscribeBanks(t *testing.T) {
+	type tt struct {
+		banks  []string
+		status int
+		res    string
 	}
 
-	for _, test := range ts {
-		client := http.DefaultClient
-		res, err := client.Get(test.addr)
-		if err != nil {
+	rdb, _ := testenv.NewRedis(t)
+	db := shared.NewDb(rdb)
+	for _, rate := range []model.BankRate{
+		{Bank: "first", Buy: 40, Sell: 41, LastUpdated: time.Now()},
+		{Bank: "second", Buy: 40.5, Sell: 40.9, LastUpdated: time.Now()},
+		{Bank: "official", Buy: 40.2, Sell: 40.2, LastUpdated: time.Now(), Official: true},
+	} {
+		if err := db.SetBankPrice(context.Background(), &rate); err != nil {
 			t.Fatal(err)
 		}
-		
 	}
 
+	conf := DefaultConfig()
+	conf.SubscribeLimits = SubscribeLimits{}
+	addr := startApi(t, NewApi(rdb, conf))
+	ts := []tt{
+		{banks: []string{"first", "other"}, status: 400, res: `{"Message":"bank other is unknown"}`},
+		{banks: []string{"official"}, status: 400, res: `{"Message":"bank official is unknown"}`},
+		{banks: []string{"first"}, status: 200, res: `{"Message":"ok"}`},
+		{banks: []string{"first", "second"}, status: 200, res: `{"Message":"ok"}`},
+		{banks: []string{"second", "first"}, status: 400, res: `{"Message":"email already added"}`},
+		{status: 200, res: `{"Message":"ok"}`},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			res, err := http.PostForm(addr+"/subscribe", url.Values{"email": {"user@example.com"}, "bank": test.banks})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.StatusCode != test.status || strings.TrimSpace(string(body)) != test.res {
+				t.Errorf("expected %d %s, got %d %s\n", test.status, test.res, res.StatusCode, body)
+			}
+		})
+	}
+
+	subscribers := rdb.SMembers(context.Background(), "rate:usd:subscribers").Val()
+	if len(subscribers) != 3 {
+		t.Errorf("expected subscriptions to first, second and default bank, got %v\n", subscribers)
+	}
+}
+
+func TestAggregatesLastModified(t *testing.T) {
+	rdb, _ := testenv.NewRedis(t)
+	now := time.Now()
+	// older rate added later changes aggregates without changing the latest update time
+	for _, rate := range []model.BankRate{
+		{Bank: "first", Buy: 40, Sell: 41, LastUpdated: now},
+		{Bank: "second", Buy: 40.5, Sell: 40.9, LastUpdated: now.Add(-time.Hour)},
+	} {
+		if err := shared.NewDb(rdb).SetBankPrice(context.Background(), &rate); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addr := startApi(t, NewApi(rdb, DefaultConfig()))
+	paths := []string{"/rates", "/rates/best", "/rates/summary", "/rate/first/history", "/convert?amount=100&from=USD&to=UAH"}
+	for i, path := range paths {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, addr+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Set("If-Modified-Since", now.Add(time.Minute).UTC().Format(http.TimeFormat))
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusOK || res.Header.Get("Last-Modified") != "" {
+				t.Errorf("expected status %d without Last-Modified, got %d %s\n", http.StatusOK, res.StatusCode, res.Header.Get("Last-Modified"))
+			}
+		})
+	}
+}
+
+func TestRatesBeforeBankSets(t *testing.T) {
+	rdb, _ := testenv.NewRedis(t)
+	ctx := context.Background()
+	rate := model.BankRate{Bank: "bank", Buy: 10, Sell: 11, LastUpdated: time.Date(2024, time.June, 10, 12, 0, 0, 0, time.UTC)}
+	official := model.BankRate{Bank: "official", Buy: 10.5, Sell: 10.5, LastUpdated: rate.LastUpdated, Official: true}
+	// rates are stored as they were before banks were listed in sets, along with other keys of the namespace
+	for _, r := range []model.BankRate{rate, official} {
+		rBuff, _ := json.Marshal(r)
+		if err := rdb.Set(ctx, "rate:usd:"+r.Bank, string(rBuff), 0).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for key, val := range map[string]string{"rate:usd:Mux": "token", "rate:usd:processed:hash": "1"} {
+		if err := rdb.Set(ctx, key, val, 0).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addr := startApi(t, NewApi(rdb, DefaultConfig()))
+	res, err := http.Get(addr + "/rates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	rates := []model.BankRate{}
+	if err := json.NewDecoder(res.Body).Decode(&rates); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rates) != 1 || rates[0].Bank != "bank" {
+		t.Errorf("expected rate of bank, got %v\n", rates)
+	}
+
+	if banks := rdb.SMembers(ctx, "rate:usd:banks:official").Val(); len(banks) != 1 || banks[0] != "official" {
+		t.Errorf("expected official bank listed, got %v\n", banks)
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	rdb, _ := testenv.NewRedis(t)
+	ctx := context.Background()
+	db := shared.NewDb(rdb)
+	now := time.Now()
+	// prices are added out of order, the oldest one is beyond retention of the latest
+	for _, at := range []time.Time{now.Add(-shared.HISTORY_RETENTION - time.Hour), now, now.Add(-shared.HISTORY_RETENTION + time.Hour)} {
+		if err := db.AddBankPriceHistory(ctx, &model.BankRate{Bank: "bank", Buy: 10, Sell: 11, LastUpdated: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := db.GetBankPriceHistory(ctx, "bank", now.Add(-2*shared.HISTORY_RETENTION), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != 2 || !history[0].LastUpdated.Equal(now.Add(-shared.HISTORY_RETENTION+time.Hour)) {
+		t.Errorf("expected 2 prices within retention, got %v\n", history)
+	}
+}
+
+func TestGetStream(t *testing.T) {
+	type tt struct {
+		// exists is whether the stream is created before request
+		exists bool
+		status int
+	}
+
+	ts := []tt{
+		{exists: false, status: http.StatusNotFound},
+		{exists: true, status: http.StatusOK},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			rdb, _ := testenv.NewRedis(t)
+			conf := DefaultConfig()
+			conf.AdminKey = "admin-key"
+			if test.exists {
+				if err := rdb.XGroupCreateMkStream(context.Background(), conf.Stream, conf.Group, "$").Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			addr := startApi(t, NewApi(rdb, conf))
+			req, err := http.NewRequest(http.MethodGet, addr+"/admin/stream", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Set("Authorization", "Bearer admin-key")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Errorf("expected %v, got %v\n", test.status, res.StatusCode)
+			}
+		})
+	}
 }
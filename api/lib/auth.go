@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SCOPE_READ      = "read"
+	SCOPE_SUBSCRIBE = "subscribe"
+	// SCOPE_ADMIN grants all the other scopes
+	SCOPE_ADMIN = "admin"
+	// API_KEY_PREFIX starts every key, so leaked keys are easy to find
+	API_KEY_PREFIX = "rk"
+)
+
+var scopes = []string{SCOPE_READ, SCOPE_SUBSCRIBE, SCOPE_ADMIN}
+
+type apiKeyCtxKey struct{}
+
+// NewApiKey returns model to store and the key shown to its owner, "rk_{id}_{secret}"
+func NewApiKey(name string, keyScopes []string, quota int64) (model.ApiKey, string) {
+	id, secret := randomHex(8), randomHex(32)
+	return model.ApiKey{
+		Id:        id,
+		Name:      name,
+		Hash:      hashApiKeySecret(secret),
+		Scopes:    keyScopes,
+		Quota:     quota,
+		CreatedAt: time.Now(),
+	}, API_KEY_PREFIX + "_" + id + "_" + secret
+}
+
+// parseApiKey splits key into id and secret
+func parseApiKey(key string) (string, string, bool) {
+	prefix, rest, ok := strings.Cut(key, "_")
+	if !ok || prefix != API_KEY_PREFIX {
+		return "", "", false
+	}
+
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return "", "", false
+	}
+
+	return id, secret, true
+}
+
+func hashApiKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// hasScope is true for admin keys regardless of scope
+func hasScope(key *model.ApiKey, scope string) bool {
+	return slices.Contains(key.Scopes, SCOPE_ADMIN) || slices.Contains(key.Scopes, scope)
+}
+
+// requestApiKey reads key from "Authorization: Bearer" or X-API-Key header
+func requestApiKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+
+	return r.Header.Get("X-API-Key")
+}
+
+// ApiKeyFromContext returns nil for anonymous requests
+func ApiKeyFromContext(ctx context.Context) *model.ApiKey {
+	key, _ := ctx.Value(apiKeyCtxKey{}).(*model.ApiKey)
+	return key
+}
+
+// AuthWrapper lets through requests with a valid key having the scope and within its daily quota.
+// Requests without key are let through unless key is required.
+type AuthWrapper struct {
+	h        http.HandlerFunc
+	db       *shared.Database
+	scope    string
+	required bool
+	// adminKeyHash authorizes configured admin key, which is not stored
+	adminKeyHash string
+}
+
+func (a AuthWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	raw := requestApiKey(r)
+	if raw == "" {
+		if a.required {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "api key not specified"})
+			return
+		}
+
+		a.h(w, r)
+		return
+	}
+
+	key, ok := a.authenticate(w, r, raw)
+	if !ok {
+		return
+	}
+
+	if !hasScope(key, a.scope) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "api key has no " + a.scope + " scope"})
+		return
+	}
+
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("api_key.id", key.Id))
+	a.h(w, r.WithContext(context.WithValue(r.Context(), apiKeyCtxKey{}, key)))
+}
+
+// authenticate writes error response and returns false if key is wrong or over quota
+func (a AuthWrapper) authenticate(w http.ResponseWriter, r *http.Request, raw string) (*model.ApiKey, bool) {
+	if a.adminKeyHash != "" && subtle.ConstantTimeCompare([]byte(hashApiKeySecret(raw)), []byte(a.adminKeyHash)) == 1 {
+		return &model.ApiKey{Id: "admin", Name: "admin", Scopes: []string{SCOPE_ADMIN}}, true
+	}
+
+	id, secret, ok := parseApiKey(raw)
+	var key *model.ApiKey
+	if ok {
+		var err error
+		if key, err = a.db.GetApiKey(r.Context(), id); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+			logger.ErrorContext(r.Context(), "failed to get api key", "err", err)
+			return nil, false
+		}
+	}
+
+	if key == nil || subtle.ConstantTimeCompare([]byte(hashApiKeySecret(secret)), []byte(key.Hash)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "api key is wrong"})
+		return nil, false
+	}
+
+	now := time.Now()
+	allowed, err := a.db.IncrApiKeyUsage(r.Context(), key.Id, now, key.Quota)
+	if err != nil {
+		// usage is not critical, quota is not enforced until redis recovers
+		logger.ErrorContext(r.Context(), "failed to count api key usage", "key", key.Id, "err", err)
+		allowed = true
+	}
+
+	if !allowed {
+		midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		w.Header().Set("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "api key quota exceeded"})
+		return nil, false
+	}
+
+	return key, true
+}
+
+// withScope requires key with scope for admin scope or if keys are required, optional otherwise
+func (api Api) withScope(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return api.withKey(scope, api.conf.RequireApiKey || scope == SCOPE_ADMIN, h)
+}
+
+// withRequiredScope requires key with scope regardless of config, e.g. for resources owned by keys
+func (api Api) withRequiredScope(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return api.withKey(scope, true, h)
+}
+
+func (api Api) withKey(scope string, required bool, h http.HandlerFunc) http.HandlerFunc {
+	wrapper := AuthWrapper{
+		h:        h,
+		db:       api.db,
+		scope:    scope,
+		required: required,
+	}
+	if api.conf.AdminKey != "" {
+		wrapper.adminKeyHash = hashApiKeySecret(api.conf.AdminKey)
+	}
+
+	return wrapper.ServeHTTP
+}
@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/testenv"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseApiKey(t *testing.T) {
+	type tt struct {
+		i      string
+		id     string
+		secret string
+		ok     bool
+	}
+
+	_, raw := NewApiKey("test", []string{SCOPE_READ}, 0)
+	id, secret, _ := parseApiKey(raw)
+	ts := []tt{
+		{i: raw, id: id, secret: secret, ok: true},
+		{i: "rk_abc_def", id: "abc", secret: "def", ok: true},
+		{i: "sk_abc_def", ok: false},
+		{i: "rk_abc", ok: false},
+		{i: "rk__def", ok: false},
+		{i: "", ok: false},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			id, secret, ok := parseApiKey(test.i)
+			if ok != test.ok || id != test.id || secret != test.secret {
+				t.Errorf("expected %v %v %v, got %v %v %v\n", test.id, test.secret, test.ok, id, secret, ok)
+			}
+		})
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	type tt struct {
+		scopes []string
+		scope  string
+		e      bool
+	}
+
+	ts := []tt{
+		{scopes: []string{SCOPE_READ}, scope: SCOPE_READ, e: true},
+		{scopes: []string{SCOPE_READ}, scope: SCOPE_SUBSCRIBE, e: false},
+		{scopes: []string{SCOPE_READ, SCOPE_SUBSCRIBE}, scope: SCOPE_SUBSCRIBE, e: true},
+		{scopes: []string{SCOPE_ADMIN}, scope: SCOPE_SUBSCRIBE, e: true},
+		{scopes: []string{}, scope: SCOPE_ADMIN, e: false},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if res := hasScope(&model.ApiKey{Scopes: test.scopes}, test.scope); res != test.e {
+				t.Errorf("expected %v, got %v\n", test.e, res)
+			}
+		})
+	}
+}
+
+// TestAuthWrapper covers cases resolved without database
+func TestAuthWrapper(t *testing.T) {
+	type tt struct {
+		scope    string
+		required bool
+		header   string
+		status   int
+	}
+
+	ts := []tt{
+		{scope: SCOPE_READ, required: false, header: "", status: http.StatusOK},
+		{scope: SCOPE_READ, required: true, header: "", status: http.StatusUnauthorized},
+		{scope: SCOPE_ADMIN, required: true, header: "Bearer admin-key", status: http.StatusOK},
+		{scope: SCOPE_READ, required: true, header: "Bearer admin-key", status: http.StatusOK},
+		{scope: SCOPE_ADMIN, required: true, header: "Bearer wrong", status: http.StatusUnauthorized},
+		{scope: SCOPE_ADMIN, required: true, header: "Basic admin-key", status: http.StatusUnauthorized},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			a := AuthWrapper{
+				h: func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				},
+				scope:        test.scope,
+				required:     test.required,
+				adminKeyHash: hashApiKeySecret("admin-key"),
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Errorf("expected %v, got %v\n", test.status, w.Code)
+			}
+		})
+	}
+}
+
+func TestApiKeyQuota(t *testing.T) {
+	rdb, _ := testenv.NewRedis(t)
+	db := shared.NewDb(rdb)
+	key, raw := NewApiKey("test", []string{SCOPE_READ}, 2)
+	if err := db.SetApiKey(context.Background(), &key); err != nil {
+		t.Fatal(err)
+	}
+
+	a := AuthWrapper{
+		h: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+		db:       db,
+		scope:    SCOPE_READ,
+		required: true,
+	}
+
+	// requests over quota are rejected without being counted
+	for i, status := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+raw)
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, r)
+			if w.Code != status {
+				t.Errorf("expected %v, got %v\n", status, w.Code)
+			}
+		})
+	}
+
+	usage, err := db.GetApiKeyUsage(context.Background(), key.Id, time.Now())
+	if err != nil || usage.Today != 2 || usage.Total != 2 {
+		t.Errorf("expected 2 requests today and total, got %v %v\n", usage, err)
+	}
+}
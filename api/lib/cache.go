@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CACHE_MAX_AGE is how long clients may reuse read responses without revalidation
+const CACHE_MAX_AGE = 60 * time.Second
+
+// ConditionalWrapper adds ETag and Cache-Control headers to successful GET responses
+// and answers If-None-Match and If-Modified-Since with 304. Handlers of a single stored rate set
+// Last-Modified from it, aggregates of several rates rely on ETag, which is derived from the response
+// body unless handler sets one. Responses to requests with api key are private, so shared caches
+// neither serve them to others nor answer keyed requests, which are counted against quota, on their own.
+type ConditionalWrapper struct {
+	h      http.HandlerFunc
+	maxAge time.Duration
+}
+
+type bufferedResponseWriter struct {
+	status int
+	header http.Header
+	buff   bytes.Buffer
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	return b.buff.Write(p)
+}
+
+func (b *bufferedResponseWriter) WriteHeader(statusCode int) {
+	b.status = statusCode
+}
+
+func (c ConditionalWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		c.h(w, r)
+		return
+	}
+
+	b := bufferedResponseWriter{
+		status: http.StatusOK,
+		header: w.Header(),
+	}
+	c.h(&b, r)
+	if b.status != http.StatusOK {
+		w.WriteHeader(b.status)
+		w.Write(b.buff.Bytes())
+		return
+	}
+
+	if b.header.Get("ETag") == "" {
+		sum := sha256.Sum256(b.buff.Bytes())
+		b.header.Set("ETag", fmt.Sprintf("%q", hex.EncodeToString(sum[:16])))
+	}
+
+	if b.header.Get("Cache-Control") == "" {
+		visibility := "public"
+		if ApiKeyFromContext(r.Context()) != nil {
+			visibility = "private"
+		}
+
+		b.header.Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", visibility, int(c.maxAge.Seconds())))
+		b.header.Add("Vary", "Authorization, X-API-Key")
+	}
+
+	if isNotModified(r, b.header) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(b.status)
+	w.Write(b.buff.Bytes())
+}
+
+// isNotModified evaluates conditional headers, If-None-Match takes precedence over If-Modified-Since
+func isNotModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return !lastModified.After(ims)
+}
+
+// setLastModified does nothing for zero time
+func setLastModified(w http.ResponseWriter, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+
+	w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+}
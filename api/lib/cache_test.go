@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConditionalWrapper(t *testing.T) {
+	type tt struct {
+		header http.Header
+		status int
+	}
+
+	updated := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := ConditionalWrapper{
+		h: func(w http.ResponseWriter, r *http.Request) {
+			setLastModified(w, updated)
+			w.Write([]byte(`{"bank":"bank"}`))
+		},
+		maxAge: CACHE_MAX_AGE,
+	}
+
+	res := httptest.NewRecorder()
+	c.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/rate/bank", nil))
+	etag := res.Header().Get("ETag")
+	if res.Code != http.StatusOK || etag == "" || res.Header().Get("Cache-Control") != "public, max-age=60" || res.Header().Get("Vary") != "Authorization, X-API-Key" {
+		t.Fatalf("unexpected response %d, %v\n", res.Code, res.Header())
+	}
+
+	ts := []tt{
+		{header: http.Header{"If-None-Match": {etag}}, status: http.StatusNotModified},
+		{header: http.Header{"If-None-Match": {`"other", W/` + etag}}, status: http.StatusNotModified},
+		{header: http.Header{"If-None-Match": {`"other"`}}, status: http.StatusOK},
+		{header: http.Header{"If-Modified-Since": {updated.Format(http.TimeFormat)}}, status: http.StatusNotModified},
+		{header: http.Header{"If-Modified-Since": {updated.Add(-time.Second).Format(http.TimeFormat)}}, status: http.StatusOK},
+		{
+			header: http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {updated.Format(http.TimeFormat)}},
+			status: http.StatusOK,
+		},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/rate/bank", nil)
+			req.Header = test.header
+			res := httptest.NewRecorder()
+			c.ServeHTTP(res, req)
+			if res.Code != test.status {
+				t.Errorf("expected status %d, got %d\n", test.status, res.Code)
+			}
+
+			if res.Code == http.StatusNotModified && res.Body.Len() != 0 {
+				t.Errorf("expected empty body, got %q\n", res.Body.String())
+			}
+		})
+	}
+}
+
+func TestConditionalWrapperPrivate(t *testing.T) {
+	type tt struct {
+		key *model.ApiKey
+		e   string
+	}
+
+	c := ConditionalWrapper{
+		h: func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"bank":"bank"}`))
+		},
+		maxAge: CACHE_MAX_AGE,
+	}
+
+	ts := []tt{
+		{key: nil, e: "public, max-age=60"},
+		{key: &model.ApiKey{Id: "key", Scopes: []string{SCOPE_READ}}, e: "private, max-age=60"},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/rates", nil)
+			if test.key != nil {
+				req = req.WithContext(context.WithValue(req.Context(), apiKeyCtxKey{}, test.key))
+			}
+
+			res := httptest.NewRecorder()
+			c.ServeHTTP(res, req)
+			if res.Header().Get("Cache-Control") != test.e {
+				t.Errorf("expected %v, got %v\n", test.e, res.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
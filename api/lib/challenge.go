@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// CHALLENGE_TTL is how long a challenge may be solved and used
+	CHALLENGE_TTL = 5 * time.Minute
+	// DEFAULT_CHALLENGE_DIFFICULTY takes about a million hashes, a second or two in a browser
+	DEFAULT_CHALLENGE_DIFFICULTY = 20
+)
+
+var (
+	ErrChallengeInvalid  = errors.New("challenge is invalid")
+	ErrChallengeExpired  = errors.New("challenge is expired")
+	ErrChallengeUnsolved = errors.New("challenge is not solved")
+)
+
+type Challenge struct {
+	Challenge string `json:"challenge"`
+	// Difficulty is number of leading zero bits of sha256("challenge:nonce") required
+	Difficulty int       `json:"difficulty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// NewChallenge returns stateless challenge "expires.random.signature", signed with secret
+func NewChallenge(secret string, difficulty int, now time.Time) Challenge {
+	expiresAt := now.Add(CHALLENGE_TTL).Truncate(time.Second)
+	payload := strconv.FormatInt(expiresAt.Unix(), 10) + "." + randomHex(16)
+	return Challenge{
+		Challenge:  payload + "." + signChallenge(secret, payload),
+		Difficulty: difficulty,
+		ExpiresAt:  expiresAt,
+	}
+}
+
+// VerifyChallenge checks signature, expiration and proof of work of the solved challenge.
+// Single use has to be checked separately.
+func VerifyChallenge(secret string, difficulty int, challenge, nonce string, now time.Time) error {
+	payload, signature, ok := cutLast(challenge, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signChallenge(secret, payload))) {
+		return ErrChallengeInvalid
+	}
+
+	expiresRaw, _, _ := strings.Cut(payload, ".")
+	expires, err := strconv.ParseInt(expiresRaw, 10, 64)
+	if err != nil {
+		return ErrChallengeInvalid
+	}
+
+	if now.After(time.Unix(expires, 0)) {
+		return ErrChallengeExpired
+	}
+
+	if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) < difficulty {
+		return ErrChallengeUnsolved
+	}
+
+	return nil
+}
+
+// SolveChallenge finds nonce by brute force, as clients are expected to
+func SolveChallenge(challenge string, difficulty int) string {
+	for i := 0; ; i += 1 {
+		nonce := strconv.Itoa(i)
+		if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) >= difficulty {
+			return nonce
+		}
+	}
+}
+
+func (api Api) HandleGetChallenge(w http.ResponseWriter, r *http.Request) {
+	if api.conf.ChallengeSecret == "" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "challenge is not enabled"})
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(NewChallenge(api.conf.ChallengeSecret, api.conf.ChallengeDifficulty, time.Now()))
+}
+
+func signChallenge(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+
+		n += 8
+	}
+
+	return n
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+
+	return s[:i], s[i+len(sep):], true
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestVerifyChallenge(t *testing.T) {
+	type tt struct {
+		secret    string
+		challenge string
+		nonce     string
+		now       time.Time
+		e         error
+	}
+
+	now := time.Now()
+	difficulty := 8
+	c := NewChallenge("secret", difficulty, now)
+	nonce := SolveChallenge(c.Challenge, difficulty)
+	wrong := "x"
+	for VerifyChallenge("secret", difficulty, c.Challenge, wrong, now) == nil {
+		wrong += "x"
+	}
+
+	ts := []tt{
+		{secret: "secret", challenge: c.Challenge, nonce: nonce, now: now, e: nil},
+		{secret: "secret", challenge: c.Challenge, nonce: wrong, now: now, e: ErrChallengeUnsolved},
+		{secret: "other", challenge: c.Challenge, nonce: nonce, now: now, e: ErrChallengeInvalid},
+		{secret: "secret", challenge: "1" + c.Challenge, nonce: nonce, now: now, e: ErrChallengeInvalid},
+		{secret: "secret", challenge: "garbage", nonce: nonce, now: now, e: ErrChallengeInvalid},
+		{secret: "secret", challenge: c.Challenge, nonce: nonce, now: now.Add(CHALLENGE_TTL + time.Second), e: ErrChallengeExpired},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if err := VerifyChallenge(test.secret, difficulty, test.challenge, test.nonce, test.now); err != test.e {
+				t.Errorf("expected %v, got %v\n", test.e, err)
+			}
+		})
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	type tt struct {
+		i   string
+		e   Limit
+		err bool
+	}
+
+	ts := []tt{
+		{i: "10/1h", e: Limit{Count: 10, Window: time.Hour}},
+		{i: "5/30s", e: Limit{Count: 5, Window: 30 * time.Second}},
+		{i: "0", e: Limit{}},
+		{i: "10", err: true},
+		{i: "-1/1h", err: true},
+		{i: "10/0s", err: true},
+		{i: "ten/1h", err: true},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			res, err := ParseLimit(test.i)
+			if (err != nil) != test.err {
+				t.Errorf("expected error %v, got %v\n", test.err, err)
+			}
+
+			if res != test.e {
+				t.Errorf("expected %v, got %v\n", test.e, res)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"context"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// COLLECT_TIMEOUT bounds reading rates on a single scrape
+const COLLECT_TIMEOUT = 2 * time.Second
+
+// RateCollector exports current rates of every bank on scrape, so rates can be charted and alerted on.
+// Official rates are not exported, they are not exchange offers and are listed apart from banks.
+type RateCollector struct {
+	db   *shared.Database
+	rate *prometheus.Desc
+	age  *prometheus.Desc
+	now  func() time.Time
+}
+
+func NewRateCollector(rdb *redis.Client) *RateCollector {
+	return &RateCollector{
+		db:  shared.NewDb(rdb),
+		now: time.Now,
+		rate: prometheus.NewDesc(
+			"usd_rate",
+			"Current USD rate of the bank in UAH, not quoted rates are omitted.",
+			[]string{"bank", "kind"}, nil,
+		),
+		age: prometheus.NewDesc(
+			"usd_rate_age_seconds",
+			"Time since the bank rate was updated.",
+			[]string{"bank"}, nil,
+		),
+	}
+}
+
+func (c *RateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.rate
+	ch <- c.age
+}
+
+func (c *RateCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), COLLECT_TIMEOUT)
+	defer cancel()
+	rates, err := c.db.GetBankPrices(ctx)
+	if err != nil {
+		logger.Error("failed to collect rates", "err", err)
+		ch <- prometheus.NewInvalidMetric(c.rate, err)
+		return
+	}
+
+	now := c.now()
+	for _, rate := range rates {
+		for kind, value := range map[string]float64{
+			"buy":         rate.Buy,
+			"sell":        rate.Sell,
+			"buy_online":  rate.BuyOnline,
+			"sell_online": rate.SellOnline,
+		} {
+			if value <= 0 {
+				continue
+			}
+
+			ch <- prometheus.MustNewConstMetric(c.rate, prometheus.GaugeValue, value, rate.Bank, kind)
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.age, prometheus.GaugeValue, now.Sub(rate.LastUpdated).Seconds(), rate.Bank)
+	}
+}
@@ -0,0 +1,47 @@
+package lib
+
+import (
+	"context"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/testenv"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateCollector(t *testing.T) {
+	rdb, _ := testenv.NewRedis(t)
+	now := time.Date(2024, time.June, 10, 12, 0, 0, 0, time.UTC)
+	// not quoted online rates are omitted, the official rate is not exported
+	for _, rate := range []model.BankRate{
+		{Bank: "first", Buy: 40, BuyOnline: 40.1, Sell: 41, SellOnline: 40.9, LastUpdated: now.Add(-time.Minute)},
+		{Bank: "second", Buy: 40.5, Sell: 40.8, LastUpdated: now.Add(-time.Hour)},
+		{Bank: "official", Buy: 40.3, Sell: 40.3, LastUpdated: now, Official: true},
+	} {
+		if err := shared.NewDb(rdb).SetBankPrice(context.Background(), &rate); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewRateCollector(rdb)
+	c.now = func() time.Time { return now }
+	e := `
+# HELP usd_rate Current USD rate of the bank in UAH, not quoted rates are omitted.
+# TYPE usd_rate gauge
+usd_rate{bank="first",kind="buy"} 40
+usd_rate{bank="first",kind="buy_online"} 40.1
+usd_rate{bank="first",kind="sell"} 41
+usd_rate{bank="first",kind="sell_online"} 40.9
+usd_rate{bank="second",kind="buy"} 40.5
+usd_rate{bank="second",kind="sell"} 40.8
+# HELP usd_rate_age_seconds Time since the bank rate was updated.
+# TYPE usd_rate_age_seconds gauge
+usd_rate_age_seconds{bank="first"} 60
+usd_rate_age_seconds{bank="second"} 3600
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(e)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/market"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_MAX_AGE is the age after which quotes are considered stale
+const DEFAULT_MAX_AGE = 24 * time.Hour
+
+func (api Api) HandleGetBestRates(w http.ResponseWriter, r *http.Request) {
+	rates, ok := api.freshRates(w, r)
+	if !ok {
+		return
+	}
+
+	json.NewEncoder(w).Encode(market.FindBest(rates))
+}
+
+func (api Api) HandleGetRatesSummary(w http.ResponseWriter, r *http.Request) {
+	rates, ok := api.freshRates(w, r)
+	if !ok {
+		return
+	}
+
+	json.NewEncoder(w).Encode(market.Summarize(rates))
+}
+
+// freshRates returns rates not older than max_age param, writes error response if it fails
+func (api Api) freshRates(w http.ResponseWriter, r *http.Request) ([]model.BankRate, bool) {
+	maxAge := DEFAULT_MAX_AGE
+	if param := r.URL.Query().Get("max_age"); param != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(param); err != nil || maxAge <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "max_age is wrong"})
+			return nil, false
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+	rates, err := api.db.GetBankPrices(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to get rates", "err", err)
+		return nil, false
+	}
+
+	return market.Fresh(rates, time.Now(), maxAge), true
+}
+
+// parseFiniteFloat rejects NaN and infinities, which strconv.ParseFloat accepts and comparisons let through
+func parseFiniteFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%q is not a finite number", s)
+	}
+
+	return f, nil
+}
+
+func (api Api) HandleConvert(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	amount, err := parseFiniteFloat(query.Get("amount"))
+	if err != nil || amount <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "amount is wrong"})
+		return
+	}
+
+	from, to := strings.ToUpper(query.Get("from")), strings.ToUpper(query.Get("to"))
+	channel := strings.ToLower(query.Get("channel"))
+	if channel == "" {
+		channel = market.CASH
+	}
+
+	var (
+		conversion market.Conversion
+		// only conversion by a single rate has Last-Modified, best conversion changes with the set of fresh rates
+		modified time.Time
+	)
+	if bank := query.Get("bank"); bank != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+		defer cancel()
+		var price *model.BankRate
+		if price, err = api.db.GetBankPrice(ctx, bank); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+			logger.ErrorContext(r.Context(), "failed to get rate", "bank", bank, "err", err)
+			return
+		}
+
+		if price == nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "bank not found"})
+			return
+		}
+
+		modified = price.LastUpdated
+		conversion, err = market.Convert(*price, amount, from, to, channel)
+	} else {
+		rates, ok := api.freshRates(w, r)
+		if !ok {
+			return
+		}
+
+		conversion, err = market.BestConversion(rates, amount, from, to, channel)
+	}
+
+	switch {
+	case errors.Is(err, market.ErrUnsupported):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "conversion is not supported"})
+	case errors.Is(err, market.ErrNotQuoted):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "rate is not quoted"})
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to convert", "err", err)
+	default:
+		setLastModified(w, modified)
+		json.NewEncoder(w).Encode(conversion)
+	}
+}
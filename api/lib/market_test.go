@@ -0,0 +1,34 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseFiniteFloat(t *testing.T) {
+	type tt struct {
+		s   string
+		e   float64
+		err bool
+	}
+
+	ts := []tt{
+		{s: "100.5", e: 100.5},
+		{s: "-1", e: -1},
+		{s: "NaN", err: true},
+		{s: "nan", err: true},
+		{s: "Inf", err: true},
+		{s: "-Infinity", err: true},
+		{s: "1e400", err: true},
+		{s: "", err: true},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			f, err := parseFiniteFloat(test.s)
+			if (err != nil) != test.err || f != test.e {
+				t.Errorf("expected %v %v, got %v %v\n", test.e, test.err, f, err)
+			}
+		})
+	}
+}
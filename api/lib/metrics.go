@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/logging"
+	"github.com/charkpep/usd_rate_api/shared/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// REQUEST_ID_HEADER is accepted from clients and proxies and echoed in the response
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// requestIdPattern limits propagated ids, so clients can not inject arbitrary data into logs
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,64}$`)
+
+var tracer = otel.Tracer("github.com/charkpep/usd_rate_api/api")
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_http_requests_total",
+		Help: "Number of handled HTTP requests by route and response status.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "api_http_request_duration_seconds",
+		Help:    "Latency of handled HTTP requests by route and response status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// InstrumentWrapper assigns request id, starts span continuing trace of the caller if any,
+// records request count and latency of the route and logs a line per request
+type InstrumentWrapper struct {
+	route string
+	h     http.HandlerFunc
+}
+
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusResponseWriter) WriteHeader(statusCode int) {
+	s.status = statusCode
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush streams
+func (s *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (i InstrumentWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := r.Header.Get(REQUEST_ID_HEADER)
+	if !requestIdPattern.MatchString(id) {
+		id = logging.NewRequestId()
+	}
+
+	w.Header().Set(REQUEST_ID_HEADER, id)
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, r.Method+" "+i.route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", i.route),
+			attribute.String("request_id", id),
+		),
+	)
+	r = r.WithContext(logging.WithRequestId(ctx, id))
+	sw := statusResponseWriter{
+		ResponseWriter: w,
+		status:         http.StatusOK,
+	}
+	i.h(&sw, r)
+	elapsed := time.Since(start)
+	status := strconv.Itoa(sw.status)
+	span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+	var err error
+	if sw.status >= http.StatusInternalServerError {
+		err = fmt.Errorf("status %d", sw.status)
+	}
+
+	tracing.End(span, err)
+	httpRequests.WithLabelValues(r.Method, i.route, status).Inc()
+	httpDuration.WithLabelValues(r.Method, i.route, status).Observe(elapsed.Seconds())
+	logger.InfoContext(r.Context(), "request",
+		"method", r.Method,
+		"route", i.route,
+		"path", r.URL.Path,
+		"status", sw.status,
+		"duration", elapsed,
+		"remote", r.RemoteAddr,
+	)
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Limit struct {
+	// Count is number of requests allowed per Window, zero disables the limit
+	Count  int64
+	Window time.Duration
+}
+
+type SubscribeLimits struct {
+	Ip     Limit
+	Domain Limit
+	Global Limit
+}
+
+// ParseLimit reads limit in "count/window" format, e.g. "10/1h", "0" disables limit
+func ParseLimit(s string) (Limit, error) {
+	if s == "0" {
+		return Limit{}, nil
+	}
+
+	countRaw, windowRaw, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("limit %q is not in count/window format", s)
+	}
+
+	count, err := strconv.ParseInt(countRaw, 10, 64)
+	if err != nil || count < 0 {
+		return Limit{}, fmt.Errorf("limit %q has wrong count", s)
+	}
+
+	window, err := time.ParseDuration(windowRaw)
+	if err != nil || window <= 0 {
+		return Limit{}, fmt.Errorf("limit %q has wrong window", s)
+	}
+
+	return Limit{Count: count, Window: window}, nil
+}
+
+// RateLimitWrapper rejects requests exceeding any of the limits with 429 and Retry-After.
+// Requests are let through if limits can not be checked.
+type RateLimitWrapper struct {
+	h      http.HandlerFunc
+	db     *shared.Database
+	limits func(r *http.Request) []shared.RateLimit
+}
+
+func (rl RateLimitWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if allowRequest(w, r, rl.db, rl.limits(r)) {
+		rl.h(w, r)
+	}
+}
+
+// allowRequest records request in limits, writes 429 response and returns false if any of them is exceeded
+func allowRequest(w http.ResponseWriter, r *http.Request, db *shared.Database, limits []shared.RateLimit) bool {
+	wait, err := db.AllowRequest(r.Context(), limits)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to check rate limit", "err", err)
+	}
+
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "too many requests"})
+		return false
+	}
+
+	return true
+}
+
+// subscribeIpLimits limits subscription attempts per client ip, checked before the request is read
+func (api Api) subscribeIpLimits(r *http.Request) []shared.RateLimit {
+	return subscribeLimits(map[string]Limit{"ip:" + clientIp(r, api.conf.TrustProxy): api.conf.SubscribeLimits.Ip})
+}
+
+// subscribeEmailLimits limits subscriptions per email domain and globally. They are checked only for valid requests,
+// so invalid ones can not use up limits of other clients.
+func (api Api) subscribeEmailLimits(email string) []shared.RateLimit {
+	_, domain, _ := strings.Cut(email, "@")
+	return subscribeLimits(map[string]Limit{
+		"domain:" + strings.ToLower(domain): api.conf.SubscribeLimits.Domain,
+		"global":                            api.conf.SubscribeLimits.Global,
+	})
+}
+
+func subscribeLimits(limits map[string]Limit) []shared.RateLimit {
+	res := make([]shared.RateLimit, 0, len(limits))
+	for key, limit := range limits {
+		if limit.Count > 0 {
+			res = append(res, shared.RateLimit{Key: "subscribe:" + key, Limit: limit.Count, Window: limit.Window})
+		}
+	}
+
+	return res
+}
+
+// clientIp takes the first X-Forwarded-For address if proxy is trusted, remote address otherwise
+func clientIp(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			ip, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(ip)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_CSV  = "csv"
+	FORMAT_XML  = "xml"
+	FORMAT_TEXT = "text"
+)
+
+var contentTypes = map[string]string{
+	FORMAT_JSON: "application/json",
+	FORMAT_CSV:  "text/csv; charset=utf-8",
+	FORMAT_XML:  "application/xml; charset=utf-8",
+	FORMAT_TEXT: "text/plain; charset=utf-8",
+}
+
+var mediaTypeFormats = map[string]string{
+	"*/*":              FORMAT_JSON,
+	"application/*":    FORMAT_JSON,
+	"application/json": FORMAT_JSON,
+	"text/csv":         FORMAT_CSV,
+	"application/xml":  FORMAT_XML,
+	"text/xml":         FORMAT_XML,
+	"text/plain":       FORMAT_TEXT,
+	"text/*":           FORMAT_TEXT,
+}
+
+type xmlRate struct {
+	XMLName xml.Name `xml:"rate"`
+	model.BankRate
+}
+
+type xmlRates struct {
+	XMLName xml.Name         `xml:"rates"`
+	Rates   []model.BankRate `xml:"rate"`
+}
+
+// negotiateFormat picks format by ?format= param or Accept header, json if none specified.
+// Returns false if none of the acceptable formats is supported.
+func negotiateFormat(r *http.Request) (string, bool) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		_, ok := contentTypes[format]
+		return format, ok
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return FORMAT_JSON, true
+	}
+
+	type candidate struct {
+		format string
+		q      float64
+	}
+
+	candidates := make([]candidate, 0)
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+
+		format, ok := mediaTypeFormats[mediaType]
+		if !ok {
+			continue
+		}
+
+		q := 1.0
+		if param, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(param, 64); err != nil {
+				continue
+			}
+		}
+
+		if q > 0 {
+			candidates = append(candidates, candidate{format: format, q: q})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+
+	return candidates[0].format, true
+}
+
+// renderRates writes rates in the format, a single object for json and xml unless list is set
+func renderRates(w http.ResponseWriter, format string, rates []model.BankRate, list bool) error {
+	w.Header().Set("Content-Type", contentTypes[format])
+	w.Header().Add("Vary", "Accept")
+	switch format {
+	case FORMAT_CSV:
+		return writeRatesCsv(w, rates)
+	case FORMAT_TEXT:
+		return writeRatesText(w, rates)
+	case FORMAT_XML:
+		io.WriteString(w, xml.Header)
+		enc := xml.NewEncoder(w)
+		if !list && len(rates) == 1 {
+			return enc.Encode(xmlRate{BankRate: rates[0]})
+		}
+
+		return enc.Encode(xmlRates{Rates: rates})
+	default:
+		if !list && len(rates) == 1 {
+			return json.NewEncoder(w).Encode(rates[0])
+		}
+
+		return json.NewEncoder(w).Encode(rates)
+	}
+}
+
+func writeRatesCsv(w io.Writer, rates []model.BankRate) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"bank", "buy", "sell", "buy_online", "sell_online", "update_at", "source", "site_url"})
+	for _, rate := range rates {
+		cw.Write([]string{
+			rate.Bank,
+			formatRate(rate.Buy),
+			formatRate(rate.Sell),
+			formatRate(rate.BuyOnline),
+			formatRate(rate.SellOnline),
+			rate.LastUpdated.Format(time.RFC3339),
+			rate.Source,
+			rate.SiteUrl,
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeRatesText(w io.Writer, rates []model.BankRate) error {
+	for _, rate := range rates {
+		_, err := fmt.Fprintf(w, "%s buy=%s sell=%s buy_online=%s sell_online=%s update_at=%s\n",
+			rate.Bank,
+			formatRate(rate.Buy),
+			formatRate(rate.Sell),
+			formatRate(rate.BuyOnline),
+			formatRate(rate.SellOnline),
+			rate.LastUpdated.Format(time.RFC3339),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func formatRate(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
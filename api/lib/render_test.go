@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	type tt struct {
+		url    string
+		accept string
+		e      string
+		ok     bool
+	}
+
+	ts := []tt{
+		{url: "/rate", accept: "", e: FORMAT_JSON, ok: true},
+		{url: "/rate", accept: "*/*", e: FORMAT_JSON, ok: true},
+		{url: "/rate", accept: "text/csv", e: FORMAT_CSV, ok: true},
+		{url: "/rate", accept: "text/html, application/xml;q=0.9, text/plain;q=0.5", e: FORMAT_XML, ok: true},
+		{url: "/rate", accept: "application/json;q=0.1, text/plain", e: FORMAT_TEXT, ok: true},
+		{url: "/rate?format=csv", accept: "application/json", e: FORMAT_CSV, ok: true},
+		{url: "/rate", accept: "image/png", ok: false},
+		{url: "/rate", accept: "text/csv;q=0", ok: false},
+		{url: "/rate?format=pdf", ok: false},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.url, nil)
+			if test.accept != "" {
+				r.Header.Set("Accept", test.accept)
+			}
+
+			format, ok := negotiateFormat(r)
+			if ok != test.ok || (ok && format != test.e) {
+				t.Errorf("expected %q, %v, got %q, %v\n", test.e, test.ok, format, ok)
+			}
+		})
+	}
+}
+
+func TestRenderRates(t *testing.T) {
+	type tt struct {
+		format string
+		list   bool
+		e      string
+	}
+
+	updated := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	rates := []model.BankRate{
+		{Bank: "bank", Buy: 41.1, Sell: 41.65, BuyOnline: 0, SellOnline: 41.5, LastUpdated: updated, Source: "source.com", SiteUrl: "/bank.com"},
+	}
+
+	ts := []tt{
+		{
+			format: FORMAT_CSV,
+			e:      "bank,buy,sell,buy_online,sell_online,update_at,source,site_url\nbank,41.1,41.65,0,41.5,2024-01-01T12:00:00Z,source.com,/bank.com\n",
+		},
+		{
+			format: FORMAT_TEXT,
+			e:      "bank buy=41.1 sell=41.65 buy_online=0 sell_online=41.5 update_at=2024-01-01T12:00:00Z\n",
+		},
+		{
+			format: FORMAT_XML,
+			e:      "<rate><bank>bank</bank><buy>41.1</buy>",
+		},
+		{
+			format: FORMAT_XML,
+			list:   true,
+			e:      "<rates><rate><bank>bank</bank>",
+		},
+		{
+			format: FORMAT_JSON,
+			list:   true,
+			e:      `[{"bank":"bank","buy":41.1`,
+		},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			res := httptest.NewRecorder()
+			if err := renderRates(res, test.format, rates, test.list); err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Header().Get("Content-Type") != contentTypes[test.format] {
+				t.Errorf("expected content type %q, got %q\n", contentTypes[test.format], res.Header().Get("Content-Type"))
+			}
+
+			if !strings.Contains(res.Body.String(), test.e) {
+				t.Errorf("expected body to contain %q, got %q\n", test.e, res.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// STREAM_HEARTBEAT is the max interval between events sent to keep connection alive
+const STREAM_HEARTBEAT = 15 * time.Second
+
+// STREAM_BUFFER is number of updates queued for a client, slower clients are disconnected and resume with Last-Event-ID
+const STREAM_BUFFER = 64
+
+var eventIdPattern = regexp.MustCompile(`^\d+-\d+$`)
+
+// rateHub reads rate updates once per process and fans them out to stream clients.
+// Reading starts with the first client and stops when the last one leaves.
+type rateHub struct {
+	ctx     context.Context
+	db      *shared.Database
+	mu      sync.Mutex
+	running bool
+	// lastId is the last update sent to clients
+	lastId string
+	subs   map[chan shared.RateUpdate]struct{}
+}
+
+func newRateHub(ctx context.Context, db *shared.Database) *rateHub {
+	return &rateHub{ctx: ctx, db: db, subs: make(map[chan shared.RateUpdate]struct{})}
+}
+
+// subscribe returns channel receiving updates published after the returned id.
+// The channel is closed if reading fails or the client falls behind.
+func (h *rateHub) subscribe(ctx context.Context) (chan shared.RateUpdate, string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.running {
+		lastId, err := h.db.LastBankPriceUpdateId(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+
+		h.lastId = lastId
+		h.running = true
+		go h.run()
+	}
+
+	ch := make(chan shared.RateUpdate, STREAM_BUFFER)
+	h.subs[ch] = struct{}{}
+	return ch, h.lastId, nil
+}
+
+func (h *rateHub) unsubscribe(ch chan shared.RateUpdate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+func (h *rateHub) run() {
+	h.mu.Lock()
+	lastId := h.lastId
+	h.mu.Unlock()
+	for {
+		updates, err := h.db.ReadBankPriceUpdates(h.ctx, lastId, STREAM_HEARTBEAT)
+		if err != nil && h.ctx.Err() == nil {
+			logger.ErrorContext(h.ctx, "failed to read updates", "err", err)
+		}
+
+		h.mu.Lock()
+		if err != nil || len(h.subs) == 0 {
+			// clients resume from their last event on reconnect
+			for ch := range h.subs {
+				delete(h.subs, ch)
+				close(ch)
+			}
+			h.running = false
+			h.mu.Unlock()
+			return
+		}
+
+		for _, update := range updates {
+			for ch := range h.subs {
+				select {
+				case ch <- update:
+				default:
+					delete(h.subs, ch)
+					close(ch)
+				}
+			}
+			lastId = update.Id
+		}
+		h.lastId = lastId
+		h.mu.Unlock()
+	}
+}
+
+// HandleRateStream sends Server-Sent Events with rate updates, of a single bank if specified.
+// Clients may resume with Last-Event-ID, otherwise only updates published after connect are sent.
+func (api Api) HandleRateStream(w http.ResponseWriter, r *http.Request) {
+	bank := r.PathValue("bank")
+	ctx := r.Context()
+	resumeId := r.Header.Get("Last-Event-ID")
+	if resumeId != "" && !eventIdPattern.MatchString(resumeId) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "Last-Event-ID is wrong"})
+		return
+	}
+
+	updates, lastId, err := api.updates.subscribe(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(ctx, "failed to subscribe to updates", "err", err)
+		return
+	}
+	defer api.updates.unsubscribe(updates)
+
+	// updates missed since Last-Event-ID are read once, the following ones come from the hub
+	missed := []shared.RateUpdate{}
+	if resumeId != "" {
+		if missed, err = api.db.GetBankPriceUpdates(ctx, resumeId, lastId); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+			logger.ErrorContext(ctx, "failed to get missed updates", "err", err)
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	// server write timeout applies to the whole response, so it is extended for every write
+	rc.SetWriteDeadline(time.Now().Add(2 * STREAM_HEARTBEAT))
+	for _, update := range missed {
+		if err := writeUpdate(ctx, w, bank, update); err != nil {
+			return
+		}
+	}
+
+	if err := flush(ctx, rc); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(STREAM_HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			rc.SetWriteDeadline(time.Now().Add(2 * STREAM_HEARTBEAT))
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+
+			rc.SetWriteDeadline(time.Now().Add(2 * STREAM_HEARTBEAT))
+			if err := writeUpdate(ctx, w, bank, update); err != nil {
+				return
+			}
+		}
+
+		if err := flush(ctx, rc); err != nil {
+			return
+		}
+	}
+}
+
+// writeUpdate writes update as event unless it is of another bank than requested
+func writeUpdate(ctx context.Context, w io.Writer, bank string, update shared.RateUpdate) error {
+	if bank != "" && update.Rate.Bank != bank {
+		return nil
+	}
+
+	data, err := json.Marshal(update.Rate)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to marshal update", "err", err)
+		return nil
+	}
+
+	return writeEvent(w, update.Id, "rate", data)
+}
+
+func flush(ctx context.Context, rc *http.ResponseController) error {
+	err := rc.Flush()
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.ErrorContext(ctx, "failed to flush stream", "err", err)
+	}
+
+	return err
+}
+
+func writeEvent(w io.Writer, id, event string, data []byte) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, event, data)
+	return err
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/testenv"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateStream(t *testing.T) {
+	type tt struct {
+		path        string
+		lastEventId string
+		status      int
+		// e are ids of expected events, "live" is id of the update published after connect
+		e []string
+	}
+
+	// every test publishes the same updates to its own redis, so they have the same ids
+	ids := []string{"1-0", "1-1"}
+	ts := []tt{
+		{path: "/rate/stream", lastEventId: "wrong", status: 400},
+		{path: "/rate/stream", status: 200, e: []string{"live"}},
+		{path: "/rate/stream", lastEventId: "0-0", status: 200, e: []string{ids[0], ids[1], "live"}},
+		{path: "/rate/second/stream", lastEventId: "0-0", status: 200, e: []string{ids[1]}},
+		{path: "/rate/stream", lastEventId: ids[0], status: 200, e: []string{ids[1], "live"}},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			rdb, _ := testenv.NewRedis(t)
+			db := shared.NewDb(rdb)
+			for j, bank := range []string{"first", "second"} {
+				err := rdb.XAdd(context.Background(), &redis.XAddArgs{
+					Stream: "rate:usd:updates",
+					ID:     ids[j],
+					Values: map[string]interface{}{"rate": fmt.Sprintf(`{"bank":%q}`, bank)},
+				}).Err()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			addr := startApi(t, NewApi(rdb, DefaultConfig()))
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.lastEventId != "" {
+				req.Header.Set("Last-Event-ID", test.lastEventId)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Fatalf("expected status %d, got %d\n", test.status, res.StatusCode)
+			}
+
+			if test.status != http.StatusOK {
+				return
+			}
+
+			live, err := db.PublishBankPrice(context.Background(), &model.BankRate{Bank: "first", LastUpdated: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the live update is of the other bank in bank streams, so the stream ends with its expected events
+			expected := strings.Replace(fmt.Sprint(test.e), "live", live, 1)
+			got := []string{}
+			scanner := bufio.NewScanner(res.Body)
+			for len(got) < len(test.e) && scanner.Scan() {
+				if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+					got = append(got, id)
+				}
+			}
+
+			if fmt.Sprint(got) != expected {
+				t.Errorf("expected %s, got %v\n", expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,623 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/logging"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/tracing"
+	"github.com/go-redsync/redsync/v4"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	WEBHOOK_CURRENCY = "USD"
+	// WEBHOOK_ATTEMPTS is number of delivery attempts of a single event
+	WEBHOOK_ATTEMPTS = 5
+	// WEBHOOK_BACKOFF is the delay before the second attempt, doubled after each next one
+	WEBHOOK_BACKOFF = time.Second
+	// WEBHOOK_MAX_FAILURES is number of consecutive failed deliveries after which webhook is disabled
+	WEBHOOK_MAX_FAILURES = 10
+	WEBHOOK_TIMEOUT      = 5 * time.Second
+	// WEBHOOK_WORKERS is number of deliveries made at once, events of a webhook are delivered by one worker in order
+	WEBHOOK_WORKERS = 8
+	// WEBHOOK_QUEUE is number of events waiting for a worker, reading updates waits when it is full
+	WEBHOOK_QUEUE = 100
+	// WEBHOOK_LOCK_EXPIRY is how long the dispatching replica holds the lock, it is extended before every read
+	WEBHOOK_LOCK_EXPIRY = 2 * STREAM_HEARTBEAT
+	// WEBHOOK_LOCK_RETRY is interval between attempts of other replicas to take over dispatching
+	WEBHOOK_LOCK_RETRY = 5 * time.Second
+)
+
+// errWebhookLockLost stops dispatching once another replica may have taken it over
+var errWebhookLockLost = errors.New("webhook dispatcher lock lost")
+
+// errWebhookAddr is returned for webhook hosts inside the deployment, e.g. loopback or cloud metadata addresses
+var errWebhookAddr = errors.New("webhook address is not public")
+
+// webhookCgnat is shared address space of carrier-grade NAT, not covered by net.IP.IsPrivate
+var webhookCgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIp reports whether ip is routable on the internet, webhooks are not delivered to any other
+func isPublicIp(ip net.IP) bool {
+	return ip != nil &&
+		!ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() &&
+		!ip.IsUnspecified() &&
+		!webhookCgnat.Contains(ip) &&
+		// 0.0.0.0/8 reaches the local host on some systems
+		!(ip.To4() != nil && ip.To4()[0] == 0)
+}
+
+// checkWebhookHost resolves host and returns errWebhookAddr if any of its addresses is not public
+func checkWebhookHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if !isPublicIp(addr.IP) {
+			return errWebhookAddr
+		}
+	}
+
+	return nil
+}
+
+// webhookDialControl rejects connections to addresses which are not public. It runs on the resolved address
+// of every connection, so a host resolving to a public address on creation and to a private one later is refused too.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if !isPublicIp(net.ParseIP(host)) {
+		return errWebhookAddr
+	}
+
+	return nil
+}
+
+// newWebhookClient returns client which connects only to public addresses, redirects included.
+// Proxy from environment is not used, the check would apply to the proxy instead of the webhook.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: WEBHOOK_TIMEOUT, Control: webhookDialControl}
+	return &http.Client{
+		Timeout: WEBHOOK_TIMEOUT,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: WEBHOOK_TIMEOUT,
+		},
+	}
+}
+
+type WebhookEvent struct {
+	Id       string          `json:"id"`
+	Type     string          `json:"type"`
+	Currency string          `json:"currency"`
+	Rate     model.BankRate  `json:"rate"`
+	Previous *model.BankRate `json:"previous,omitempty"`
+}
+
+func (api Api) HandleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "can not read request"})
+		return
+	}
+
+	hookUrl, err := url.Parse(r.Form.Get("url"))
+	if err != nil || (hookUrl.Scheme != "http" && hookUrl.Scheme != "https") || hookUrl.Host == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "url is wrong"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+	if err := checkWebhookHost(ctx, hookUrl.Hostname()); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "url host is not allowed"})
+		logger.InfoContext(r.Context(), "webhook host rejected", "host", hookUrl.Hostname(), "err", err)
+		return
+	}
+
+	currency := strings.ToUpper(r.Form.Get("currency"))
+	if currency == "" {
+		currency = WEBHOOK_CURRENCY
+	}
+
+	if currency != WEBHOOK_CURRENCY {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "currency is not supported"})
+		return
+	}
+
+	var minDelta float64
+	if param := r.Form.Get("min_delta"); param != "" {
+		if minDelta, err = parseFiniteFloat(param); err != nil || minDelta < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct{ Message string }{Message: "min_delta is wrong"})
+			return
+		}
+	}
+
+	hook := model.Webhook{
+		Id:        randomHex(16),
+		Url:       hookUrl.String(),
+		Bank:      r.Form.Get("bank"),
+		Currency:  currency,
+		MinDelta:  minDelta,
+		Secret:    randomHex(32),
+		CreatedAt: time.Now(),
+		Owner:     ApiKeyFromContext(r.Context()).Id,
+	}
+
+	if err := api.db.SetWebhook(ctx, &hook); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to create webhook", "err", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// ownedWebhook writes error response and returns nil unless webhook of the request exists and belongs to its key.
+// Webhooks of other keys are not found, so their ids are not disclosed.
+func (api Api) ownedWebhook(ctx context.Context, w http.ResponseWriter, r *http.Request) *model.Webhook {
+	hook, err := api.db.GetWebhook(ctx, r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to get webhook", "err", err)
+		return nil
+	}
+
+	key := ApiKeyFromContext(r.Context())
+	if hook == nil || (hook.Owner != key.Id && !hasScope(key, SCOPE_ADMIN)) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "webhook not found"})
+		return nil
+	}
+
+	return hook
+}
+
+func (api Api) HandleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+	hook := api.ownedWebhook(ctx, w, r)
+	if hook == nil {
+		return
+	}
+
+	hook.Secret = ""
+	json.NewEncoder(w).Encode(hook)
+}
+
+func (api Api) HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+	hook := api.ownedWebhook(ctx, w, r)
+	if hook == nil {
+		return
+	}
+
+	isDeleted, err := api.db.DeleteWebhook(ctx, hook.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to delete webhook", "err", err)
+		return
+	}
+
+	if !isDeleted {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "webhook not found"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct{ Message string }{Message: "ok"})
+}
+
+// HandleEnableWebhook delivers events to webhook disabled after failed deliveries again
+func (api Api) HandleEnableWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+	hook := api.ownedWebhook(ctx, w, r)
+	if hook == nil {
+		return
+	}
+
+	isEnabled, err := api.db.EnableWebhook(ctx, hook.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to enable webhook", "err", err)
+		return
+	}
+
+	if !isEnabled {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "webhook not found"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct{ Message string }{Message: "ok"})
+}
+
+func (api Api) HandleGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+	hook := api.ownedWebhook(ctx, w, r)
+	if hook == nil {
+		return
+	}
+
+	deliveries, err := api.db.GetWebhookDeliveries(ctx, hook.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Message string }{Message: "unexpected error occurred"})
+		logger.ErrorContext(r.Context(), "failed to get webhook deliveries", "err", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// WebhookDispatcher delivers rate updates to registered webhooks.
+// Every API replica runs one, but only the one holding the lock of the database dispatches, so events are delivered once.
+type WebhookDispatcher struct {
+	db     *shared.Database
+	client *http.Client
+}
+
+func NewWebhookDispatcher(rdb *redis.Client) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		db:     shared.NewDb(rdb),
+		client: newWebhookClient(),
+	}
+}
+
+// webhookJob is an update to deliver to hook
+type webhookJob struct {
+	hook   model.Webhook
+	update shared.RateUpdate
+}
+
+// Run dispatches updates while this replica holds the dispatcher lock, others wait to take over, until ctx is done
+func (d *WebhookDispatcher) Run(ctx context.Context) error {
+	lock := d.db.NewMutex("webhooks:dispatcher", WEBHOOK_LOCK_EXPIRY)
+	for {
+		if err := lock.TryLockContext(ctx); err == nil {
+			err = d.lead(ctx, lock)
+			if _, err := lock.UnlockContext(context.Background()); err != nil && !errors.Is(err, redsync.ErrLockAlreadyExpired) {
+				logger.WarnContext(ctx, "failed to unlock webhook dispatcher", "err", err)
+			}
+
+			if err != nil && !errors.Is(err, errWebhookLockLost) {
+				return err
+			}
+		}
+
+		select {
+		case <-time.After(WEBHOOK_LOCK_RETRY):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// lead dispatches updates after the last dispatched one until ctx is done or lock is lost,
+// on the first start only updates published after it are dispatched.
+// The last id is stored once all deliveries of read updates are done, so updates are not lost on restart.
+func (d *WebhookDispatcher) lead(ctx context.Context, lock *redsync.Mutex) error {
+	lastId, err := d.db.GetLastDispatchedUpdateId(ctx)
+	if err != nil {
+		return err
+	}
+
+	if lastId == "" {
+		if lastId, err = d.db.LastBankPriceUpdateId(ctx); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	queues := make([]chan webhookJob, WEBHOOK_WORKERS)
+	// done receives a value for every dispatched job
+	done := make(chan struct{}, WEBHOOK_WORKERS)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	for i := range queues {
+		queues[i] = make(chan webhookJob, WEBHOOK_QUEUE)
+		wg.Add(1)
+		go func(queue chan webhookJob) {
+			defer wg.Done()
+			for {
+				select {
+				case job := <-queue:
+					d.dispatch(ctx, job.hook, job.update)
+					select {
+					case done <- struct{}{}:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(queues[i])
+	}
+
+	for {
+		if ok, err := lock.ExtendContext(ctx); !ok {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			logger.WarnContext(ctx, "lost webhook dispatcher lock", "err", err)
+			return errWebhookLockLost
+		}
+
+		updates, err := d.db.ReadBankPriceUpdates(ctx, lastId, STREAM_HEARTBEAT)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		if len(updates) == 0 {
+			continue
+		}
+
+		hooks, err := d.db.GetWebhooks(ctx)
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to get webhooks", "err", err)
+			continue
+		}
+
+		// finished jobs are counted while queueing, so workers never wait for the reader
+		pending := 0
+		for _, update := range updates {
+			for _, hook := range hooks {
+				if hook.Disabled || (hook.Bank != "" && hook.Bank != update.Rate.Bank) || hook.Currency != WEBHOOK_CURRENCY {
+					continue
+				}
+
+				for queued := false; !queued; {
+					select {
+					case queues[webhookWorker(hook.Id)] <- webhookJob{hook: hook, update: update}:
+						queued = true
+						pending++
+					case <-done:
+						pending--
+					case <-ctx.Done():
+						return nil
+					}
+				}
+			}
+		}
+
+		for ; pending > 0; pending-- {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				// deliveries in progress are made again after restart
+				return nil
+			}
+		}
+
+		// a delivery may have been stopped by shutdown
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		lastId = updates[len(updates)-1].Id
+		if err := d.db.SetLastDispatchedUpdateId(ctx, lastId); err != nil {
+			logger.ErrorContext(ctx, "failed to store last dispatched update", "id", lastId, "err", err)
+		}
+	}
+}
+
+// webhookWorker picks worker of webhook, so its events are delivered in order
+func webhookWorker(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % WEBHOOK_WORKERS)
+}
+
+func (d *WebhookDispatcher) dispatch(ctx context.Context, hook model.Webhook, update shared.RateUpdate) {
+	if update.RequestId != "" {
+		ctx = logging.WithRequestId(ctx, update.RequestId)
+	}
+
+	ctx, span := tracer.Start(tracing.Extract(ctx, update.Trace), "WebhookDispatcher.dispatch",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("webhook.id", hook.Id), attribute.String("bank", update.Rate.Bank)),
+	)
+	defer span.End()
+
+	prev, err := d.db.GetWebhookLastRate(ctx, hook.Id, update.Rate.Bank)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to get webhook last rate", "webhook", hook.Id, "err", err)
+		return
+	}
+
+	if prev != nil && rateDelta(prev, &update.Rate) < hook.MinDelta {
+		return
+	}
+
+	body, err := json.Marshal(WebhookEvent{
+		Id:       update.Id,
+		Type:     "rate.changed",
+		Currency: WEBHOOK_CURRENCY,
+		Rate:     update.Rate,
+		Previous: prev,
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to marshal webhook event", "err", err)
+		return
+	}
+
+	delivery := model.WebhookDelivery{
+		Event: update.Id,
+		Bank:  update.Rate.Bank,
+	}
+
+	backoff := WEBHOOK_BACKOFF
+	for delivery.Attempts < WEBHOOK_ATTEMPTS {
+		if delivery.Attempts > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		delivery.Attempts += 1
+		delivery.Status, err = d.send(ctx, hook, update.Id, body)
+		if err == nil {
+			delivery.Success = true
+			delivery.Error = ""
+			break
+		}
+
+		delivery.Error = err.Error()
+	}
+
+	delivery.DeliveredAt = time.Now()
+	span.SetAttributes(attribute.Int("webhook.attempts", delivery.Attempts))
+	if !delivery.Success {
+		span.SetStatus(codes.Error, delivery.Error)
+	}
+
+	if err := d.db.AddWebhookDelivery(ctx, hook.Id, &delivery); err != nil {
+		logger.ErrorContext(ctx, "failed to log webhook delivery", "webhook", hook.Id, "err", err)
+	}
+
+	if delivery.Success {
+		if err := d.db.SetWebhookLastRate(ctx, hook.Id, &update.Rate); err != nil {
+			logger.ErrorContext(ctx, "failed to set webhook last rate", "webhook", hook.Id, "err", err)
+		}
+
+		if err := d.db.ResetWebhookFailures(ctx, hook.Id); err != nil {
+			logger.ErrorContext(ctx, "failed to reset webhook failures", "webhook", hook.Id, "err", err)
+		}
+		return
+	}
+
+	failures, err := d.db.IncrWebhookFailures(ctx, hook.Id)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to count webhook failure", "webhook", hook.Id, "err", err)
+		return
+	}
+
+	if failures >= WEBHOOK_MAX_FAILURES {
+		logger.WarnContext(ctx, "disabling webhook", "webhook", hook.Id, "failures", failures)
+		// webhook may be deleted while it is being delivered, it must not be stored again then
+		if _, err := d.db.DisableWebhook(ctx, hook.Id); err != nil {
+			logger.ErrorContext(ctx, "failed to disable webhook", "webhook", hook.Id, "err", err)
+		}
+	}
+}
+
+// send returns response status, error if event was not accepted
+func (d *WebhookDispatcher) send(ctx context.Context, hook model.Webhook, event string, body []byte) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", hook.Id)
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+SignWebhook(hook.Secret, timestamp, body))
+	if id := logging.RequestId(ctx); id != "" {
+		req.Header.Set(REQUEST_ID_HEADER, id)
+	}
+
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	return res.StatusCode, nil
+}
+
+// SignWebhook returns hex encoded HMAC-SHA256 of "timestamp.body", so receivers can verify both
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// rateDelta returns the biggest absolute change among quoted rates
+func rateDelta(prev, cur *model.BankRate) float64 {
+	var delta float64
+	for _, pair := range [][2]float64{
+		{prev.Buy, cur.Buy},
+		{prev.Sell, cur.Sell},
+		{prev.BuyOnline, cur.BuyOnline},
+		{prev.SellOnline, cur.SellOnline},
+	} {
+		delta = math.Max(delta, math.Abs(pair[1]-pair[0]))
+	}
+
+	return delta
+}
+
+func randomHex(n int) string {
+	buff := make([]byte, n)
+	if _, err := rand.Read(buff); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(buff)
+}
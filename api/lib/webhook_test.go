@@ -0,0 +1,399 @@
+package lib
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/testenv"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateDelta(t *testing.T) {
+	type tt struct {
+		prev model.BankRate
+		cur  model.BankRate
+		e    float64
+	}
+
+	ts := []tt{
+		{
+			prev: model.BankRate{Buy: 41.0, Sell: 41.5},
+			cur:  model.BankRate{Buy: 41.0, Sell: 41.5},
+			e:    0,
+		},
+		{
+			prev: model.BankRate{Buy: 41.0, Sell: 41.5, BuyOnline: 41.1, SellOnline: 41.4},
+			cur:  model.BankRate{Buy: 40.75, Sell: 41.5, BuyOnline: 41.1, SellOnline: 41.9},
+			e:    0.5,
+		},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if d := rateDelta(&test.prev, &test.cur); d != test.e {
+				t.Errorf("expected %v, got %v\n", test.e, d)
+			}
+		})
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"id":"1-0"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if sig := SignWebhook("secret", "1700000000", body); sig != expected {
+		t.Errorf("expected %s, got %s\n", expected, sig)
+	}
+}
+
+func TestIsPublicIp(t *testing.T) {
+	type tt struct {
+		ip string
+		e  bool
+	}
+
+	ts := []tt{
+		{ip: "93.184.216.34", e: true},
+		{ip: "2606:2800:220:1:248:1893:25c8:1946", e: true},
+		{ip: "127.0.0.1", e: false},
+		{ip: "::1", e: false},
+		{ip: "10.1.2.3", e: false},
+		{ip: "172.16.0.1", e: false},
+		{ip: "192.168.1.1", e: false},
+		{ip: "169.254.169.254", e: false},
+		{ip: "fe80::1", e: false},
+		{ip: "fd00::1", e: false},
+		{ip: "100.64.0.1", e: false},
+		{ip: "0.0.0.0", e: false},
+		{ip: "0.1.2.3", e: false},
+		{ip: "::ffff:127.0.0.1", e: false},
+		{ip: "224.0.0.1", e: false},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if res := isPublicIp(net.ParseIP(test.ip)); res != test.e {
+				t.Errorf("expected %v, got %v\n", test.e, res)
+			}
+		})
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	if _, err := newWebhookClient().Get(ts.URL); !errors.Is(err, errWebhookAddr) {
+		t.Errorf("expected %v, got %v\n", errWebhookAddr, err)
+	}
+}
+
+func TestWebhookOwner(t *testing.T) {
+	type tt struct {
+		method string
+		path   string
+		key    string
+		status int
+	}
+
+	rdb, _ := testenv.NewRedis(t)
+	db := shared.NewDb(rdb)
+	keys := []string{}
+	for _, name := range []string{"owner", "other"} {
+		key, secret := NewApiKey(name, []string{SCOPE_SUBSCRIBE}, 0)
+		if err := db.SetApiKey(context.Background(), &key); err != nil {
+			t.Fatal(err)
+		}
+
+		keys = append(keys, secret)
+	}
+
+	addr := startApi(t, NewApi(rdb, DefaultConfig()))
+	do := func(method, path, key string, form url.Values) (int, []byte) {
+		req, _ := http.NewRequest(method, addr+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, body
+	}
+
+	form := url.Values{"url": {"http://93.184.216.34/hook"}}
+	if status, _ := do(http.MethodPost, "/webhooks", "", form); status != http.StatusUnauthorized {
+		t.Fatalf("expected %d, got %d\n", http.StatusUnauthorized, status)
+	}
+
+	status, body := do(http.MethodPost, "/webhooks", keys[0], form)
+	hook := model.Webhook{}
+	if err := json.Unmarshal(body, &hook); err != nil || status != http.StatusCreated {
+		t.Fatalf("expected %d, got %d %s\n", http.StatusCreated, status, body)
+	}
+
+	ts := []tt{
+		{method: http.MethodGet, path: "/webhooks/" + hook.Id, key: keys[1], status: http.StatusNotFound},
+		{method: http.MethodGet, path: "/webhooks/" + hook.Id + "/deliveries", key: keys[1], status: http.StatusNotFound},
+		{method: http.MethodDelete, path: "/webhooks/" + hook.Id, key: keys[1], status: http.StatusNotFound},
+		{method: http.MethodPost, path: "/webhooks/" + hook.Id + "/enable", key: keys[1], status: http.StatusNotFound},
+		{method: http.MethodGet, path: "/webhooks/" + hook.Id, key: "", status: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/webhooks/" + hook.Id, key: keys[0], status: http.StatusOK},
+		{method: http.MethodGet, path: "/webhooks/" + hook.Id + "/deliveries", key: keys[0], status: http.StatusOK},
+		{method: http.MethodPost, path: "/webhooks/" + hook.Id + "/enable", key: keys[0], status: http.StatusOK},
+		{method: http.MethodDelete, path: "/webhooks/" + hook.Id, key: keys[0], status: http.StatusOK},
+		{method: http.MethodGet, path: "/webhooks/" + hook.Id, key: keys[0], status: http.StatusNotFound},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if status, body := do(test.method, test.path, test.key, nil); status != test.status {
+				t.Errorf("expected %d, got %d %s\n", test.status, status, body)
+			}
+		})
+	}
+}
+
+func TestDisableWebhook(t *testing.T) {
+	rdb, _ := testenv.NewRedis(t)
+	db := shared.NewDb(rdb)
+	ctx := context.Background()
+	hook := model.Webhook{Id: "hook", Url: "http://93.184.216.34/hook", Secret: "secret"}
+	if err := db.SetWebhook(ctx, &hook); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := db.DisableWebhook(ctx, hook.Id); !ok || err != nil {
+		t.Fatalf("expected true, got %v %v\n", ok, err)
+	}
+
+	if res, err := db.GetWebhook(ctx, hook.Id); err != nil || !res.Disabled || res.Secret != hook.Secret {
+		t.Errorf("expected disabled webhook, got %+v %v\n", res, err)
+	}
+
+	if _, err := db.IncrWebhookFailures(ctx, hook.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := db.EnableWebhook(ctx, hook.Id); !ok || err != nil {
+		t.Fatalf("expected true, got %v %v\n", ok, err)
+	}
+
+	// failures are counted from zero again
+	if res, err := db.GetWebhook(ctx, hook.Id); err != nil || res.Disabled {
+		t.Errorf("expected enabled webhook, got %+v %v\n", res, err)
+	}
+
+	if failures, err := db.IncrWebhookFailures(ctx, hook.Id); failures != 1 || err != nil {
+		t.Errorf("expected 1, got %v %v\n", failures, err)
+	}
+
+	if _, err := db.DeleteWebhook(ctx, hook.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := db.DisableWebhook(ctx, hook.Id); ok || err != nil {
+		t.Errorf("expected false, got %v %v\n", ok, err)
+	}
+
+	if res, err := db.GetWebhook(ctx, hook.Id); res != nil || err != nil {
+		t.Errorf("expected deleted webhook, got %+v %v\n", res, err)
+	}
+}
+
+func TestWebhookOrder(t *testing.T) {
+	rdb, _ := testenv.NewRedis(t)
+	db := shared.NewDb(rdb)
+	events := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first event is the slowest, so it would be delivered last without ordering
+		if len(events) == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		events <- r.Header.Get("X-Webhook-Event")
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hook := model.Webhook{Id: "hook", Url: srv.URL, Currency: WEBHOOK_CURRENCY, Secret: "secret"}
+	if err := db.SetWebhook(ctx, &hook); err != nil {
+		t.Fatal(err)
+	}
+
+	// loopback test server is allowed by default client
+	d := &WebhookDispatcher{db: db, client: srv.Client()}
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		// blocked read of updates returns once connection is closed
+		rdb.Close()
+		<-done
+	})
+
+	time.Sleep(100 * time.Millisecond)
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		id, err := db.PublishBankPrice(ctx, &model.BankRate{Bank: "bank", Buy: float64(40 + i), LastUpdated: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	got := []string{}
+	for range ids {
+		select {
+		case id := <-events:
+			got = append(got, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %v, got %v\n", ids, got)
+		}
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(ids) {
+		t.Errorf("expected %v, got %v\n", ids, got)
+	}
+}
+
+func TestWebhookSingleDispatcher(t *testing.T) {
+	rdb, _ := testenv.NewRedis(t)
+	db := shared.NewDb(rdb)
+	events := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.Header.Get("X-Webhook-Event")
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hook := model.Webhook{Id: "hook", Url: srv.URL, Currency: WEBHOOK_CURRENCY, Secret: "secret"}
+	if err := db.SetWebhook(ctx, &hook); err != nil {
+		t.Fatal(err)
+	}
+
+	// dispatchers of two replicas
+	done := make(chan error)
+	for i := 0; i < 2; i++ {
+		d := &WebhookDispatcher{db: db, client: srv.Client()}
+		go func() { done <- d.Run(ctx) }()
+	}
+	t.Cleanup(func() {
+		cancel()
+		rdb.Close()
+		<-done
+		<-done
+	})
+
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, err := db.PublishBankPrice(ctx, &model.BankRate{Bank: "bank", Buy: float64(40 + i), LastUpdated: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := 0
+	for {
+		select {
+		case <-events:
+			got++
+			continue
+		case <-time.After(500 * time.Millisecond):
+		}
+		break
+	}
+
+	if got != 3 {
+		t.Errorf("expected %v, got %v\n", 3, got)
+	}
+}
+
+func TestWebhookResume(t *testing.T) {
+	rdb, _ := testenv.NewRedis(t)
+	db := shared.NewDb(rdb)
+	events := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.Header.Get("X-Webhook-Event")
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hook := model.Webhook{Id: "hook", Url: srv.URL, Currency: WEBHOOK_CURRENCY, Secret: "secret"}
+	if err := db.SetWebhook(ctx, &hook); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first update was dispatched before restart, the following ones are published while the dispatcher is down
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		id, err := db.PublishBankPrice(ctx, &model.BankRate{Bank: "bank", Buy: float64(40 + i), LastUpdated: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err := db.SetLastDispatchedUpdateId(ctx, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &WebhookDispatcher{db: db, client: srv.Client()}
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		rdb.Close()
+		<-done
+	})
+
+	got := []string{}
+	for range ids[1:] {
+		select {
+		case id := <-events:
+			got = append(got, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %v, got %v\n", ids[1:], got)
+		}
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(ids[1:]) {
+		t.Errorf("expected %v, got %v\n", ids[1:], got)
+	}
+
+	// the last id is stored once deliveries are done
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lastId, err := db.GetLastDispatchedUpdateId(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lastId == ids[2] {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v, got %v\n", ids[2], lastId)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,34 +1,129 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/charkpep/usd_rate_api/api/lib"
+	"github.com/charkpep/usd_rate_api/shared/logging"
+	"github.com/charkpep/usd_rate_api/shared/tracing"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/redis/go-redis/v9"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
+// SHUTDOWN_TIMEOUT is how long active requests are drained on shutdown
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+func getEnvDefault(key, def string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+
+	return def
+}
+
+// getConfig overrides defaults with SUBSCRIBE_LIMIT_IP, SUBSCRIBE_LIMIT_DOMAIN, SUBSCRIBE_LIMIT_GLOBAL
+// in "count/window" format, TRUST_PROXY, SUBSCRIBE_CHALLENGE_SECRET, SUBSCRIBE_CHALLENGE_DIFFICULTY,
+// REQUIRE_API_KEY, ADMIN_API_KEY, REDIS_STEAM and CONSUMPTION_GROUP
+func getConfig() (lib.Config, error) {
+	conf := lib.DefaultConfig()
+	for key, limit := range map[string]*lib.Limit{
+		"SUBSCRIBE_LIMIT_IP":     &conf.SubscribeLimits.Ip,
+		"SUBSCRIBE_LIMIT_DOMAIN": &conf.SubscribeLimits.Domain,
+		"SUBSCRIBE_LIMIT_GLOBAL": &conf.SubscribeLimits.Global,
+	} {
+		if val, ok := os.LookupEnv(key); ok {
+			var err error
+			if *limit, err = lib.ParseLimit(val); err != nil {
+				return conf, fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	}
+
+	conf.TrustProxy = os.Getenv("TRUST_PROXY") == "true"
+	conf.ChallengeSecret = os.Getenv("SUBSCRIBE_CHALLENGE_SECRET")
+	conf.RequireApiKey = os.Getenv("REQUIRE_API_KEY") == "true"
+	conf.AdminKey = os.Getenv("ADMIN_API_KEY")
+	conf.Stream = getEnvDefault("REDIS_STEAM", conf.Stream)
+	conf.Group = getEnvDefault("CONSUMPTION_GROUP", conf.Group)
+	if val, ok := os.LookupEnv("SUBSCRIBE_CHALLENGE_DIFFICULTY"); ok {
+		difficulty, err := strconv.Atoi(val)
+		if err != nil || difficulty < 0 || difficulty > 64 {
+			return conf, fmt.Errorf("SUBSCRIBE_CHALLENGE_DIFFICULTY %q is wrong", val)
+		}
+
+		conf.ChallengeDifficulty = difficulty
+	}
+
+	return conf, nil
+}
+
 func main() {
+	logger := logging.New("api")
+	slog.SetDefault(logger)
 	url, ok := os.LookupEnv("REDIS_URL")
 	if !ok {
-		log.Fatalf("missing REDIS URL")
+		logger.Error("missing REDIS_URL")
+		os.Exit(1)
 	}
 
 	port, ok := os.LookupEnv("PORT")
 	if !ok {
-		log.Fatalf("missing PORT")
+		logger.Error("missing PORT")
+		os.Exit(1)
 	}
 	opt, err := redis.ParseURL(url)
 	if err != nil {
-		log.Println(err)
+		logger.Error("failed to parse REDIS_URL", "err", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Init(ctx, "api")
+	if err != nil {
+		logger.Error("failed to init tracing", "err", err)
 		os.Exit(1)
 	}
 
 	rdb := redis.NewClient(opt)
-	api := lib.NewApi(rdb)
+	defer rdb.Close()
+	conf, err := getConfig()
+	if err != nil {
+		logger.Error("failed to read config", "err", err)
+		os.Exit(1)
+	}
 
-	if err = api.ListenAndServer(fmt.Sprintf("0.0.0.0:%s", port)); err != nil {
-		log.Println(err)
+	api := lib.NewApi(rdb, conf)
+	prometheus.MustRegister(lib.NewRateCollector(rdb))
+	go func() {
+		if err := lib.NewWebhookDispatcher(rdb).Run(ctx); err != nil {
+			logger.Error("webhook dispatcher stopped", "err", err)
+		}
+	}()
+
+	go func() {
+		if err := api.ListenAndServer(fmt.Sprintf("0.0.0.0:%s", port)); err != nil {
+			logger.Error("server stopped", "err", err)
+		}
+		stop()
+	}()
+
+	<-ctx.Done()
+	logger.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := api.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to shut down", "err", err)
 	}
 
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("failed to flush traces", "err", err)
+	}
 }
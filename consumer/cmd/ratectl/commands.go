@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	consumer "github.com/charkpep/usd_rate_api/consumer/lib"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// DEFAULT_BANK is the bank subscribed to if bank is not specified, same as in api
+	DEFAULT_BANK = "Приватбанк"
+	// DEFAULT_REPLAY_COUNT is number of entries read at once by replay, rebuild and export
+	DEFAULT_REPLAY_COUNT = 1000
+)
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage of ratectl %s:\n", name)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+func runBanks(ctx context.Context, e env, args []string) error {
+	rates, err := e.db.GetBankPrices(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BANK\tBUY\tSELL\tBUY ONLINE\tSELL ONLINE\tUPDATED")
+	for _, rate := range rates {
+		fmt.Fprintf(tw, "%s\t%.4f\t%.4f\t%.4f\t%.4f\t%s\n", rate.Bank, rate.Buy, rate.Sell, rate.BuyOnline, rate.SellOnline, rate.LastUpdated.Format(time.RFC3339))
+	}
+
+	return tw.Flush()
+}
+
+func runSubscribers(ctx context.Context, e env, args []string) error {
+	if len(args) > 0 && (args[0] == "add" || args[0] == "rm") {
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("expected EMAIL [BANK]")
+		}
+
+		email, bank := args[1], DEFAULT_BANK
+		if len(args) == 3 {
+			bank = args[2]
+		}
+
+		var ok bool
+		var err error
+		if args[0] == "add" {
+			ok, err = e.db.AddSubscriber(ctx, email, bank)
+		} else {
+			ok, err = e.db.DeleteSubscriber(ctx, email, bank)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return fmt.Errorf("%s is not changed for %s", email, bank)
+		}
+
+		fmt.Fprintln(e.out, "ok")
+		return nil
+	}
+
+	fs := newFlagSet("subscribers")
+	limit := fs.Int("limit", 100, "max number of subscribers listed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	subscribers, err := e.db.SearchSubscribers(ctx, fs.Arg(0), *limit)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMAIL\tBANK")
+	for _, s := range subscribers {
+		fmt.Fprintf(tw, "%s\t%s\n", s.Email, s.Bank)
+	}
+
+	return tw.Flush()
+}
+
+func runStream(ctx context.Context, e env, args []string) error {
+	info, err := e.db.GetStreamInfo(ctx, e.stream, e.group)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "stream\t%s\n", e.stream)
+	fmt.Fprintf(tw, "length\t%d\n", info.Stream.Length)
+	fmt.Fprintf(tw, "first entry\t%s\n", info.Stream.FirstEntry.ID)
+	fmt.Fprintf(tw, "last entry\t%s\n", info.Stream.LastGeneratedID)
+	for _, g := range info.Groups {
+		fmt.Fprintf(tw, "group %s\tconsumers %d, pending %d, last delivered %s, lag %d\n", g.Name, g.Consumers, g.Pending, g.LastDeliveredID, g.Lag)
+	}
+
+	for _, c := range info.Consumers {
+		fmt.Fprintf(tw, "consumer %s\tpending %d, idle %s\n", c.Name, c.Pending, c.Idle)
+	}
+
+	return tw.Flush()
+}
+
+func runPending(ctx context.Context, e env, args []string) error {
+	fs := newFlagSet("pending")
+	idle := fs.Duration("idle", 0, "min time since last delivery")
+	count := fs.Int64("count", 100, "max number of entries listed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	pending, err := e.db.GetPendingEntries(ctx, e.stream, e.group, *idle, *count)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCONSUMER\tIDLE\tDELIVERIES\tBANK\tBUY\tSELL")
+	for _, p := range pending {
+		// pending entry may be trimmed already, its value is shown if it is still in stream
+		bank, buy, sell := "-", "-", "-"
+		entries, err := e.db.GetStreamRange(ctx, e.stream, p.ID, p.ID, 1)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) > 0 {
+			msg := consumer.BankRateMessage{}
+			if err := msg.Unmarshal(entries[0].Values); err != nil {
+				bank = "malformed: " + err.Error()
+			} else {
+				bank, buy, sell = msg.Bank, strconv.FormatFloat(msg.Buy, 'f', 4, 64), strconv.FormatFloat(msg.Sell, 'f', 4, 64)
+			}
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", p.ID, p.Consumer, p.Idle.Round(time.Second), p.RetryCount, bank, buy, sell)
+	}
+
+	return tw.Flush()
+}
+
+func runClaim(ctx context.Context, e env, args []string) error {
+	fs := newFlagSet("claim")
+	name := fs.String("consumer", "", "consumer claiming entries")
+	idle := fs.Duration("idle", time.Minute, "min time since last delivery")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *name == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("consumer and ids are required")
+	}
+
+	claimed, err := e.db.ClaimEntries(ctx, e.stream, e.group, *name, *idle, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range claimed {
+		fmt.Fprintln(e.out, msg.ID)
+	}
+
+	fmt.Fprintf(e.out, "claimed %d of %d\n", len(claimed), fs.NArg())
+	return nil
+}
+
+func runAck(ctx context.Context, e env, args []string) error {
+	if len(args) == 0 {
+		return errors.New("ids are required")
+	}
+
+	acked, err := e.db.AckEntries(ctx, e.stream, e.group, args)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(e.out, "acked %d of %d\n", acked, len(args))
+	return nil
+}
+
+// runReplay applies entries between START and END to rates of a namespace as consumer does, without clearing it.
+// Entries are not published again, so live consumers, webhooks and traces are not affected.
+func runReplay(ctx context.Context, e env, args []string) error {
+	fs := newFlagSet("replay")
+	namespace := fs.String("namespace", DEFAULT_REBUILD_NAMESPACE, "namespace rates are replayed into")
+	count := fs.Int64("count", DEFAULT_REPLAY_COUNT, "number of entries read at once")
+	force := fs.Bool("force", false, "allow replaying into live rates")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected START END")
+	}
+
+	if *namespace == shared.RATES_NAMESPACE && !*force {
+		return fmt.Errorf("%s holds live rates, use -force to replay into them", *namespace)
+	}
+
+	start, err := consumer.ParseRangeBound(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	end, err := consumer.ParseRangeBound(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	stats, err := consumer.Replay(ctx, e.db.InNamespace(*namespace), consumer.NewStreamReader(e.db, e.stream, start, end, *count))
+	if err != nil {
+		return err
+	}
+
+	if stats.Entries == 0 {
+		fmt.Fprintln(e.out, "nothing to replay")
+		return nil
+	}
+
+	fmt.Fprintf(e.out, "replayed %d entries %s..%s into %s: %d applied, %d stale, %d malformed\n",
+		stats.Entries, stats.FirstId, stats.LastId, *namespace, stats.Applied, stats.Stale, stats.ParseErrors)
+	return nil
+}
+
+func runMail(ctx context.Context, e env, args []string) error {
+	fs := newFlagSet("mail")
+	digest := fs.Bool("digest", false, "send digests instead of current rates")
+	dryRun := fs.Bool("dry-run", false, "only log emails")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	run := model.MailRun{
+		Digest:      *digest,
+		DryRun:      *dryRun,
+		RequestedBy: "ratectl",
+		RequestedAt: time.Now(),
+	}
+
+	id, err := e.db.RequestMailRun(ctx, &run)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(e.out, "requested mail run %s\n", id)
+	return nil
+}
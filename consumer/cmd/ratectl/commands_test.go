@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/stream"
+	"github.com/charkpep/usd_rate_api/shared/testenv"
+	"github.com/redis/go-redis/v9"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEnv returns env of an empty redis, output of commands is written to the returned buffer
+func newEnv(t *testing.T) (env, *bytes.Buffer) {
+	rdb, _ := testenv.NewRedis(t)
+	out := &bytes.Buffer{}
+	return env{db: shared.NewDb(rdb), rdb: rdb, stream: "rate:usd", group: "usd-rate", out: out}, out
+}
+
+// publish adds rates to the stream of e as scrapers do, returns their ids.
+// Fields required by the message schema are filled in.
+func publish(t *testing.T, e env, rates ...model.BankRate) []string {
+	msgs := make([]stream.BankRateMessage, 0, len(rates))
+	for _, rate := range rates {
+		rate.Source, rate.SiteUrl = "https://source.com", "https://bank.com"
+		if rate.LastUpdated.IsZero() {
+			rate.LastUpdated = time.Now()
+		}
+		msgs = append(msgs, stream.NewBankRateMessage(&rate))
+	}
+
+	ids, err := stream.NewPublisher(e.rdb, stream.PublisherConfig{Stream: e.stream}).PublishBulk(context.Background(), msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ids
+}
+
+func TestRunBanks(t *testing.T) {
+	e, out := newEnv(t)
+	rate := model.BankRate{Bank: "bank", Buy: 41.1, Sell: 41.5, LastUpdated: time.Date(2024, time.June, 10, 12, 0, 0, 0, time.UTC)}
+	if err := e.db.SetBankPrice(context.Background(), &rate); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runBanks(context.Background(), e, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := out.String(); !strings.Contains(res, "bank") || !strings.Contains(res, "41.1000") || !strings.Contains(res, "2024-06-10T12:00:00Z") {
+		t.Errorf("expected bank with its rate, got %s\n", res)
+	}
+}
+
+func TestRunPendingClaimAck(t *testing.T) {
+	type tt struct {
+		run  func(ctx context.Context, e env, args []string) error
+		args []string
+		// e is expected in output, ne is not
+		e, ne string
+	}
+
+	e, out := newEnv(t)
+	ctx := context.Background()
+	ids := publish(t, e, model.BankRate{Bank: "first", Buy: 41.1, Sell: 41.5}, model.BankRate{Bank: "second", Buy: 41, Sell: 41.6})
+	if err := e.rdb.XGroupCreate(ctx, e.stream, e.group, "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries are delivered to consumer-1 and left pending
+	err := e.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{Group: e.group, Consumer: "consumer-1", Streams: []string{e.stream, ">"}, Block: -1}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := []tt{
+		{run: runPending, e: ids[0] + "  consumer-1"},
+		{run: runPending, args: []string{"-idle", "1h"}, ne: ids[0]},
+		{run: runClaim, args: []string{"-idle", "0", "-consumer", "consumer-2", ids[1]}, e: "claimed 1 of 1"},
+		{run: runPending, e: ids[1] + "  consumer-2"},
+		{run: runAck, args: []string{ids[0], ids[1], "1-0"}, e: "acked 2 of 3"},
+		{run: runPending, ne: ids[1]},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			out.Reset()
+			if err := test.run(ctx, e, test.args); err != nil {
+				t.Fatal(err)
+			}
+
+			res := out.String()
+			if (test.e != "" && !strings.Contains(res, test.e)) || (test.ne != "" && strings.Contains(res, test.ne)) {
+				t.Errorf("expected %q and not %q, got %s\n", test.e, test.ne, res)
+			}
+		})
+	}
+}
+
+func TestRunReplay(t *testing.T) {
+	type tt struct {
+		args []string
+		// ns is namespace rate is expected in, empty if command fails
+		ns string
+	}
+
+	ts := []tt{
+		{args: []string{"-", "+"}, ns: DEFAULT_REBUILD_NAMESPACE},
+		{args: []string{"-namespace", "test", "2024-06-10T00:00:00Z", "+"}, ns: "test"},
+		{args: []string{"-namespace", shared.RATES_NAMESPACE, "-", "+"}},
+		{args: []string{"-namespace", shared.RATES_NAMESPACE, "-force", "-", "+"}, ns: shared.RATES_NAMESPACE},
+		{args: []string{"yesterday", "+"}},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			e, _ := newEnv(t)
+			ctx := context.Background()
+			publish(t, e, model.BankRate{Bank: "bank", Buy: 41.1, Sell: 41.5, LastUpdated: time.Now()})
+			err := runReplay(ctx, e, test.args)
+			if (err != nil) != (test.ns == "") {
+				t.Fatalf("expected error %v, got %v\n", test.ns == "", err)
+			}
+
+			// entries are applied, not published again
+			if length := e.rdb.XLen(ctx, e.stream).Val(); length != 1 {
+				t.Errorf("expected stream of 1 entry, got %d\n", length)
+			}
+
+			if test.ns == "" {
+				return
+			}
+
+			rate, err := e.db.InNamespace(test.ns).GetBankPrice(ctx, "bank")
+			if err != nil || rate == nil || rate.Buy != 41.1 {
+				t.Errorf("expected rate in %s, got %v %v\n", test.ns, rate, err)
+			}
+		})
+	}
+}
+
+func TestRunMail(t *testing.T) {
+	e, out := newEnv(t)
+	ctx := context.Background()
+	if err := runMail(ctx, e, []string{"-digest", "-dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := e.db.ReadMailRuns(ctx, "0", -1)
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("expected 1 run, got %v %v\n", runs, err)
+	}
+
+	if run := runs[0]; !run.Digest || !run.DryRun || run.RequestedBy != "ratectl" || out.String() != fmt.Sprintf("requested mail run %s\n", run.Id) {
+		t.Errorf("expected requested digest dry run, got %v %s\n", run, out.String())
+	}
+}
@@ -0,0 +1,105 @@
+// Command ratectl operates the rate pipeline: rates, subscribers, the scraper stream and mail runs.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+)
+
+type env struct {
+	db     *shared.Database
+	rdb    *redis.Client
+	stream string
+	group  string
+	out    io.Writer
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, e env, args []string) error
+}
+
+var commands = map[string]command{
+	"banks":       {usage: "list banks and their current rates", run: runBanks},
+	"subscribers": {usage: "[query] | add EMAIL [BANK] | rm EMAIL [BANK] - list, add or remove subscribers", run: runSubscribers},
+	"stream":      {usage: "show XINFO of the stream, group and its consumers", run: runStream},
+	"pending":     {usage: "[-idle 1m] [-count 100] - list pending entries of the group", run: runPending},
+	"claim":       {usage: "-consumer NAME [-idle 1m] ID... - claim stuck pending entries", run: runClaim},
+	"ack":         {usage: "ID... - acknowledge pending entries", run: runAck},
+	"replay":      {usage: "[-namespace replay:rate:usd] [-force] START END - apply entries to rates of namespace, ids or RFC3339 times", run: runReplay},
+	"rebuild":     {usage: "[-namespace NS] [-archive FILE] START END - rebuild rates from entries and diff them with live ones", run: runRebuild},
+	"export":      {usage: "[-gzip] -o FILE START END - write entries to archive read by rebuild", run: runExport},
+	"mail":        {usage: "[-digest] [-dry-run] - request run of listening mailer", run: runMail},
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "usage: ratectl [flags] command [args]\n\nflags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(w, "\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, commands[name].usage)
+	}
+
+	tw.Flush()
+}
+
+func getEnvDefault(key, def string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+
+	return def
+}
+
+func main() {
+	url := flag.String("redis", os.Getenv("REDIS_URL"), "redis url, REDIS_URL by default")
+	stream := flag.String("stream", getEnvDefault("REDIS_STEAM", "rate:usd"), "scraper stream")
+	group := flag.String("group", getEnvDefault("CONSUMPTION_GROUP", "usd-rate"), "consumer group")
+	flag.Usage = usage
+	flag.Parse()
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	opt, err := redis.ParseURL(*url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wrong redis url: %s\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	rdb := redis.NewClient(opt)
+	defer rdb.Close()
+	e := env{
+		db:     shared.NewDb(rdb),
+		rdb:    rdb,
+		stream: *stream,
+		group:  *group,
+		out:    os.Stdout,
+	}
+
+	if err := cmd.run(ctx, e, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	consumer "github.com/charkpep/usd_rate_api/consumer/lib"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/stream"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// DEFAULT_REBUILD_NAMESPACE is where rates are rebuilt unless specified, next to live ones
+const DEFAULT_REBUILD_NAMESPACE = "replay:" + shared.RATES_NAMESPACE
+
+// runRebuild replays entries between START and END into a namespace and shows how it differs from live rates
+func runRebuild(ctx context.Context, e env, args []string) error {
+	fs := newFlagSet("rebuild")
+	namespace := fs.String("namespace", DEFAULT_REBUILD_NAMESPACE, "namespace rates are rebuilt into, cleared first")
+	archive := fs.String("archive", "", "read entries from archive written by export instead of the stream")
+	count := fs.Int64("count", DEFAULT_REPLAY_COUNT, "number of entries read at once")
+	force := fs.Bool("force", false, "allow rebuilding live rates, e.g. to bootstrap a fresh environment")
+	all := fs.Bool("all", false, "show equal rates in diff too")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected START END")
+	}
+
+	if *namespace == shared.RATES_NAMESPACE && !*force {
+		return fmt.Errorf("%s holds live rates, use -force to rebuild them", *namespace)
+	}
+
+	start, err := consumer.ParseRangeBound(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	end, err := consumer.ParseRangeBound(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	var entries consumer.EntryReader = consumer.NewStreamReader(e.db, e.stream, start, end, *count)
+	if *archive != "" {
+		file, err := os.Open(*archive)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		ar, err := stream.NewArchiveReader(file)
+		if err != nil {
+			return err
+		}
+		defer ar.Close()
+
+		if entries, err = consumer.NewArchiveEntryReader(ar, start, end, *count); err != nil {
+			return err
+		}
+	}
+
+	target := e.db.InNamespace(*namespace)
+	deleted, err := target.DeleteBankPrices(ctx)
+	if err != nil {
+		return err
+	}
+
+	stats, err := consumer.Replay(ctx, target, entries)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(e.out, "cleared %d banks in %s\n", deleted, *namespace)
+	fmt.Fprintf(e.out, "replayed %d entries %s..%s: %d applied, %d stale, %d malformed\n",
+		stats.Entries, stats.FirstId, stats.LastId, stats.Applied, stats.Stale, stats.ParseErrors)
+	if *namespace == shared.RATES_NAMESPACE {
+		return nil
+	}
+
+	diffs, err := consumer.Diff(ctx, e.db, target)
+	if err != nil {
+		return err
+	}
+
+	return writeDiff(e.out, diffs, *all)
+}
+
+func writeDiff(w io.Writer, diffs []consumer.RateDiff, all bool) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BANK\tSTATUS\tLIVE BUY/SELL\tREBUILT BUY/SELL\tLIVE UPDATED\tREBUILT UPDATED\tHISTORY LIVE/REBUILT")
+	changed := 0
+	for _, d := range diffs {
+		status := d.Status()
+		if status != consumer.DIFF_EQUAL {
+			changed += 1
+		} else if !all {
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d/%d\n", d.Bank, status, diffRate(d.Live), diffRate(d.Rebuilt),
+			diffUpdated(d.Live), diffUpdated(d.Rebuilt), d.LiveHistory, d.RebuiltHistory)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%d of %d banks differ\n", changed, len(diffs))
+	return err
+}
+
+func diffRate(rate *model.BankRate) string {
+	if rate == nil {
+		return "-"
+	}
+
+	return fmt.Sprintf("%.4f/%.4f", rate.Buy, rate.Sell)
+}
+
+func diffUpdated(rate *model.BankRate) string {
+	if rate == nil {
+		return "-"
+	}
+
+	return rate.LastUpdated.Format(time.RFC3339)
+}
+
+// runExport writes entries between START and END to archive, so they can be rebuilt elsewhere
+func runExport(ctx context.Context, e env, args []string) error {
+	fs := newFlagSet("export")
+	out := fs.String("o", "", "archive file, created or truncated")
+	compress := fs.Bool("gzip", false, "gzip archive")
+	count := fs.Int64("count", DEFAULT_REPLAY_COUNT, "number of entries read at once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *out == "" || fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected -o FILE START END")
+	}
+
+	start, err := consumer.ParseRangeBound(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	end, err := consumer.ParseRangeBound(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	aw := stream.NewArchiveWriter(file, *compress)
+	entries := consumer.NewStreamReader(e.db, e.stream, start, end, *count)
+	written := 0
+	for {
+		batch, err := entries.Read(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := aw.Write(batch...); err != nil {
+			return err
+		}
+
+		written += len(batch)
+	}
+
+	if err := aw.Close(); err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(e.out, "exported %d entries to %s\n", written, *out)
+	return nil
+}
@@ -2,92 +2,292 @@ package consumer
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/bus"
+	"github.com/charkpep/usd_rate_api/shared/logging"
 	"github.com/charkpep/usd_rate_api/shared/model"
-	"github.com/dranikpg/gtrs"
+	"github.com/charkpep/usd_rate_api/shared/stream"
+	"github.com/charkpep/usd_rate_api/shared/tracing"
 	"github.com/redis/go-redis/v9"
-	"log"
-	"os"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"strconv"
+	"sync"
+	"time"
 )
 
-var errLogger = log.New(os.Stdout, "consumer error: ", log.LstdFlags)
+var logger = logging.New("consumer")
+
+var tracer = otel.Tracer("github.com/charkpep/usd_rate_api/consumer")
 
 type Config struct {
 	Name   string
 	Group  string
 	Stream string
-	Start  string
+	// DedupTTL is how long processed messages are remembered to skip their duplicates, nothing is skipped if zero
+	DedupTTL time.Duration
+	// ClaimIdle is how long messages of other consumers stay unacknowledged before they are claimed, not claimed if zero
+	ClaimIdle time.Duration
 }
 
+const (
+	// PROCESS_TIMEOUT bounds processing of a single message
+	PROCESS_TIMEOUT = 10 * time.Second
+	// MAX_DELIVERIES is number of times message failing to be processed is delivered before it is dropped
+	MAX_DELIVERIES = 3
+)
+
 type Consumer struct {
-	db   *shared.Database
-	rdb  *redis.Client
-	cs   *gtrs.GroupConsumer[BankRateMessage]
-	done chan struct{}
+	db     *shared.Database
+	sub    bus.Subscription
+	conf   Config
+	ctx    context.Context
+	cancel context.CancelFunc
+	// messages being processed, mu guards adding to wg against Shutdown waiting for it
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	once sync.Once
 }
 
+// NewConsumer consumes Redis stream, the group is created if missing
 func NewConsumer(rdb *redis.Client, conf Config) (*Consumer, error) {
-	cs := gtrs.NewGroupConsumer[BankRateMessage](context.Background(), rdb, conf.Group, conf.Name, conf.Stream, conf.Start)
+	return NewBusConsumer(bus.NewRedis(rdb, bus.RedisConfig{}), shared.NewDb(rdb), conf)
+}
+
+// NewBusConsumer consumes topic Stream of b, rates are stored in db
+func NewBusConsumer(b bus.Bus, db *shared.Database, conf Config) (*Consumer, error) {
+	sub, err := b.Subscribe(context.Background(), conf.Stream, conf.Group, conf.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Consumer{
-		db:   shared.NewDb(rdb),
-		cs:   cs,
-		done: make(chan struct{}),
+		db:     db,
+		sub:    sub,
+		conf:   conf,
+		ctx:    ctx,
+		cancel: cancel,
 	}, nil
 }
 
 func (c *Consumer) Close() {
-	errLogger.Println("Closing")
-	c.done <- struct{}{}
-	c.cs.AwaitAcks()
-	c.cs.Close()
+	c.Shutdown(context.Background())
+}
+
+// Shutdown stops consumption and waits for messages being processed until ctx is done.
+// Subsequent calls do nothing.
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	var err error
+	c.once.Do(func() {
+		logger.Info("closing")
+		c.mu.Lock()
+		c.cancel()
+		c.mu.Unlock()
+		done := make(chan struct{})
+		go func() {
+			c.wg.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		c.sub.Close()
+	})
+
+	return err
 }
 
+// Consume returns nil after shutdown, error if subscription fails
 func (c *Consumer) Consume() error {
+	var claims <-chan time.Time
+	if c.conf.ClaimIdle > 0 {
+		ticker := time.NewTicker(c.conf.ClaimIdle)
+		defer ticker.Stop()
+		claims = ticker.C
+	}
+
 	for {
 		select {
-		case delivery := <-c.cs.Chan():
-			switch delivery.Err.(type) {
-			case nil:
-				//TODO: write tests for race conditions, though redsync guarantees mut execution
-				go c.processMessage(context.TODO(), delivery.Data)
-				c.cs.Ack(delivery)
-			case gtrs.ParseError:
-				// Data loss is acceptable here
-				errLogger.Println(delivery.Err)
-				c.cs.Ack(delivery)
-			default:
-				return delivery.Err
+		case msg, ok := <-c.sub.Messages():
+			if !ok {
+				return c.sub.Err()
+			}
+
+			c.handle(msg)
+		case <-claims:
+			n, err := c.sub.Claim(c.ctx, c.conf.ClaimIdle)
+			if err != nil {
+				logger.Error("failed to claim messages", "err", err)
 			}
-		case <-c.done:
+
+			if n > 0 {
+				messagesClaimed.Add(float64(n))
+				logger.Info("claimed messages", "count", n)
+			}
+		case <-c.ctx.Done():
 			return nil
 		}
 	}
 }
 
-func (c *Consumer) processMessage(ctx context.Context, msg BankRateMessage) {
-	if err := c.db.Mux.LockContext(ctx); err != nil {
-		errLogger.Println(err)
+// handle processes message in background, message is acked when processed and nacked if it failed
+func (c *Consumer) handle(msg bus.Message) {
+	data := BankRateMessage{}
+	if err := data.Unmarshal(msg.Values); err != nil {
+		// Data loss is acceptable here
+		parseErrors.Inc()
+		logger.Warn("failed to parse message", "id", msg.Id, "err", err, "schema_version", msg.Values[stream.SCHEMA_VERSION_FIELD])
+		c.ack(msg)
 		return
 	}
 
-	curPrice, err := c.db.GetBankPrice(ctx, msg.Bank)
-	if err != nil {
-		errLogger.Println(err)
+	//TODO: write tests for race conditions, though redsync guarantees mut execution
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx.Err() != nil {
+		// message is left pending and delivered again after restart
 		return
 	}
 
-	if curPrice == nil || msg.UpdateAt.Sub(curPrice.LastUpdated) >= 0 {
-		price := model.BankRate{}
-		mapToBankRateModel(msg, &price)
-		if err := c.db.SetBankPrice(ctx, &price); err != nil {
-			errLogger.Println(err)
+	messagesConsumed.Inc()
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		id := data.RequestId
+		if id == "" {
+			id = logging.NewRequestId()
+		}
+
+		ctx := tracing.Extract(logging.WithRequestId(context.Background(), id), tracing.StreamCarrier{
+			"traceparent": data.Traceparent,
+			"tracestate":  data.Tracestate,
+		})
+		ctx, cancel := context.WithTimeout(ctx, PROCESS_TIMEOUT)
+		defer cancel()
+		if err := c.processMessage(ctx, data); err != nil && msg.Deliveries < MAX_DELIVERIES {
+			if err := c.sub.Nack(context.Background(), msg); err != nil {
+				logger.ErrorContext(ctx, "failed to nack message", "id", msg.Id, "err", err)
+			}
+			return
+		}
+
+		c.ack(msg)
+	}()
+}
+
+func (c *Consumer) ack(msg bus.Message) {
+	if err := c.sub.Ack(context.Background(), msg); err != nil {
+		logger.Error("failed to ack message", "id", msg.Id, "err", err)
+	}
+}
+
+// processMessage returns error if message should be processed again
+func (c *Consumer) processMessage(ctx context.Context, msg BankRateMessage) error {
+	ctx, span := tracer.Start(ctx, "Consumer.processMessage",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("bank", msg.Bank), attribute.String("request_id", logging.RequestId(ctx))),
+	)
+	defer span.End()
+	start := time.Now()
+	if err := c.db.Mux.LockContext(ctx); err != nil {
+		span.RecordError(err)
+		logger.ErrorContext(ctx, "failed to lock", "bank", msg.Bank, "err", err)
+		return err
+	}
+
+	lockWait.Observe(time.Since(start).Seconds())
+
+	defer func() {
+		if _, err := c.db.Mux.Unlock(); err != nil {
+			logger.ErrorContext(ctx, "failed to unlock", "bank", msg.Bank, "err", err)
+		}
+	}()
+
+	// message is checked under the lock and marked only once applied,
+	// so a message failing or interrupted before that is applied on redelivery
+	hash := contentHash(msg)
+	if c.conf.DedupTTL > 0 {
+		processed, err := c.db.IsProcessed(ctx, hash)
+		if err != nil {
+			// duplicates are harmless, message is processed anyway
+			logger.WarnContext(ctx, "failed to check message processed", "bank", msg.Bank, "err", err)
+		} else if processed {
+			duplicatesSkipped.Inc()
+			span.SetAttributes(attribute.Bool("duplicate", true))
+			logger.DebugContext(ctx, "skipping duplicate", "bank", msg.Bank, "update_at", msg.UpdateAt, "hash", hash)
+			return nil
+		}
+	}
+
+	price := model.BankRate{}
+	mapToBankRateModel(msg, &price)
+	updated, err := applyRate(ctx, c.db, &price)
+	if err != nil {
+		span.RecordError(err)
+		logger.ErrorContext(ctx, "failed to apply rate", "bank", msg.Bank, "err", err)
+		return err
+	}
+
+	if c.conf.DedupTTL > 0 {
+		if err := c.db.MarkProcessed(ctx, hash, c.conf.DedupTTL); err != nil {
+			logger.WarnContext(ctx, "failed to mark message processed", "bank", msg.Bank, "err", err)
+		}
+	}
+
+	if updated {
+		if _, err := c.db.PublishBankPrice(ctx, &price); err != nil {
+			logger.ErrorContext(ctx, "failed to publish rate", "bank", msg.Bank, "err", err)
 		}
+	} else {
+		staleSkipped.Inc()
+		span.SetAttributes(attribute.Bool("stale", true))
+		logger.DebugContext(ctx, "skipping stale rate", "bank", msg.Bank, "update_at", msg.UpdateAt)
+	}
+
+	return nil
+}
+
+// contentHash identifies rate of message by bank, update time and rates.
+// Request id, trace and source are not hashed, so republished rates are duplicates.
+func contentHash(msg BankRateMessage) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%s\x00%s\x00%s\x00%s", msg.Bank, msg.UpdateAt.UnixMilli(),
+		strconv.FormatFloat(msg.Buy, 'f', -1, 64), strconv.FormatFloat(msg.Sell, 'f', -1, 64),
+		strconv.FormatFloat(msg.BuyOnline, 'f', -1, 64), strconv.FormatFloat(msg.SellOnline, 'f', -1, 64))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// applyRate sets price as the current rate unless a later one is set, returns whether it was set.
+// Price is added to history anyway, history is kept for out of order updates as well.
+func applyRate(ctx context.Context, db *shared.Database, price *model.BankRate) (bool, error) {
+	curPrice, err := db.GetBankPrice(ctx, price.Bank)
+	if err != nil {
+		return false, fmt.Errorf("get rate: %w", err)
+	}
+
+	updated := false
+	if curPrice == nil || price.LastUpdated.Sub(curPrice.LastUpdated) >= 0 {
+		if err := db.SetBankPrice(ctx, price); err != nil {
+			return false, fmt.Errorf("set rate: %w", err)
+		}
+
+		updated = true
 	}
 
-	if _, err = c.db.Mux.Unlock(); err != nil {
-		errLogger.Println(err)
+	if err := db.AddBankPriceHistory(ctx, price); err != nil {
+		return updated, fmt.Errorf("add rate history: %w", err)
 	}
 
+	return updated, nil
 }
 
 func mapToBankRateModel(msg BankRateMessage, cur *model.BankRate) {
@@ -99,4 +299,5 @@ func mapToBankRateModel(msg BankRateMessage, cur *model.BankRate) {
 	cur.BuyOnline = msg.BuyOnline
 	cur.SellOnline = msg.SellOnline
 	cur.SiteUrl = msg.SiteUrl
+	cur.Official = msg.Official
 }
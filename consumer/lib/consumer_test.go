@@ -5,55 +5,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/bus"
 	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/testenv"
 	"github.com/dranikpg/gtrs"
 	"github.com/redis/go-redis/v9"
-	"github.com/testcontainers/testcontainers-go"
-	"github.com/testcontainers/testcontainers-go/wait"
-	"log"
 	"strings"
 	"testing"
 	"time"
 )
 
-func SpinUpRedis(t *testing.T) string {
-	req := testcontainers.ContainerRequest{
-		Image:        "redis:latest",
-		ExposedPorts: []string{"6379/tcp"},
-		WaitingFor:   wait.ForLog("Ready to accept connections"),
-	}
-	redisC, err := testcontainers.GenericContainer(context.Background(), testcontainers.GenericContainerRequest{
-		ContainerRequest: req,
-		Started:          true,
-	})
-	if err != nil {
-		log.Fatalf("Could not start redis: %s", err)
-	}
-
-	t.Cleanup(func() {
-		if err := redisC.Terminate(context.Background()); err != nil {
-			log.Fatalf("Could not container redis: %s", err)
-		}
-	})
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	endpoint, err := redisC.Endpoint(ctx, "")
-	if err != nil {
-		log.Fatalf("Could get redis endpoint: %s", err)
-	}
-
-	t.Log(endpoint)
-	return endpoint
-}
-
 func TestCheckAndCreateGroup(t *testing.T) {
-	opt, err := redis.ParseURL(fmt.Sprintf("redis://%s", SpinUpRedis(t)))
-	if err != nil {
-		t.Fatalf("failed to parse connection options")
-	}
-
-	rdb := redis.NewClient(opt)
+	rdb, _ := testenv.NewRedis(t)
 	rdb.XAdd(context.Background(), &redis.XAddArgs{
 		Stream: "test",
 		ID:     "*",
@@ -62,15 +25,15 @@ func TestCheckAndCreateGroup(t *testing.T) {
 		},
 	})
 
-	// Create group
-	if err := CheckAndCreateGroup(context.Background(), rdb, "test", "test", "0"); err != nil {
+	// Create group, full id as in-memory Redis reports the start id as is
+	if err := CheckAndCreateGroup(context.Background(), rdb, "test", "test", "0-0"); err != nil {
 		t.Fatal(err)
 	}
 
 	AssertGroupExists(t, rdb, "test", "test", "0-0")
 
 	// Check if error returns on the subsequent request
-	if err := CheckAndCreateGroup(context.Background(), rdb, "test", "test", "0"); err != nil {
+	if err := CheckAndCreateGroup(context.Background(), rdb, "test", "test", "0-0"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -189,21 +152,6 @@ func TestUnmarshalRequiredFields(t *testing.T) {
 
 }
 
-func MessageToMap(b BankRateMessage) map[string]any {
-	m := make(map[string]any)
-
-	// Note: if message interface changes frequently, good idea to rewrite using reflect
-	m["bank"] = b.Bank
-	m["buy"] = b.Buy
-	m["sell"] = b.Sell
-	m["buy_online"] = b.BuyOnline
-	m["sell_online"] = b.SellOnline
-	m["site_url"] = b.SiteUrl
-	m["update_at"] = b.UpdateAt
-	m["source_url"] = b.SourceUrl
-	return m
-}
-
 func TestConsume(t *testing.T) {
 	type tt struct {
 		db  []model.BankRate
@@ -274,12 +222,7 @@ func TestConsume(t *testing.T) {
 			},
 		},
 	}
-	opt, err := redis.ParseURL(fmt.Sprintf("redis://%s", SpinUpRedis(t)))
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	rdb := redis.NewClient(opt)
+	rdb, _ := testenv.NewRedis(t)
 	for i, test := range ts {
 		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
 			t.Cleanup(func() {
@@ -290,10 +233,15 @@ func TestConsume(t *testing.T) {
 				rateBuff, _ := json.Marshal(rate)
 				rdb.Set(context.Background(), fmt.Sprintf("rate:usd:%s", rate.Bank), string(rateBuff), 0)
 			}
+			values, err := test.msg.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+
 			rdb.XAdd(context.Background(), &redis.XAddArgs{
 				Stream: "rate:usd",
 				ID:     "*",
-				Values: MessageToMap(test.msg),
+				Values: values,
 			})
 
 			rdb.XGroupCreate(context.Background(), "rate:usd", "group", "0")
@@ -302,7 +250,6 @@ func TestConsume(t *testing.T) {
 				Name:   "consumer",
 				Group:  "group",
 				Stream: "rate:usd",
-				Start:  ">",
 			})
 
 			if err != nil {
@@ -324,6 +271,44 @@ func TestConsume(t *testing.T) {
 
 }
 
+func TestHandleAfterShutdown(t *testing.T) {
+	rdb, _ := testenv.NewRedis(t)
+	c, err := NewConsumer(rdb, Config{Name: "consumer", Group: "group", Stream: "rate:usd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := func(bank string) bus.Message {
+		msg := BankRateMessage{Bank: bank, Buy: 10, Sell: 11, UpdateAt: time.Now(), SourceUrl: "aggregator.com"}
+		values, err := msg.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return bus.Message{Id: "1-0", Values: values, Deliveries: 1}
+	}
+
+	// handling concurrently with Shutdown is reported by the race detector if it is not guarded
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.handle(message(fmt.Sprintf("bank_%d", i)))
+		}
+	}()
+
+	if err := c.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	<-done
+	c.handle(message("late"))
+	c.wg.Wait()
+	if rate, err := c.db.GetBankPrice(context.Background(), "late"); rate != nil || err != nil {
+		t.Errorf("expected nil, got %v %v\n", rate, err)
+	}
+}
+
 func AssertLoop(t *testing.T, rdb *redis.Client, key string, expected model.BankRate) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
@@ -347,6 +332,9 @@ func AssertLoop(t *testing.T, rdb *redis.Client, key string, expected model.Bank
 				t.Fatal(err)
 			}
 
+			// JSON keeps offset but not location of stored time
+			price.LastUpdated = price.LastUpdated.In(expected.LastUpdated.Location())
+
 			if price == expected {
 				return
 			}
@@ -355,3 +343,75 @@ func AssertLoop(t *testing.T, rdb *redis.Client, key string, expected model.Bank
 	}
 
 }
+
+func TestContentHash(t *testing.T) {
+	type tt struct {
+		i    BankRateMessage
+		same bool
+	}
+
+	at := time.Date(2024, time.June, 10, 12, 34, 56, 0, time.UTC)
+	msg := BankRateMessage{Bank: "bank", Buy: 41.05, Sell: 41.5, UpdateAt: at, SourceUrl: "src", RequestId: "req-1"}
+	ts := []tt{
+		{i: BankRateMessage{Bank: "bank", Buy: 41.05, Sell: 41.5, UpdateAt: at.In(time.Local), SourceUrl: "other", RequestId: "req-2"}, same: true},
+		{i: BankRateMessage{Bank: "bank", Buy: 41.05, Sell: 41.5, UpdateAt: at, Traceparent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}, same: true},
+		{i: BankRateMessage{Bank: "bank", Buy: 41.05, Sell: 41.6, UpdateAt: at}},
+		{i: BankRateMessage{Bank: "bank", Buy: 41.05, Sell: 41.5, UpdateAt: at.Add(time.Second)}},
+		{i: BankRateMessage{Bank: "other", Buy: 41.05, Sell: 41.5, UpdateAt: at}},
+		{i: BankRateMessage{Bank: "bank", Buy: 41.05, SellOnline: 41.5, UpdateAt: at}},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if same := contentHash(test.i) == contentHash(msg); same != test.same {
+				t.Errorf("expected %v, got %v\n", test.same, same)
+			}
+		})
+	}
+}
+
+func TestProcessAfterFailure(t *testing.T) {
+	type tt struct {
+		// fail makes the first processing fail and returns its ctx
+		fail func(rdb *redis.Client) context.Context
+	}
+
+	ts := []tt{
+		{fail: func(rdb *redis.Client) context.Context {
+			// malformed current rate fails applying
+			rdb.Set(context.Background(), "rate:usd:bank", "malformed", 0)
+			return context.Background()
+		}},
+		{fail: func(rdb *redis.Client) context.Context {
+			// processing timed out
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx
+		}},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			rdb, _ := testenv.NewRedis(t)
+			c, err := NewConsumer(rdb, Config{Name: "consumer", Group: "group", Stream: "rate:usd", DedupTTL: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg := BankRateMessage{Bank: "bank", Buy: 10, Sell: 11, UpdateAt: time.Now(), SourceUrl: "aggregator.com"}
+			if err := c.processMessage(test.fail(rdb), msg); err == nil {
+				t.Fatalf("expected error, got %v\n", err)
+			}
+
+			// redelivered message is applied, not skipped as duplicate
+			rdb.Del(context.Background(), "rate:usd:bank")
+			if err := c.processMessage(context.Background(), msg); err != nil {
+				t.Fatal(err)
+			}
+
+			if rate, err := c.db.GetBankPrice(context.Background(), "bank"); err != nil || rate == nil || rate.Buy != 10 {
+				t.Errorf("expected rate applied, got %v %v\n", rate, err)
+			}
+		})
+	}
+}
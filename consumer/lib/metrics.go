@@ -0,0 +1,124 @@
+package consumer
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+var (
+	messagesConsumed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_messages_consumed_total",
+		Help: "Number of stream messages consumed.",
+	})
+
+	parseErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_parse_errors_total",
+		Help: "Number of stream messages dropped as not parsable.",
+	})
+
+	messagesClaimed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_messages_claimed_total",
+		Help: "Number of stream messages claimed from other consumers.",
+	})
+
+	staleSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_stale_updates_skipped_total",
+		Help: "Number of updates older than the stored rate.",
+	})
+
+	duplicatesSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_duplicates_skipped_total",
+		Help: "Number of stream messages skipped as already processed.",
+	})
+
+	entriesTrimmed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_stream_entries_trimmed_total",
+		Help: "Number of stream entries deleted by retention.",
+	})
+
+	entriesArchived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "consumer_stream_entries_archived_total",
+		Help: "Number of stream entries archived before trimming.",
+	})
+
+	lockWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "consumer_lock_wait_seconds",
+		Help:    "Time spent waiting for the rate lock.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// NewStreamLagGauge reports number of stream entries not yet delivered to the group, -1 if it is unknown
+func NewStreamLagGauge(rdb *redis.Client, stream, group string) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "consumer_stream_lag",
+		Help:        "Number of stream entries not yet delivered to the consumer group.",
+		ConstLabels: prometheus.Labels{"stream": stream, "group": group},
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		groups, err := rdb.XInfoGroups(ctx, stream).Result()
+		if err != nil {
+			logger.Error("failed to get stream lag", "stream", stream, "err", err)
+			return -1
+		}
+
+		for _, g := range groups {
+			if g.Name == group {
+				return float64(g.Lag)
+			}
+		}
+
+		return -1
+	})
+}
+
+// NewStreamLengthGauge reports number of entries in stream, -1 if it is unknown
+func NewStreamLengthGauge(rdb *redis.Client, stream string) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "consumer_stream_length",
+		Help:        "Number of entries in the stream.",
+		ConstLabels: prometheus.Labels{"stream": stream},
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		length, err := rdb.XLen(ctx, stream).Result()
+		if err != nil {
+			logger.Error("failed to get stream length", "stream", stream, "err", err)
+			return -1
+		}
+
+		return float64(length)
+	})
+}
+
+// NewStreamOldestEntryGauge reports unix time the oldest retained entry was added at, 0 if stream is empty, -1 if it is unknown
+func NewStreamOldestEntryGauge(rdb *redis.Client, stream string) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "consumer_stream_oldest_entry_timestamp_seconds",
+		Help:        "Unix time the oldest entry of the stream was added at.",
+		ConstLabels: prometheus.Labels{"stream": stream},
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		entries, err := rdb.XRangeN(ctx, stream, "-", "+", 1).Result()
+		if err != nil {
+			logger.Error("failed to get oldest stream entry", "stream", stream, "err", err)
+			return -1
+		}
+
+		if len(entries) == 0 {
+			return 0
+		}
+
+		id, err := parseStreamId(entries[0].ID, false)
+		if err != nil {
+			return -1
+		}
+
+		return float64(id.ms) / 1000
+	})
+}
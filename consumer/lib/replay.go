@@ -0,0 +1,310 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/stream"
+	"github.com/dranikpg/gtrs"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statuses of rebuilt bank rates compared to live ones
+const (
+	DIFF_EQUAL   = "equal"
+	DIFF_CHANGED = "changed"
+	// DIFF_MISSING bank has live rate only
+	DIFF_MISSING = "missing"
+	// DIFF_ADDED bank has rebuilt rate only
+	DIFF_ADDED = "added"
+)
+
+// EntryReader reads stream entries in stream order, returns io.EOF after the last one
+type EntryReader interface {
+	Read(ctx context.Context) ([]redis.XMessage, error)
+}
+
+// StreamReader reads entries of the stream in [start, end] page by page, without consumer group
+type StreamReader struct {
+	db     *shared.Database
+	stream string
+	next   string
+	end    string
+	count  int64
+	done   bool
+}
+
+// NewStreamReader reads entries with ids in [start, end] by count, "-" and "+" are the ends of stream
+func NewStreamReader(db *shared.Database, stream, start, end string, count int64) *StreamReader {
+	return &StreamReader{db: db, stream: stream, next: start, end: end, count: count}
+}
+
+func (r *StreamReader) Read(ctx context.Context) ([]redis.XMessage, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+
+	entries, err := r.db.GetStreamRange(ctx, r.stream, r.next, r.end, r.count)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(entries)) < r.count {
+		r.done = true
+	}
+
+	if len(entries) == 0 {
+		return nil, io.EOF
+	}
+
+	r.next = "(" + entries[len(entries)-1].ID
+	return entries, nil
+}
+
+// ArchiveEntryReader reads entries of archive with ids in [start, end]
+type ArchiveEntryReader struct {
+	archive    *stream.ArchiveReader
+	start, end streamId
+	count      int
+	done       bool
+}
+
+// NewArchiveEntryReader reads entries with ids in [start, end] by count, bounds are the same as of NewStreamReader
+func NewArchiveEntryReader(archive *stream.ArchiveReader, start, end string, count int64) (*ArchiveEntryReader, error) {
+	startId, err := parseStreamId(start, false)
+	if err != nil {
+		return nil, err
+	}
+
+	endId, err := parseStreamId(end, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ArchiveEntryReader{archive: archive, start: startId, end: endId, count: int(count)}, nil
+}
+
+func (r *ArchiveEntryReader) Read(ctx context.Context) ([]redis.XMessage, error) {
+	entries := make([]redis.XMessage, 0, r.count)
+	for !r.done && len(entries) < r.count {
+		entry, err := r.archive.Next()
+		if errors.Is(err, io.EOF) {
+			r.done = true
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := parseStreamId(entry.ID, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if id.less(r.start) {
+			continue
+		}
+
+		// archive is in stream order, nothing is in range after end
+		if r.end.less(id) {
+			r.done = true
+			break
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if len(entries) == 0 {
+		return nil, io.EOF
+	}
+
+	return entries, ctx.Err()
+}
+
+type streamId struct {
+	ms, seq uint64
+}
+
+func (id streamId) less(other streamId) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// parseStreamId parses full or millisecond only id, which is the first id of millisecond as start and the last one as end
+func parseStreamId(str string, end bool) (streamId, error) {
+	switch str {
+	case "-":
+		return streamId{}, nil
+	case "+":
+		return streamId{ms: math.MaxUint64, seq: math.MaxUint64}, nil
+	}
+
+	ms, seq, hasSeq := strings.Cut(str, "-")
+	id := streamId{}
+	var err error
+	if id.ms, err = strconv.ParseUint(ms, 10, 64); err != nil {
+		return id, fmt.Errorf("invalid stream id %q", str)
+	}
+
+	if !hasSeq {
+		if end {
+			id.seq = math.MaxUint64
+		}
+		return id, nil
+	}
+
+	if id.seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+		return id, fmt.Errorf("invalid stream id %q", str)
+	}
+
+	return id, nil
+}
+
+// ParseRangeBound accepts stream ids, "-", "+" and RFC3339 times, which are turned into ids of that millisecond
+func ParseRangeBound(str string) (string, error) {
+	if _, err := parseStreamId(str, false); err == nil {
+		return str, nil
+	}
+
+	at, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return "", fmt.Errorf("%q is neither stream id nor RFC3339 time", str)
+	}
+
+	return strconv.FormatInt(at.UnixMilli(), 10), nil
+}
+
+type ReplayStats struct {
+	Entries int
+	// Applied entries updated the current rate, Stale ones were only added to history
+	Applied     int
+	Stale       int
+	ParseErrors int
+	FirstId     string
+	LastId      string
+}
+
+// Replay applies rates of entries to target as consumer does, without consumer group and publishing updates.
+// Malformed entries are skipped and counted, replay stops on the first database error.
+func Replay(ctx context.Context, target *shared.Database, entries EntryReader) (ReplayStats, error) {
+	stats := ReplayStats{}
+	for {
+		batch, err := entries.Read(ctx)
+		if errors.Is(err, io.EOF) {
+			return stats, nil
+		}
+
+		if err != nil {
+			return stats, err
+		}
+
+		for _, entry := range batch {
+			if stats.FirstId == "" {
+				stats.FirstId = entry.ID
+			}
+
+			stats.LastId = entry.ID
+			stats.Entries += 1
+			msg := BankRateMessage{}
+			if err := msg.Unmarshal(entry.Values); err != nil {
+				var parseErr gtrs.ParseError
+				if !errors.As(err, &parseErr) {
+					return stats, err
+				}
+
+				stats.ParseErrors += 1
+				logger.DebugContext(ctx, "skipping malformed entry", "id", entry.ID, "err", err)
+				continue
+			}
+
+			price := model.BankRate{}
+			mapToBankRateModel(msg, &price)
+			updated, err := applyRate(ctx, target, &price)
+			if err != nil {
+				return stats, fmt.Errorf("entry %s: %w", entry.ID, err)
+			}
+
+			if updated {
+				stats.Applied += 1
+			} else {
+				stats.Stale += 1
+			}
+		}
+	}
+}
+
+// RateDiff compares current rate and history length of a bank in live and rebuilt namespaces
+type RateDiff struct {
+	Bank string
+	// Live or Rebuilt is nil if bank has no rate in the namespace
+	Live           *model.BankRate
+	Rebuilt        *model.BankRate
+	LiveHistory    int64
+	RebuiltHistory int64
+}
+
+func (d RateDiff) Status() string {
+	switch {
+	case d.Rebuilt == nil:
+		return DIFF_MISSING
+	case d.Live == nil:
+		return DIFF_ADDED
+	case !sameRate(*d.Live, *d.Rebuilt) || d.LiveHistory != d.RebuiltHistory:
+		return DIFF_CHANGED
+	default:
+		return DIFF_EQUAL
+	}
+}
+
+func sameRate(a, b model.BankRate) bool {
+	return a.Bank == b.Bank && a.Buy == b.Buy && a.Sell == b.Sell && a.BuyOnline == b.BuyOnline && a.SellOnline == b.SellOnline &&
+		a.LastUpdated.Equal(b.LastUpdated) && a.Source == b.Source && a.SiteUrl == b.SiteUrl
+}
+
+// Diff compares rates of all banks known to live or rebuilt, ordered by bank
+func Diff(ctx context.Context, live, rebuilt *shared.Database) ([]RateDiff, error) {
+	diffs := map[string]*RateDiff{}
+	for _, db := range []*shared.Database{live, rebuilt} {
+		rates, err := db.GetBankPrices(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rate := range rates {
+			d, ok := diffs[rate.Bank]
+			if !ok {
+				d = &RateDiff{Bank: rate.Bank}
+				diffs[rate.Bank] = d
+			}
+
+			history, err := db.CountBankPriceHistory(ctx, rate.Bank)
+			if err != nil {
+				return nil, err
+			}
+
+			if db == live {
+				d.Live, d.LiveHistory = &rate, history
+			} else {
+				d.Rebuilt, d.RebuiltHistory = &rate, history
+			}
+		}
+	}
+
+	res := make([]RateDiff, 0, len(diffs))
+	for _, d := range diffs {
+		res = append(res, *d)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Bank < res[j].Bank
+	})
+	return res, nil
+}
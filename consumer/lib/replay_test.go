@@ -0,0 +1,160 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/stream"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseStreamId(t *testing.T) {
+	type tt struct {
+		i   string
+		end bool
+		e   streamId
+		err bool
+	}
+
+	ts := []tt{
+		{i: "-", e: streamId{}},
+		{i: "+", e: streamId{ms: math.MaxUint64, seq: math.MaxUint64}},
+		{i: "1718022896000-3", e: streamId{ms: 1718022896000, seq: 3}},
+		{i: "1718022896000", e: streamId{ms: 1718022896000}},
+		{i: "1718022896000", end: true, e: streamId{ms: 1718022896000, seq: math.MaxUint64}},
+		{i: "1718022896000-x", err: true},
+		{i: "yesterday", err: true},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			res, err := parseStreamId(test.i, test.end)
+			if (err != nil) != test.err || (!test.err && res != test.e) {
+				t.Errorf("expected %v %v, got %v %v\n", test.e, test.err, res, err)
+			}
+		})
+	}
+}
+
+func TestParseRangeBound(t *testing.T) {
+	type tt struct {
+		i   string
+		e   string
+		err bool
+	}
+
+	ts := []tt{
+		{i: "-", e: "-"},
+		{i: "+", e: "+"},
+		{i: "1718000000000", e: "1718000000000"},
+		{i: "1718000000000-3", e: "1718000000000-3"},
+		{i: "2024-06-10T06:13:20Z", e: "1718000000000"},
+		{i: "2024-06-10T09:13:20+03:00", e: "1718000000000"},
+		{i: "2024-06-10", err: true},
+		{i: "1718000000000-", err: true},
+		{i: "", err: true},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			res, err := ParseRangeBound(test.i)
+			if (err != nil) != test.err || res != test.e {
+				t.Errorf("expected %v %v, got %v %v\n", test.e, test.err, res, err)
+			}
+		})
+	}
+}
+
+func TestArchiveEntryReader(t *testing.T) {
+	type tt struct {
+		start, end string
+		e          []string
+	}
+
+	buf := &bytes.Buffer{}
+	aw := stream.NewArchiveWriter(buf, true)
+	ids := []string{"1000-0", "1000-1", "2000-0", "3000-0", "4000-0"}
+	for _, id := range ids {
+		if err := aw.Write(redis.XMessage{ID: id, Values: map[string]interface{}{"bank": id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := []tt{
+		{start: "-", end: "+", e: ids},
+		{start: "1000", end: "1000", e: []string{"1000-0", "1000-1"}},
+		{start: "1000-1", end: "3000-0", e: []string{"1000-1", "2000-0", "3000-0"}},
+		{start: "5000", end: "+", e: []string{}},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			ar, err := stream.NewArchiveReader(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := NewArchiveEntryReader(ar, test.start, test.end, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := []string{}
+			for {
+				batch, err := r.Read(context.Background())
+				if err == io.EOF {
+					break
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, entry := range batch {
+					res = append(res, entry.ID)
+				}
+			}
+
+			if fmt.Sprint(res) != fmt.Sprint(test.e) {
+				t.Errorf("expected %v, got %v\n", test.e, res)
+			}
+		})
+	}
+}
+
+func TestRateDiffStatus(t *testing.T) {
+	type tt struct {
+		i RateDiff
+		e string
+	}
+
+	at := time.Date(2024, time.June, 10, 12, 34, 56, 0, time.UTC)
+	rate := model.BankRate{Bank: "bank", Buy: 41.05, Sell: 41.5, LastUpdated: at, Source: "src"}
+	changed := rate
+	changed.Sell = 41.6
+	ts := []tt{
+		{i: RateDiff{Live: &rate, Rebuilt: &rate, LiveHistory: 2, RebuiltHistory: 2}, e: DIFF_EQUAL},
+		{i: RateDiff{Live: &rate, Rebuilt: &model.BankRate{Bank: "bank", Buy: 41.05, Sell: 41.5, LastUpdated: at.In(time.Local), Source: "src"}}, e: DIFF_EQUAL},
+		{i: RateDiff{Live: &rate, Rebuilt: &changed}, e: DIFF_CHANGED},
+		{i: RateDiff{Live: &rate, Rebuilt: &rate, LiveHistory: 2, RebuiltHistory: 3}, e: DIFF_CHANGED},
+		{i: RateDiff{Live: &rate}, e: DIFF_MISSING},
+		{i: RateDiff{Rebuilt: &rate}, e: DIFF_ADDED},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if res := test.i.Status(); res != test.e {
+				t.Errorf("expected %v, got %v\n", test.e, res)
+			}
+		})
+	}
+}
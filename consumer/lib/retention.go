@@ -0,0 +1,262 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/stream"
+	"github.com/go-redsync/redsync/v4"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARCHIVE_PAGE is number of entries read at once for archiving
+const ARCHIVE_PAGE = 1000
+
+// RETENTION_LOCK_EXPIRY is how long a trim holds the lock of the stream, it is extended for every archived page
+const RETENTION_LOCK_EXPIRY = 30 * time.Second
+
+type RetentionConfig struct {
+	Stream string
+	Group  string
+	// MaxLen keeps about this many latest entries, not trimmed by length if zero
+	MaxLen int64
+	// MaxAge keeps entries added within it, not trimmed by age if zero
+	MaxAge time.Duration
+	// Interval is time between trims
+	Interval time.Duration
+	// ArchiveDir is where trimmed entries are written to gzipped NDJSON files before trimming, not archived if empty
+	ArchiveDir string
+}
+
+// Retention trims the stream by length and age, never past entries the group has not processed yet
+type Retention struct {
+	db   *shared.Database
+	conf RetentionConfig
+	now  func() time.Time
+	// lock lets only one replica archive and trim the stream at a time
+	lock *redsync.Mutex
+}
+
+type TrimResult struct {
+	// MinId is the oldest id kept, empty if nothing was trimmed
+	MinId   string
+	Trimmed int64
+	// Archive is the file trimmed entries were written to, empty if not archived
+	Archive string
+}
+
+func NewRetention(rdb *redis.Client, conf RetentionConfig) *Retention {
+	db := shared.NewDb(rdb)
+	return &Retention{db: db, conf: conf, now: time.Now, lock: db.NewMutex(conf.Stream+":retention", RETENTION_LOCK_EXPIRY)}
+}
+
+// Run trims the stream every Interval until ctx is done, failed trims are retried on the next tick
+func (r *Retention) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			res, err := r.Trim(ctx)
+			if err != nil {
+				logger.ErrorContext(ctx, "failed to trim stream", "stream", r.conf.Stream, "err", err)
+				continue
+			}
+
+			if res.Trimmed > 0 {
+				logger.InfoContext(ctx, "trimmed stream", "stream", r.conf.Stream, "min_id", res.MinId, "trimmed", res.Trimmed, "archive", res.Archive)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Trim deletes entries older than MaxAge or beyond MaxLen, which are delivered to the group and acknowledged.
+// Both limits are turned into MINID, so the bound of the group applies to them.
+// Nothing is trimmed while another replica holds the lock of the stream.
+func (r *Retention) Trim(ctx context.Context) (TrimResult, error) {
+	if err := r.lock.TryLockContext(ctx); err != nil {
+		var taken *redsync.ErrTaken
+		if errors.As(err, &taken) {
+			return TrimResult{}, nil
+		}
+
+		return TrimResult{}, fmt.Errorf("lock: %w", err)
+	}
+	defer r.lock.Unlock()
+
+	minId, err := r.minId(ctx)
+	if err != nil || minId == "" {
+		return TrimResult{}, err
+	}
+
+	res := TrimResult{MinId: minId}
+	if r.conf.ArchiveDir != "" {
+		if res.Archive, err = r.archive(ctx, minId); err != nil {
+			return TrimResult{}, fmt.Errorf("archive: %w", err)
+		}
+	}
+
+	if err := r.extendLock(ctx); err != nil {
+		return res, err
+	}
+
+	if res.Trimmed, err = r.db.TrimStream(ctx, r.conf.Stream, minId); err != nil {
+		return res, err
+	}
+
+	entriesTrimmed.Add(float64(res.Trimmed))
+	return res, nil
+}
+
+// minId returns the oldest id to keep, empty if nothing can be trimmed
+func (r *Retention) minId(ctx context.Context) (string, error) {
+	info, err := r.db.GetStreamInfo(ctx, r.conf.Stream, r.conf.Group)
+	if err != nil {
+		return "", err
+	}
+
+	if info.Stream.Length == 0 {
+		return "", nil
+	}
+
+	// the group may still need entries it was not delivered yet and pending ones
+	safe := ""
+	for _, g := range info.Groups {
+		if g.Name == r.conf.Group {
+			safe = g.LastDeliveredID
+		}
+	}
+
+	if safe == "" {
+		return "", fmt.Errorf("group %s of %s does not exist", r.conf.Group, r.conf.Stream)
+	}
+
+	if info.Pending != nil && info.Pending.Count > 0 {
+		safe = minStreamId(safe, info.Pending.Lower)
+	}
+
+	target := ""
+	if r.conf.MaxAge > 0 {
+		target = strconv.FormatInt(r.now().Add(-r.conf.MaxAge).UnixMilli(), 10) + "-0"
+	}
+
+	if r.conf.MaxLen > 0 && info.Stream.Length > r.conf.MaxLen {
+		tail, err := r.db.GetStreamTail(ctx, r.conf.Stream, r.conf.MaxLen)
+		if err != nil {
+			return "", err
+		}
+
+		if len(tail) > 0 && (target == "" || minStreamId(target, tail[len(tail)-1].ID) == target) {
+			target = tail[len(tail)-1].ID
+		}
+	}
+
+	if target == "" {
+		return "", nil
+	}
+
+	minId := minStreamId(target, safe)
+	first, err := r.db.GetStreamRange(ctx, r.conf.Stream, "-", "+", 1)
+	if err != nil {
+		return "", err
+	}
+
+	if len(first) == 0 || minStreamId(minId, first[0].ID) == minId {
+		return "", nil
+	}
+
+	return minId, nil
+}
+
+// archive writes entries with ids less than minId to a new file of ArchiveDir, empty if there are none
+func (r *Retention) archive(ctx context.Context, minId string) (string, error) {
+	tmp, err := os.CreateTemp(r.conf.ArchiveDir, ".archive-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	aw := stream.NewArchiveWriter(tmp, true)
+	entries := NewStreamReader(r.db, r.conf.Stream, "-", "("+minId, ARCHIVE_PAGE)
+	first, last, count := "", "", 0
+	for {
+		batch, err := entries.Read(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		if err := aw.Write(batch...); err != nil {
+			return "", err
+		}
+
+		if err := r.extendLock(ctx); err != nil {
+			return "", err
+		}
+
+		if first == "" {
+			first = batch[0].ID
+		}
+
+		last = batch[len(batch)-1].ID
+		count += len(batch)
+	}
+
+	if count == 0 {
+		return "", nil
+	}
+
+	if err := aw.Close(); err != nil {
+		return "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	name := filepath.Join(r.conf.ArchiveDir, archiveName(r.conf.Stream, first, last))
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return "", err
+	}
+
+	entriesArchived.Add(float64(count))
+	return name, nil
+}
+
+// extendLock fails if the lock expired, another replica may trim the stream then
+func (r *Retention) extendLock(ctx context.Context) error {
+	if ok, err := r.lock.ExtendContext(ctx); !ok {
+		return fmt.Errorf("lost lock of %s: %v", r.conf.Stream, err)
+	}
+
+	return nil
+}
+
+// archiveName is file name of entries from first to last, files of a stream sort in stream order
+func archiveName(streamName, first, last string) string {
+	return fmt.Sprintf("%s_%s_%s.ndjson.gz", strings.NewReplacer(":", "-", "/", "-").Replace(streamName), first, last)
+}
+
+// minStreamId returns the lesser of ids
+func minStreamId(a, b string) string {
+	aId, aErr := parseStreamId(a, false)
+	bId, bErr := parseStreamId(b, false)
+	if aErr != nil || (bErr == nil && bId.less(aId)) {
+		return b
+	}
+
+	return a
+}
@@ -0,0 +1,170 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/stream"
+	"github.com/charkpep/usd_rate_api/shared/testenv"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMinStreamId(t *testing.T) {
+	type tt struct {
+		a, b string
+		e    string
+	}
+
+	ts := []tt{
+		{a: "1000-1", b: "1000-2", e: "1000-1"},
+		{a: "2000-0", b: "1000-5", e: "1000-5"},
+		{a: "1000-0", b: "1000-0", e: "1000-0"},
+		{a: "0-0", b: "1000-0", e: "0-0"},
+		{a: "", b: "1000-0", e: "1000-0"},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if res := minStreamId(test.a, test.b); res != test.e {
+				t.Errorf("expected %v, got %v\n", test.e, res)
+			}
+		})
+	}
+}
+
+func TestArchiveName(t *testing.T) {
+	res := archiveName("rate:usd", "1718022896000-0", "1718022899000-3")
+	if e := "rate-usd_1718022896000-0_1718022899000-3.ndjson.gz"; res != e {
+		t.Errorf("expected %v, got %v\n", e, res)
+	}
+}
+
+func TestTrimLock(t *testing.T) {
+	type tt struct {
+		// locked is whether another replica holds the lock
+		locked bool
+		e      int64
+	}
+
+	ts := []tt{
+		{locked: false, e: 2},
+		{locked: true, e: 0},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			rdb, _ := testenv.NewRedis(t)
+			ctx := context.Background()
+			for _, id := range []string{"1-0", "2-0", "3-0"} {
+				if err := rdb.XAdd(ctx, &redis.XAddArgs{Stream: "rate:usd", ID: id, Values: map[string]interface{}{"a": "b"}}).Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := rdb.XGroupCreate(ctx, "rate:usd", "group", "$").Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := NewRetention(rdb, RetentionConfig{Stream: "rate:usd", Group: "group", MaxLen: 1, Interval: time.Minute})
+			if test.locked {
+				other := NewRetention(rdb, RetentionConfig{Stream: "rate:usd", Group: "group"})
+				if err := other.lock.TryLock(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			res, err := r.Trim(ctx)
+			if err != nil || res.Trimmed != test.e {
+				t.Errorf("expected %v, got %v %v\n", test.e, res.Trimmed, err)
+			}
+		})
+	}
+}
+
+func TestTrimKeepsUnprocessed(t *testing.T) {
+	rdb, _ := testenv.NewRedis(t)
+	ctx := context.Background()
+	for _, id := range []string{"1-0", "2-0", "3-0", "4-0", "5-0", "6-0"} {
+		if err := rdb.XAdd(ctx, &redis.XAddArgs{Stream: "rate:usd", ID: id, Values: map[string]interface{}{"a": "b"}}).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := rdb.XGroupCreate(ctx, "rate:usd", "group", "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1-0 and 2-0 are acknowledged, 3-0 and 4-0 pending, 5-0 and 6-0 undelivered
+	err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "group", Consumer: "consumer", Streams: []string{"rate:usd", ">"}, Count: 4, Block: -1}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rdb.XAck(ctx, "rate:usd", "group", "1-0", "2-0").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every entry is beyond MaxLen and older than MaxAge
+	dir := t.TempDir()
+	r := NewRetention(rdb, RetentionConfig{Stream: "rate:usd", Group: "group", MaxLen: 1, MaxAge: time.Minute, Interval: time.Minute, ArchiveDir: dir})
+	res, err := r.Trim(ctx)
+	if err != nil || res.Trimmed != 2 || res.MinId != "3-0" {
+		t.Fatalf("expected 2 trimmed before 3-0, got %v %v\n", res, err)
+	}
+
+	entries, err := rdb.XRange(ctx, "rate:usd", "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := streamIds(entries); fmt.Sprint(ids) != "[3-0 4-0 5-0 6-0]" {
+		t.Errorf("expected pending and undelivered entries kept, got %v\n", ids)
+	}
+
+	if e := filepath.Join(dir, archiveName("rate:usd", "1-0", "2-0")); res.Archive != e {
+		t.Errorf("expected %v, got %v\n", e, res.Archive)
+	}
+
+	f, err := os.Open(res.Archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ar, err := stream.NewArchiveReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+
+	archived := []redis.XMessage{}
+	for {
+		entry, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		archived = append(archived, entry)
+	}
+
+	if ids := streamIds(archived); fmt.Sprint(ids) != "[1-0 2-0]" {
+		t.Errorf("expected trimmed entries archived, got %v\n", ids)
+	}
+}
+
+func streamIds(entries []redis.XMessage) []string {
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+
+	return ids
+}
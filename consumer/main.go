@@ -2,39 +2,134 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	consumer "github.com/charkpep/usd_rate_api/consumer/lib"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/bus"
+	"github.com/charkpep/usd_rate_api/shared/health"
+	"github.com/charkpep/usd_rate_api/shared/logging"
+	"github.com/charkpep/usd_rate_api/shared/tracing"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 )
 
-func getEnvs() (redis, stream, group string) {
+const (
+	// SHUTDOWN_TIMEOUT is how long messages being processed are drained on shutdown
+	SHUTDOWN_TIMEOUT = 10 * time.Second
+	// MAX_LAG is number of not delivered stream entries after which consumer is not ready
+	MAX_LAG = 1000
+	// DEFAULT_DEDUP_TTL is how long processed messages are remembered, longer than scraper retries and restarts take
+	DEFAULT_DEDUP_TTL = "24h"
+	// DEFAULT_RETENTION_INTERVAL is time between stream trims
+	DEFAULT_RETENTION_INTERVAL = "1h"
+	// DEFAULT_CLAIM_IDLE is how long messages of a gone consumer wait before they are claimed
+	DEFAULT_CLAIM_IDLE = "5m"
+)
+
+func getEnvDefault(key, def string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+
+	return def
+}
+
+func getEnvs(logger *slog.Logger) (redis, stream, group string) {
 	var ok bool
 	redis, ok = os.LookupEnv("REDIS_URL")
 	if !ok {
-		log.Fatalf("missing REDIS URL")
+		logger.Error("missing REDIS_URL")
+		os.Exit(1)
 	}
 
 	stream, ok = os.LookupEnv("REDIS_STEAM")
 	if !ok {
-		log.Fatalf("missing REDIS STEAM")
+		logger.Error("missing REDIS_STEAM")
+		os.Exit(1)
 	}
 
 	group, ok = os.LookupEnv("CONSUMPTION_GROUP")
 	if !ok {
-		log.Fatalf("missing CONSUMPTION GROUP")
+		logger.Error("missing CONSUMPTION_GROUP")
+		os.Exit(1)
 	}
 
 	return
 }
 
+// getRetentionConfig reads retention of the stream, stream is not trimmed if neither max length nor max age is set
+func getRetentionConfig(stream, group string) (consumer.RetentionConfig, error) {
+	conf := consumer.RetentionConfig{Stream: stream, Group: group, ArchiveDir: os.Getenv("RETENTION_ARCHIVE_DIR")}
+	var err error
+	if maxLen, ok := os.LookupEnv("RETENTION_MAX_LEN"); ok {
+		if conf.MaxLen, err = strconv.ParseInt(maxLen, 10, 64); err != nil {
+			return conf, fmt.Errorf("RETENTION_MAX_LEN: %w", err)
+		}
+	}
+
+	if maxAge, ok := os.LookupEnv("RETENTION_MAX_AGE"); ok {
+		if conf.MaxAge, err = time.ParseDuration(maxAge); err != nil {
+			return conf, fmt.Errorf("RETENTION_MAX_AGE: %w", err)
+		}
+	}
+
+	if conf.Interval, err = time.ParseDuration(getEnvDefault("RETENTION_INTERVAL", DEFAULT_RETENTION_INTERVAL)); err != nil {
+		return conf, fmt.Errorf("RETENTION_INTERVAL: %w", err)
+	}
+
+	if conf.Interval <= 0 {
+		return conf, errors.New("RETENTION_INTERVAL: must be positive")
+	}
+
+	return conf, nil
+}
+
+// newBus connects to the bus set by BUS, redis or nats. JetStream stream is created with limits of the retention.
+func newBus(rdb *redis.Client, retention consumer.RetentionConfig) (bus.Bus, func(), error) {
+	switch kind := getEnvDefault("BUS", "redis"); kind {
+	case "redis":
+		return bus.NewRedis(rdb, bus.RedisConfig{}), func() {}, nil
+	case "nats":
+		url, ok := os.LookupEnv("NATS_URL")
+		if !ok {
+			return nil, nil, errors.New("missing NATS_URL")
+		}
+
+		nc, err := nats.Connect(url, nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		b, err := bus.NewJetStream(nc, bus.JetStreamConfig{MaxMsgs: retention.MaxLen, MaxAge: retention.MaxAge})
+		if err != nil {
+			nc.Close()
+			return nil, nil, err
+		}
+
+		return b, nc.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown bus %q", kind)
+	}
+}
+
 func main() {
-	url, steam, group := getEnvs()
+	logger := logging.New("consumer")
+	slog.SetDefault(logger)
+	url, steam, group := getEnvs(logger)
 
 	opt, err := redis.ParseURL(url)
 	if err != nil {
-		log.Println(err)
+		logger.Error("failed to parse REDIS_URL", "err", err)
 		os.Exit(1)
 	}
 
@@ -42,19 +137,104 @@ func main() {
 	opt.MaxRetries = 10
 	rdb := redis.NewClient(opt)
 	defer rdb.Close()
-	if err := consumer.CheckAndCreateGroup(context.Background(), rdb, steam, group, "0"); err != nil {
-		log.Println(err)
+	dedupTTL, err := time.ParseDuration(getEnvDefault("DEDUP_TTL", DEFAULT_DEDUP_TTL))
+	if err != nil {
+		logger.Error("failed to parse DEDUP_TTL", "err", err)
 		rdb.Close()
 		os.Exit(1)
 	}
 
-	c, err := consumer.NewConsumer(rdb, consumer.Config{Name: "consumer_go", Group: group, Stream: steam, Start: ">"})
+	retentionConf, err := getRetentionConfig(steam, group)
 	if err != nil {
-		log.Println(err)
+		logger.Error("failed to parse retention", "err", err)
 		rdb.Close()
 		os.Exit(1)
 	}
 
-	defer c.Close()
-	c.Consume()
+	claimIdle, err := time.ParseDuration(getEnvDefault("CLAIM_IDLE", DEFAULT_CLAIM_IDLE))
+	if err != nil {
+		logger.Error("failed to parse CLAIM_IDLE", "err", err)
+		rdb.Close()
+		os.Exit(1)
+	}
+
+	b, closeBus, err := newBus(rdb, retentionConf)
+	if err != nil {
+		logger.Error("failed to connect to bus", "err", err)
+		rdb.Close()
+		os.Exit(1)
+	}
+	defer closeBus()
+
+	c, err := consumer.NewBusConsumer(b, shared.NewDb(rdb), consumer.Config{
+		Name:      getEnvDefault("CONSUMER_NAME", "consumer_go"),
+		Group:     group,
+		Stream:    steam,
+		DedupTTL:  dedupTTL,
+		ClaimIdle: claimIdle,
+	})
+	if err != nil {
+		logger.Error("failed to create consumer", "err", err)
+		rdb.Close()
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Init(ctx, "consumer")
+	if err != nil {
+		logger.Error("failed to init tracing", "err", err)
+		os.Exit(1)
+	}
+
+	checker := health.NewChecker()
+	checker.Add("redis", health.RedisCheck(rdb))
+	// lag, gauges and retention inspect Redis stream, JetStream limits its stream by itself
+	_, redisBus := b.(*bus.Redis)
+	if redisBus {
+		checker.Add("stream", health.StreamLagCheck(rdb, steam, group, MAX_LAG))
+		prometheus.MustRegister(
+			consumer.NewStreamLagGauge(rdb, steam, group),
+			consumer.NewStreamLengthGauge(rdb, steam),
+			consumer.NewStreamOldestEntryGauge(rdb, steam),
+		)
+	}
+
+	mux := http.NewServeMux()
+	checker.Register(mux)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	admin := health.NewAdminServer(fmt.Sprintf("0.0.0.0:%s", getEnvDefault("ADMIN_PORT", "8081")), mux)
+	go func() {
+		if err := admin.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("admin server stopped", "err", err)
+		}
+	}()
+
+	if redisBus && (retentionConf.MaxLen > 0 || retentionConf.MaxAge > 0) {
+		go consumer.NewRetention(rdb, retentionConf).Run(ctx)
+	}
+
+	go func() {
+		if err := c.Consume(); err != nil {
+			logger.Error("consumption stopped", "err", err)
+		}
+		stop()
+	}()
+
+	<-ctx.Done()
+	checker.SetDraining()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := c.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to shut down consumer", "err", err)
+	}
+
+	if err := admin.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to shut down admin server", "err", err)
+	}
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("failed to flush traces", "err", err)
+	}
 }
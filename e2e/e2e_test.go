@@ -0,0 +1,75 @@
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	api "github.com/charkpep/usd_rate_api/api/lib"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateEmail(t *testing.T) {
+	type tt struct {
+		digest bool
+		text   string
+	}
+
+	ts := []tt{
+		{digest: false, text: fmt.Sprintf("%s, Buy: 41.05; Sell: 41.6", api.DEFAULT_BANK)},
+		{digest: true, text: "USD rates digest"},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			h := Start(t, nil)
+			h.Subscribe(t, "user@example.com")
+			at := time.Now().Truncate(time.Second)
+			h.PublishRate(t, model.BankRate{Bank: api.DEFAULT_BANK, Buy: 41.05, Sell: 41.6, LastUpdated: at, Source: "e2e"})
+			h.WaitRate(t, api.DEFAULT_BANK, at)
+
+			status, body := h.Do(t, http.MethodGet, "/rate/"+url.PathEscape(api.DEFAULT_BANK), nil)
+			rate := model.BankRate{}
+			if err := json.Unmarshal([]byte(body), &rate); err != nil || status != http.StatusOK {
+				t.Fatalf("expected status %d, got %d %s\n", http.StatusOK, status, body)
+			}
+
+			if rate.Buy != 41.05 || rate.Sell != 41.6 || !rate.LastUpdated.Equal(at) {
+				t.Errorf("expected published rate, got %+v\n", rate)
+			}
+
+			h.RequestMailRun(t, test.digest)
+			mail := h.AssertEmail(t, "user@example.com", test.text)
+			if mail.From != MAIL_FROM {
+				t.Errorf("expected %s, got %s\n", MAIL_FROM, mail.From)
+			}
+
+			if test.digest && !strings.Contains(mail.Body, "41.05") {
+				t.Errorf("expected digest with 41.05, got %s\n", mail.Body)
+			}
+		})
+	}
+}
+
+func TestStaleRate(t *testing.T) {
+	h := Start(t, nil)
+	at := time.Now().Truncate(time.Second)
+	h.PublishRate(t, model.BankRate{Bank: "bank", Buy: 41.05, Sell: 41.6, LastUpdated: at, Source: "e2e"})
+	h.WaitRate(t, "bank", at)
+	// older rate is only added to history, duplicate of the current one is skipped
+	h.PublishRate(t, model.BankRate{Bank: "bank", Buy: 40, Sell: 40.5, LastUpdated: at.Add(-time.Hour), Source: "e2e"})
+	h.PublishRate(t, model.BankRate{Bank: "bank", Buy: 41.05, Sell: 41.6, LastUpdated: at, Source: "e2e"})
+	h.PublishRate(t, model.BankRate{Bank: "bank", Buy: 41.1, Sell: 41.7, LastUpdated: at.Add(time.Minute), Source: "e2e"})
+	if rate := h.WaitRate(t, "bank", at.Add(time.Minute)); rate.Buy != 41.1 || rate.Sell != 41.7 {
+		t.Errorf("expected the latest rate, got %+v\n", rate)
+	}
+
+	n, err := h.Db.CountBankPriceHistory(context.Background(), "bank")
+	if err != nil || n != 3 {
+		t.Errorf("expected 3 rates in history, got %d %v\n", n, err)
+	}
+}
@@ -0,0 +1,204 @@
+// Package e2e boots the API, consumer and mailer in one process against in-memory Redis and a fake SMTP server,
+// so end-to-end tests run without Docker or network.
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	mail "github.com/charkpep/mail-consumer/lib"
+	api "github.com/charkpep/usd_rate_api/api/lib"
+	consumer "github.com/charkpep/usd_rate_api/consumer/lib"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/bus"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/stream"
+	"github.com/charkpep/usd_rate_api/shared/testenv"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/gomail.v2"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	STREAM = "rate:usd"
+	GROUP  = "usd-rate"
+	// ADMIN_KEY is accepted by the API with admin scope
+	ADMIN_KEY = "e2e-admin-key"
+	// MAIL_FROM is sender of emails
+	MAIL_FROM = "rates@example.com"
+	// WAIT bounds waiting for services to process a request
+	WAIT = 5 * time.Second
+)
+
+// Harness is the application running until test ends
+type Harness struct {
+	Redis *miniredis.Miniredis
+	Rdb   *redis.Client
+	Db    *shared.Database
+	SMTP  *testenv.SMTPServer
+	// ApiUrl is base url of the API
+	ApiUrl    string
+	publisher *stream.Publisher
+}
+
+// Start boots services, conf is applied to the default API config.
+// The mailer listens for runs requested via the API, see RequestMailRun.
+func Start(t *testing.T, conf func(*api.Config)) *Harness {
+	t.Helper()
+	rdb, m := testenv.NewRedis(t)
+	h := &Harness{
+		Redis:     m,
+		Rdb:       rdb,
+		Db:        shared.NewDb(rdb),
+		SMTP:      testenv.NewSMTPServer(t),
+		publisher: stream.NewPublisher(rdb, stream.PublisherConfig{Stream: STREAM}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	// services are stopped before the in-memory servers, cleanups run in reverse order
+	t.Cleanup(func() {
+		cancel()
+		// blocked reads of stopped services return once connections are closed
+		rdb.Close()
+		wg.Wait()
+	})
+
+	apiConf := api.DefaultConfig()
+	apiConf.AdminKey = ADMIN_KEY
+	apiConf.Stream = STREAM
+	apiConf.Group = GROUP
+	if conf != nil {
+		conf(&apiConf)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := api.NewApi(rdb, apiConf)
+	h.ApiUrl = "http://" + l.Addr().String()
+	goRun(t, &wg, func() error { return a.Serve(l) })
+	goRun(t, &wg, func() error { return api.NewWebhookDispatcher(rdb).Run(ctx) })
+	t.Cleanup(func() { a.Shutdown(context.Background()) })
+
+	c, err := consumer.NewBusConsumer(bus.NewRedis(rdb, bus.RedisConfig{Block: 50 * time.Millisecond}), h.Db, consumer.Config{
+		Name:     "consumer",
+		Group:    GROUP,
+		Stream:   STREAM,
+		DedupTTL: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	goRun(t, &wg, c.Consume)
+	t.Cleanup(func() { c.Shutdown(context.Background()) })
+
+	d := gomail.NewDialer(h.SMTP.Host(), h.SMTP.Port(), MAIL_FROM, "password")
+	goRun(t, &wg, func() error { return mail.ListenRuns(ctx, h.Db, d, mail.Config{ApiUrl: h.ApiUrl}) })
+	return h
+}
+
+// goRun runs service in background, its error is logged to t as it may be the expected shutdown.
+// Cleanup of the test waits for wg, so t outlives the service.
+func goRun(t *testing.T, wg *sync.WaitGroup, run func() error) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := run(); err != nil {
+			t.Log("service stopped:", err)
+		}
+	}()
+}
+
+// PublishRate publishes rate to the stream as scrapers do, returns message id
+func (h *Harness) PublishRate(t *testing.T, rate model.BankRate) string {
+	t.Helper()
+	id, err := h.publisher.Publish(context.Background(), stream.NewBankRateMessage(&rate))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+// WaitRate waits until the consumer stores rate of bank updated at least at updatedAt, returns the stored rate
+func (h *Harness) WaitRate(t *testing.T, bank string, updatedAt time.Time) model.BankRate {
+	t.Helper()
+	deadline := time.Now().Add(WAIT)
+	for {
+		rate, err := h.Db.GetBankPrice(context.Background(), bank)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rate != nil && !rate.LastUpdated.Before(updatedAt) {
+			return *rate
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected rate of %s updated at %v, got %+v\n", bank, updatedAt, rate)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Do sends request to the API with admin key, form is sent url encoded if not nil. Returns status and body.
+func (h *Harness) Do(t *testing.T, method, path string, form url.Values) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, h.ApiUrl+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+ADMIN_KEY)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode, string(body)
+}
+
+// Subscribe subscribes email to the default bank via the API
+func (h *Harness) Subscribe(t *testing.T, email string) {
+	t.Helper()
+	if status, body := h.Do(t, http.MethodPost, "/subscribe", url.Values{"email": {email}}); status != http.StatusOK {
+		t.Fatalf("expected status %d, got %d %s\n", http.StatusOK, status, body)
+	}
+}
+
+// RequestMailRun asks the mailer to send emails to all subscribers via the API
+func (h *Harness) RequestMailRun(t *testing.T, digest bool) {
+	t.Helper()
+	form := url.Values{"digest": {fmt.Sprint(digest)}}
+	if status, body := h.Do(t, http.MethodPost, "/admin/mail-runs", form); status != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d %s\n", http.StatusAccepted, status, body)
+	}
+}
+
+// AssertEmail waits for an email to `to` with subject or body containing text
+func (h *Harness) AssertEmail(t *testing.T, to, text string) testenv.Mail {
+	t.Helper()
+	return h.SMTP.AssertMail(t, to, text)
+}
@@ -4,72 +4,102 @@ import (
 	"context"
 	"fmt"
 	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/logging"
 	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/gomail.v2"
-	"log"
-	"os"
 	"strings"
 	"time"
 )
 
-var logger = log.New(os.Stdout, "email-sender: ", log.LstdFlags)
+var logger = logging.New("mail")
+
+var tracer = otel.Tracer("github.com/charkpep/usd_rate_api/mail")
+
+const (
+	// MAIL_ATTEMPTS is number of attempts to send a single email
+	MAIL_ATTEMPTS = 3
+	// MAIL_BACKOFF is the delay before the second attempt, doubled after each next one
+	MAIL_BACKOFF = time.Second
+)
 
 type Mail struct {
 	To   string
 	Data *model.BankRate
 }
 
+type Config struct {
+	// Digest sends one email per subscriber with all subscribed banks
+	Digest bool
+	// ApiUrl is used to link rate history, omitted if empty
+	ApiUrl string
+	// DryRun logs emails instead of sending them
+	DryRun bool
+}
+
 type MailConsumer struct {
 	cache  map[string]*model.BankRate
 	db     *shared.Database
 	dialer *gomail.Dialer
+	conf   Config
 }
 
-func NewMailConsumer(db *shared.Database, dialer *gomail.Dialer) *MailConsumer {
+func NewMailConsumer(db *shared.Database, dialer *gomail.Dialer, conf Config) *MailConsumer {
 	m := &MailConsumer{
 		db:     db,
 		dialer: dialer,
 		cache:  make(map[string]*model.BankRate),
+		conf:   conf,
 	}
 
 	return m
 }
 
-func (m MailConsumer) Consume() error {
-	iter, err := m.db.GetSubscriberMails(context.TODO())
+// Consume sends emails to all subscribers, stops early when ctx is done
+func (m MailConsumer) Consume(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "MailConsumer.Consume", trace.WithAttributes(attribute.Bool("digest", m.conf.Digest)))
+	defer func() { tracing.End(span, err) }()
+	if m.conf.Digest {
+		return m.ConsumeDigest(ctx)
+	}
+
+	iter, err := m.db.GetSubscriberMails(ctx)
 	if err != nil {
 		return err
 	}
 
-	for iter.Next(context.TODO()) {
-		fmt.Println(iter.Val())
+	for iter.Next(ctx) {
+		logger.DebugContext(ctx, "subscriber", "subscriber", iter.Val())
 		to := strings.Split(iter.Val(), ":")
 		if len(to) != 2 {
-			logger.Printf("elements %s does not have 2 elements\n", to)
+			logger.WarnContext(ctx, "malformed subscriber", "subscriber", iter.Val())
 			continue
 		}
 
 		if data, ok := m.cache[to[1]]; ok {
-			if err := m.sendMail(to[0], data); err != nil {
-				logger.Println(err)
+			if err := m.sendMail(ctx, to[0], data); err != nil {
+				logger.ErrorContext(ctx, "failed to send mail", "to", to[0], "err", err)
 			}
 			continue
 		}
 
-		data, err := m.db.GetBankPrice(context.TODO(), to[1])
+		data, err := m.db.GetBankPrice(ctx, to[1])
 		if err != nil {
-			logger.Println(err)
+			logger.ErrorContext(ctx, "failed to get rate", "bank", to[1], "err", err)
 			continue
 		}
 
 		if data == nil {
-			logger.Printf("bank rate for %s, not found\n", to[1])
+			logger.WarnContext(ctx, "rate not found", "bank", to[1])
 			continue
 		}
 
 		m.cache[to[1]] = data
-		if err := m.sendMail(to[0], data); err != nil {
-			logger.Println(err)
+		if err := m.sendMail(ctx, to[0], data); err != nil {
+			logger.ErrorContext(ctx, "failed to send mail", "to", to[0], "err", err)
 		}
 	}
 
@@ -80,17 +110,59 @@ func (m MailConsumer) Consume() error {
 	return nil
 }
 
-func (m MailConsumer) sendMail(to string, data *model.BankRate) error {
+// sendMail continues trace the rate was stored with, linked to the trace of the whole run
+func (m MailConsumer) sendMail(ctx context.Context, to string, data *model.BankRate) error {
+	rateCtx, err := m.db.GetBankPriceTrace(ctx, data.Bank)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to get rate trace", "bank", data.Bank, "err", err)
+	}
+
+	return m.send(rateCtx, to, "USD Price update", fmt.Sprintf("%s, Buy: %v; Sell: %v", data.Bank, data.Buy, data.Sell), trace.LinkFromContext(ctx))
+}
+
+func (m MailConsumer) send(ctx context.Context, to, subject, body string, links ...trace.Link) (err error) {
+	ctx, span := tracer.Start(ctx, "MailConsumer.send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.String("mail.subject", subject)),
+	)
+	defer func() { tracing.End(span, err) }()
 	message := gomail.NewMessage()
 	start := time.Now()
-	message.SetHeader("Subject", "USD Price update")
+	message.SetHeader("Subject", subject)
 	message.SetHeader("From", m.dialer.Username)
 	message.SetHeader("To", to)
-	message.SetBody("text/html", fmt.Sprintf("%s, Buy: %v; Sell: %v", data.Bank, data.Buy, data.Sell))
-	if err := m.dialer.DialAndSend(message); err != nil {
-		return err
+	message.SetBody("text/html", body)
+	if m.conf.DryRun {
+		span.SetAttributes(attribute.Bool("mail.dry_run", true))
+		logger.InfoContext(ctx, "dry run, not sent", "to", to, "subject", subject)
+		return nil
+	}
+
+	backoff := MAIL_BACKOFF
+	for attempt := 1; ; attempt += 1 {
+		span.SetAttributes(attribute.Int("mail.attempts", attempt))
+		err = m.dialer.DialAndSend(message)
+		if err == nil {
+			break
+		}
+
+		if attempt >= MAIL_ATTEMPTS {
+			mailsFailed.Inc()
+			return err
+		}
+
+		mailsRetried.Inc()
+		select {
+		case <-ctx.Done():
+			mailsFailed.Inc()
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
 
-	logger.Printf("send to %s in %s\n", to, time.Now().Sub(start).String())
+	mailsSent.Inc()
+	logger.InfoContext(ctx, "sent", "to", to, "duration", time.Since(start))
 	return nil
 }
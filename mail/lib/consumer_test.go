@@ -0,0 +1,23 @@
+package lib
+
+import (
+	"context"
+	"gopkg.in/gomail.v2"
+	"testing"
+	"time"
+)
+
+func TestSendCanceled(t *testing.T) {
+	// nothing listens on the port, so every attempt fails
+	m := NewMailConsumer(nil, gomail.NewDialer("127.0.0.1", 1, "from@mail.com", ""), Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if err := m.send(ctx, "to@mail.com", "subject", "body"); err == nil {
+		t.Errorf("expected error, got %v\n", err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= MAIL_BACKOFF {
+		t.Errorf("expected retries to stop on cancel, took %v\n", elapsed)
+	}
+}
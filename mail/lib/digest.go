@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/market"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"go.opentelemetry.io/otel/trace"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DigestChangePeriod is the period the day's change is computed over
+const DigestChangePeriod = 24 * time.Hour
+
+type DigestRow struct {
+	Rate             model.BankRate
+	BuyChange        float64
+	SellChange       float64
+	BuyOnlineChange  float64
+	SellOnlineChange float64
+	HistoryUrl       string
+}
+
+type Digest struct {
+	Rows []DigestRow
+	// best rates in the market
+	Best market.Best
+}
+
+var digestTemplate = template.Must(template.New("digest").Parse(`<h3>USD rates digest</h3>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Bank</th><th>Buy</th><th>Sell</th><th>Buy online</th><th>Sell online</th><th>Updated</th><th></th></tr>
+{{range .Rows}}<tr>
+<td>{{.Rate.Bank}}</td>
+<td>{{printf "%.2f" .Rate.Buy}} ({{printf "%+.2f" .BuyChange}})</td>
+<td>{{printf "%.2f" .Rate.Sell}} ({{printf "%+.2f" .SellChange}})</td>
+<td>{{printf "%.2f" .Rate.BuyOnline}} ({{printf "%+.2f" .BuyOnlineChange}})</td>
+<td>{{printf "%.2f" .Rate.SellOnline}} ({{printf "%+.2f" .SellOnlineChange}})</td>
+<td>{{.Rate.LastUpdated.Format "2006-01-02 15:04"}}</td>
+<td>{{if .HistoryUrl}}<a href="{{.HistoryUrl}}">history</a>{{end}}</td>
+</tr>
+{{end}}</table>
+<h4>Best in the market</h4>
+<ul>
+{{with .Best.Buy}}<li>Buy: {{.Bank}}, {{printf "%.2f" .Buy}}</li>{{end}}
+{{with .Best.Sell}}<li>Sell: {{.Bank}}, {{printf "%.2f" .Sell}}</li>{{end}}
+{{with .Best.BuyOnline}}<li>Buy online: {{.Bank}}, {{printf "%.2f" .BuyOnline}}</li>{{end}}
+{{with .Best.SellOnline}}<li>Sell online: {{.Bank}}, {{printf "%.2f" .SellOnline}}</li>{{end}}
+</ul>
+`))
+
+// BuildDigest assembles digest for subscribed rates, prev holds rates by bank at the beginning of change period
+// and all known rates to find the best ones
+func BuildDigest(rates []model.BankRate, prev map[string]*model.BankRate, all []model.BankRate, apiUrl string) Digest {
+	d := Digest{
+		Rows: make([]DigestRow, 0, len(rates)),
+	}
+
+	for _, rate := range rates {
+		row := DigestRow{
+			Rate: rate,
+		}
+
+		if p, ok := prev[rate.Bank]; ok && p != nil {
+			row.BuyChange = change(p.Buy, rate.Buy)
+			row.SellChange = change(p.Sell, rate.Sell)
+			row.BuyOnlineChange = change(p.BuyOnline, rate.BuyOnline)
+			row.SellOnlineChange = change(p.SellOnline, rate.SellOnline)
+		}
+
+		if apiUrl != "" {
+			row.HistoryUrl = fmt.Sprintf("%s/rate/%s/history", strings.TrimSuffix(apiUrl, "/"), url.PathEscape(rate.Bank))
+		}
+
+		d.Rows = append(d.Rows, row)
+	}
+
+	d.Best = market.FindBest(all)
+	return d
+}
+
+// change returns difference between rates, 0 if any of them is not quoted
+func change(prev, cur float64) float64 {
+	if prev <= 0 || cur <= 0 {
+		return 0
+	}
+
+	return cur - prev
+}
+
+func (d Digest) Html() (string, error) {
+	var buff bytes.Buffer
+	if err := digestTemplate.Execute(&buff, d); err != nil {
+		return "", err
+	}
+
+	return buff.String(), nil
+}
+
+// ConsumeDigest sends to every subscriber a single email with all the banks subscribed
+func (m MailConsumer) ConsumeDigest(ctx context.Context) error {
+	iter, err := m.db.GetSubscriberMails(ctx)
+	if err != nil {
+		return err
+	}
+
+	subscribers := make(map[string][]string)
+	for iter.Next(ctx) {
+		to := strings.Split(iter.Val(), ":")
+		if len(to) != 2 {
+			logger.WarnContext(ctx, "malformed subscriber", "subscriber", iter.Val())
+			continue
+		}
+
+		subscribers[to[0]] = append(subscribers[to[0]], to[1])
+	}
+
+	if iter.Err() != nil {
+		return iter.Err()
+	}
+
+	all, err := m.db.GetBankPrices(ctx)
+	if err != nil {
+		return err
+	}
+
+	prev := make(map[string]*model.BankRate)
+	// digest combines several rates, so it links traces they were stored with instead of continuing one
+	links := make(map[string]trace.Link)
+	since := time.Now().Add(-DigestChangePeriod)
+	for email, banks := range subscribers {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		rates := make([]model.BankRate, 0, len(banks))
+		rateLinks := make([]trace.Link, 0, len(banks))
+		for _, bank := range banks {
+			data, ok := m.cache[bank]
+			if !ok {
+				if data, err = m.db.GetBankPrice(ctx, bank); err != nil {
+					logger.ErrorContext(ctx, "failed to get rate", "bank", bank, "err", err)
+					continue
+				}
+
+				if data == nil {
+					logger.WarnContext(ctx, "rate not found", "bank", bank)
+					continue
+				}
+
+				m.cache[bank] = data
+			}
+
+			if _, ok := prev[bank]; !ok {
+				if prev[bank], err = m.db.GetBankPriceAt(ctx, bank, since); err != nil {
+					logger.ErrorContext(ctx, "failed to get previous rate", "bank", bank, "err", err)
+				}
+			}
+
+			if _, ok := links[bank]; !ok {
+				rateCtx, err := m.db.GetBankPriceTrace(ctx, bank)
+				if err != nil {
+					logger.WarnContext(ctx, "failed to get rate trace", "bank", bank, "err", err)
+				}
+
+				links[bank] = trace.LinkFromContext(rateCtx)
+			}
+
+			rates = append(rates, *data)
+			rateLinks = append(rateLinks, links[bank])
+		}
+
+		if len(rates) == 0 {
+			continue
+		}
+
+		body, err := BuildDigest(rates, prev, all, m.conf.ApiUrl).Html()
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to build digest", "err", err)
+			continue
+		}
+
+		if err := m.send(ctx, email, "USD rates digest", body, rateLinks...); err != nil {
+			logger.ErrorContext(ctx, "failed to send digest", "to", email, "err", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildDigest(t *testing.T) {
+	now := time.Now().Round(time.Millisecond)
+	market := []model.BankRate{
+		{Bank: "a", Buy: 41.0, Sell: 41.6, BuyOnline: 41.1, SellOnline: 41.5, LastUpdated: now},
+		{Bank: "b", Buy: 41.2, Sell: 41.8, BuyOnline: 0, SellOnline: 0, LastUpdated: now},
+		{Bank: "c", Buy: 40.9, Sell: 41.4, BuyOnline: 41.3, SellOnline: 41.7, LastUpdated: now},
+	}
+
+	prev := map[string]*model.BankRate{
+		"a": {Bank: "a", Buy: 40.5, Sell: 41.0, BuyOnline: 0, SellOnline: 41.0},
+		"b": nil,
+	}
+
+	d := BuildDigest(market[:2], prev, market, "http://localhost:8000/")
+	if len(d.Rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d\n", len(d.Rows))
+	}
+
+	type tt struct {
+		got, exp float64
+	}
+
+	ts := []tt{
+		{got: d.Rows[0].BuyChange, exp: 0.5},
+		{got: d.Rows[0].SellChange, exp: 0.6},
+		{got: d.Rows[0].BuyOnlineChange, exp: 0},
+		{got: d.Rows[0].SellOnlineChange, exp: 0.5},
+		{got: d.Rows[1].BuyChange, exp: 0},
+		{got: d.Best.Buy.Buy, exp: 41.2},
+		{got: d.Best.Sell.Sell, exp: 41.4},
+		{got: d.Best.BuyOnline.BuyOnline, exp: 41.3},
+		{got: d.Best.SellOnline.SellOnline, exp: 41.5},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if fmt.Sprintf("%.2f", test.got) != fmt.Sprintf("%.2f", test.exp) {
+				t.Errorf("expected %v, got %v\n", test.exp, test.got)
+			}
+		})
+	}
+
+	if d.Rows[0].HistoryUrl != "http://localhost:8000/rate/a/history" {
+		t.Errorf("unexpected history url %q\n", d.Rows[0].HistoryUrl)
+	}
+
+	body, err := d.Html()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(body, "http://localhost:8000/rate/b/history") {
+		t.Errorf("expected body to link history, got %s\n", body)
+	}
+}
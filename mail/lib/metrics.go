@@ -0,0 +1,32 @@
+package lib
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// PUSH_JOB is the job metrics of a run are grouped by in Pushgateway
+const PUSH_JOB = "mailer"
+
+var (
+	mailsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mailer_emails_sent_total",
+		Help: "Number of emails sent.",
+	})
+
+	mailsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mailer_emails_failed_total",
+		Help: "Number of emails not sent after all attempts.",
+	})
+
+	mailsRetried = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mailer_emails_retried_total",
+		Help: "Number of retried attempts to send an email.",
+	})
+)
+
+// PushMetrics replaces metrics of the previous run in Pushgateway at url, so they outlive a mailer run
+func PushMetrics(url string) error {
+	return push.New(url, PUSH_JOB).Collector(mailsSent).Collector(mailsFailed).Collector(mailsRetried).Push()
+}
@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"context"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/logging"
+	"gopkg.in/gomail.v2"
+	"time"
+)
+
+// RUNS_BLOCK is how long mailer waits for a requested run before checking ctx again
+const RUNS_BLOCK = 5 * time.Second
+
+// ListenRuns sends emails on every run requested after the last handled one until ctx is done,
+// on the first start all runs kept in the stream are sent.
+// Each run gets its own consumer, so rates are not cached between runs.
+func ListenRuns(ctx context.Context, db *shared.Database, dialer *gomail.Dialer, conf Config) error {
+	lastId, err := db.GetLastMailRunId(ctx)
+	if err != nil {
+		return err
+	}
+
+	if lastId == "" {
+		lastId = "0"
+	}
+
+	for {
+		runs, err := db.ReadMailRuns(ctx, lastId, RUNS_BLOCK)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		for _, run := range runs {
+			runConf := conf
+			runConf.Digest = run.Digest
+			runConf.DryRun = runConf.DryRun || run.DryRun
+			runCtx := logging.WithRequestId(ctx, logging.NewRequestId())
+			logger.InfoContext(runCtx, "starting requested run", "run", run.Id, "digest", run.Digest, "dry_run", run.DryRun, "by", run.RequestedBy)
+			if err := NewMailConsumer(db, dialer, runConf).Consume(runCtx); err != nil {
+				logger.ErrorContext(runCtx, "failed to send mails", "run", run.Id, "err", err)
+			}
+
+			// interrupted run is sent again after restart
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			lastId = run.Id
+			if err := db.SetLastMailRunId(ctx, lastId); err != nil {
+				logger.ErrorContext(runCtx, "failed to store last run", "run", run.Id, "err", err)
+			}
+		}
+	}
+}
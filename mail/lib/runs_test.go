@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/testenv"
+	"gopkg.in/gomail.v2"
+	"testing"
+	"time"
+)
+
+func TestListenRunsResume(t *testing.T) {
+	type tt struct {
+		// lastId is the last run handled before, empty on the first start
+		lastId string
+	}
+
+	ts := []tt{
+		{lastId: "1-0"},
+		{lastId: ""},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			rdb, _ := testenv.NewRedis(t)
+			db := shared.NewDb(rdb)
+			ctx, cancel := context.WithCancel(context.Background())
+			if test.lastId != "" {
+				if err := db.SetLastMailRunId(ctx, test.lastId); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the run is requested while mailer is down
+			id, err := db.RequestMailRun(ctx, &model.MailRun{DryRun: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan error)
+			go func() { done <- ListenRuns(ctx, db, gomail.NewDialer("127.0.0.1", 1, "", ""), Config{DryRun: true}) }()
+			t.Cleanup(func() {
+				cancel()
+				rdb.Close()
+				<-done
+			})
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				lastId, err := db.GetLastMailRunId(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if lastId == id {
+					return
+				}
+
+				if time.Now().After(deadline) {
+					t.Fatalf("expected %v, got %v\n", id, lastId)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
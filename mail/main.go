@@ -1,33 +1,120 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/charkpep/mail-consumer/lib"
 	"github.com/charkpep/usd_rate_api/shared"
+	"github.com/charkpep/usd_rate_api/shared/health"
+	"github.com/charkpep/usd_rate_api/shared/logging"
+	"github.com/charkpep/usd_rate_api/shared/tracing"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
 	"gopkg.in/gomail.v2"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 )
 
+// SHUTDOWN_TIMEOUT is how long admin server requests are drained on shutdown
+const SHUTDOWN_TIMEOUT = 5 * time.Second
+
+func getEnvDefault(key, def string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+
+	return def
+}
+
 func main() {
+	logger := logging.New("mail")
+	slog.SetDefault(logger)
 	var (
 		password = os.Getenv("SMTP_PASS")
 		from     = os.Getenv("SMTP_USER")
+		host     = getEnvDefault("SMTP_HOST", "smtp.gmail.com")
+		// MAIL_MODE=digest sends one email per subscriber with all subscribed banks
+		digest = os.Getenv("MAIL_MODE") == "digest"
+		apiUrl = os.Getenv("API_URL")
+		// MAIL_RUNS=listen keeps mailer running and sends emails on runs requested via admin API
+		listen = os.Getenv("MAIL_RUNS") == "listen"
+		dryRun = os.Getenv("MAIL_DRY_RUN") == "true"
+		// PUSHGATEWAY_URL receives metrics at the end of a run, scraping may miss a short one
+		pushgateway = os.Getenv("PUSHGATEWAY_URL")
 	)
+	port, err := strconv.Atoi(getEnvDefault("SMTP_PORT", "587"))
+	if err != nil {
+		logger.Error("failed to parse SMTP_PORT", "err", err)
+		os.Exit(1)
+	}
+
 	opt, err := redis.ParseURL(os.Getenv("REDIS_URL"))
 	if err != nil {
-		log.Println(err)
+		logger.Error("failed to parse REDIS_URL", "err", err)
 		os.Exit(1)
 	}
 
 	opt.DialTimeout = 240 * time.Second
 	opt.MaxRetries = 10
 	rdb := redis.NewClient(opt)
-	d := gomail.NewDialer("smtp.gmail.com", 587, from, password)
+	defer rdb.Close()
+
+	// every run gets its own id, so lines of a single mailing can be grouped
+	ctx, stop := signal.NotifyContext(logging.WithRequestId(context.Background(), logging.NewRequestId()), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Init(ctx, "mail")
+	if err != nil {
+		logger.Error("failed to init tracing", "err", err)
+		os.Exit(1)
+	}
+
+	checker := health.NewChecker()
+	checker.Add("redis", health.RedisCheck(rdb))
+	checker.Add("smtp", health.SmtpCheck(fmt.Sprintf("%s:%d", host, port)))
+	mux := http.NewServeMux()
+	checker.Register(mux)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	admin := health.NewAdminServer(fmt.Sprintf("0.0.0.0:%s", getEnvDefault("ADMIN_PORT", "8082")), mux)
+	go func() {
+		if err := admin.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("admin server stopped", "err", err)
+		}
+	}()
+
+	d := gomail.NewDialer(host, port, from, password)
 	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
 	db := shared.NewDb(rdb)
-	c := lib.NewMailConsumer(db, d)
-	c.Consume()
+	conf := lib.Config{Digest: digest, ApiUrl: apiUrl, DryRun: dryRun}
+	if listen {
+		if err := lib.ListenRuns(ctx, db, d, conf); err != nil {
+			logger.ErrorContext(ctx, "failed to listen for runs", "err", err)
+		}
+	} else if err := lib.NewMailConsumer(db, d, conf).Consume(ctx); err != nil {
+		logger.ErrorContext(ctx, "failed to send mails", "err", err)
+	}
+
+	if pushgateway != "" {
+		if err := lib.PushMetrics(pushgateway); err != nil {
+			logger.ErrorContext(ctx, "failed to push metrics", "err", err)
+		}
+	}
+
+	checker.SetDraining()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := admin.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to shut down admin server", "err", err)
+	}
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("failed to flush traces", "err", err)
+	}
 }
@@ -6,6 +6,7 @@
 //     update_at: number,
 // }
 
+// BankRate is published as version 1 of shared/stream/schema/bank_rate_message.v1.json, missing rates are omitted
 export type BankRate = {
     bank: string,
     buy?: number,
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// fixtureServer serves fixtures by request path and raw query, other requests get 404
+func fixtureServer(t *testing.T, fixtures map[string]string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := fixtures[r.URL.RequestURI()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		body, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Errorf("failed to read fixture %s: %s", name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestApiSources(t *testing.T) {
+	type tt struct {
+		source func(baseUrl string) Source
+		// fixtures are keyed by request uri
+		fixtures map[string]string
+		e        model.BankRate
+		// fetched is whether rate is of the fetch time, e.LastUpdated is not checked then
+		fetched bool
+		err     error
+	}
+
+	ts := []tt{
+		{
+			source:   func(baseUrl string) Source { return NewMonobank(baseUrl, time.Second) },
+			fixtures: map[string]string{MONOBANK_CURRENCY_PATH: "monobank_currency.json"},
+			e: model.BankRate{
+				Bank: MONOBANK_BANK, Buy: 41.1, Sell: 41.5998, BuyOnline: 41.1, SellOnline: 41.5998,
+				LastUpdated: time.Unix(1718003640, 0), Source: MONOBANK_CURRENCY_PATH, SiteUrl: "https://www.monobank.ua/",
+			},
+		},
+		{
+			source: func(baseUrl string) Source { return NewPrivatBank(baseUrl, time.Second) },
+			fixtures: map[string]string{
+				PRIVATBANK_EXCHANGE_PATH + "?exchange&json&coursid=5":  "privatbank_cash.json",
+				PRIVATBANK_EXCHANGE_PATH + "?exchange&json&coursid=11": "privatbank_cashless.json",
+			},
+			e: model.BankRate{
+				Bank: PRIVATBANK_BANK, Buy: 41.05, Sell: 41.55, BuyOnline: 41.1, SellOnline: 41.49,
+				Source: PRIVATBANK_EXCHANGE_PATH + "?exchange&json&coursid=5", SiteUrl: "https://privatbank.ua/",
+			},
+			fetched: true,
+		},
+		{
+			source:   func(baseUrl string) Source { return NewNbu(baseUrl, time.Second) },
+			fixtures: map[string]string{NBU_EXCHANGE_PATH + "?valcode=USD&json": "nbu_exchange.json"},
+			e: model.BankRate{
+				Bank: NBU_BANK, Buy: 40.5698, Sell: 40.5698,
+				LastUpdated: time.Date(2024, time.June, 10, 0, 0, 0, 0, kyiv), Source: NBU_EXCHANGE_PATH + "?valcode=USD&json", SiteUrl: "https://bank.gov.ua/",
+				Official: true,
+			},
+		},
+		{
+			source:   func(baseUrl string) Source { return NewMonobank(baseUrl, time.Second) },
+			fixtures: map[string]string{MONOBANK_CURRENCY_PATH: "privatbank_cash.json"},
+			err:      ErrNoUsdRate,
+		},
+		{
+			source: func(baseUrl string) Source { return NewPrivatBank(baseUrl, time.Second) },
+			fixtures: map[string]string{
+				PRIVATBANK_EXCHANGE_PATH + "?exchange&json&coursid=5":  "privatbank_cash.json",
+				PRIVATBANK_EXCHANGE_PATH + "?exchange&json&coursid=11": "nbu_exchange.json",
+			},
+			err: ErrNoUsdRate,
+		},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			srv := fixtureServer(t, test.fixtures)
+			start := time.Now()
+			rates, err := test.source(srv.URL + "/").Fetch(context.Background())
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Errorf("expected %v, got %v\n", test.err, err)
+				}
+				return
+			}
+
+			if err != nil || len(rates) != 1 {
+				t.Fatalf("expected %v, got %v %v\n", test.e, rates, err)
+			}
+
+			res := rates[0]
+			test.e.Source = srv.URL + test.e.Source
+			if test.fetched {
+				if res.LastUpdated.Before(start) || res.LastUpdated.After(time.Now()) {
+					t.Errorf("expected fetch time, got %v\n", res.LastUpdated)
+				}
+				test.e.LastUpdated = res.LastUpdated
+			}
+
+			if !res.LastUpdated.Equal(test.e.LastUpdated) {
+				t.Errorf("expected %v, got %v\n", test.e.LastUpdated, res.LastUpdated)
+			}
+
+			res.LastUpdated = test.e.LastUpdated
+			if res != test.e {
+				t.Errorf("expected %v, got %v\n", test.e, res)
+			}
+		})
+	}
+}
+
+func TestApiSourceUnavailable(t *testing.T) {
+	srv := fixtureServer(t, map[string]string{})
+	for i, source := range []Source{NewMonobank(srv.URL, time.Second), NewPrivatBank(srv.URL, time.Second), NewNbu(srv.URL, time.Second)} {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if _, err := source.Fetch(context.Background()); err == nil {
+				t.Errorf("expected error, got %v\n", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MINFIN_URL = "https://minfin.com.ua"
+	// MINFIN_USD_PATH is the page with USD rates of banks
+	MINFIN_USD_PATH = "/ua/currency/banks/usd/"
+)
+
+// minfinTimeLayouts are tried in order, layouts without date are of the current day or year
+var minfinTimeLayouts = []string{"02.01.2006 15:04", "2006-01-02 15:04", "2006-01-02T15:04:05Z07:00", "02.01 15:04", "15:04"}
+
+// kyiv is the time zone minfin shows times in
+var kyiv = loadLocation("Europe/Kyiv")
+
+var ErrNoRates = errors.New("no rates found")
+
+func loadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+
+	return loc
+}
+
+// Minfin scrapes table of bank rates from minfin.com.ua
+type Minfin struct {
+	BaseUrl string
+	client  *http.Client
+}
+
+func NewMinfin(baseUrl string, timeout time.Duration) *Minfin {
+	return &Minfin{BaseUrl: strings.TrimSuffix(baseUrl, "/"), client: newClient(timeout)}
+}
+
+func (m *Minfin) Name() string {
+	return "minfin"
+}
+
+func (m *Minfin) Fetch(ctx context.Context) ([]model.BankRate, error) {
+	sourceUrl := m.BaseUrl + MINFIN_USD_PATH
+	body, err := get(ctx, m.client, sourceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseMinfin(bytes.NewReader(body), sourceUrl, time.Now())
+}
+
+// ParseMinfin reads rates from #smTable rows, cells are bank, buy, sell, buy online, sell online, update time and site.
+// Missing rates are left zero, rows without bank or update time are skipped.
+func ParseMinfin(r io.Reader, sourceUrl string, now time.Time) ([]model.BankRate, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(sourceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	rates := []model.BankRate{}
+	doc.Find("#smTable tbody tr").Each(func(i int, row *goquery.Selection) {
+		cells := row.Find("[data-title]")
+		bank := strings.TrimSpace(cells.Eq(0).Text())
+		if bank == "" {
+			return
+		}
+
+		updateAt, err := parseMinfinTime(strings.TrimSpace(cells.Eq(5).Text()), now)
+		if err != nil {
+			logger.Warn("skipping minfin row", "bank", bank, "err", err)
+			return
+		}
+
+		rate := model.BankRate{
+			Bank:        bank,
+			Buy:         parseMinfinRate(cells.Eq(1).Text()),
+			Sell:        parseMinfinRate(cells.Eq(2).Text()),
+			BuyOnline:   parseMinfinRate(cells.Eq(3).Text()),
+			SellOnline:  parseMinfinRate(cells.Eq(4).Text()),
+			LastUpdated: updateAt,
+			Source:      sourceUrl,
+		}
+		if href, ok := cells.Eq(6).Find("a").First().Attr("href"); ok {
+			if site, err := base.Parse(href); err == nil {
+				rate.SiteUrl = site.String()
+			}
+		}
+
+		rates = append(rates, rate)
+	})
+
+	if len(rates) == 0 {
+		return nil, ErrNoRates
+	}
+
+	return rates, nil
+}
+
+// parseMinfinRate parses "41,25" and "41.25", missing rates ("-", empty) are zero
+func parseMinfinRate(str string) float64 {
+	str = strings.ReplaceAll(strings.TrimSpace(str), ",", ".")
+	if fields := strings.Fields(str); len(fields) > 0 {
+		// rate may be followed by its change
+		str = fields[0]
+	}
+
+	rate, err := strconv.ParseFloat(str, 64)
+	if err != nil || rate < 0 {
+		return 0
+	}
+
+	return rate
+}
+
+func parseMinfinTime(str string, now time.Time) (time.Time, error) {
+	now = now.In(kyiv)
+	for _, layout := range minfinTimeLayouts {
+		at, err := time.ParseInLocation(layout, str, kyiv)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case !strings.Contains(layout, "01"):
+			at = time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, kyiv)
+		case !strings.Contains(layout, "2006"):
+			at = time.Date(now.Year(), at.Month(), at.Day(), at.Hour(), at.Minute(), 0, 0, kyiv)
+			// December dates seen in January are of the last year
+			if at.After(now.AddDate(0, 0, 1)) {
+				at = at.AddDate(-1, 0, 0)
+			}
+		}
+
+		return at, nil
+	}
+
+	return time.Time{}, fmt.Errorf("unknown time format %q", str)
+}
@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func openFixture(t *testing.T, name string) *os.File {
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatalf("failed to open fixture %s: %s", name, err)
+	}
+
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestParseMinfin(t *testing.T) {
+	now := time.Date(2024, time.June, 10, 15, 0, 0, 0, kyiv)
+	sourceUrl := MINFIN_URL + MINFIN_USD_PATH
+	rates, err := ParseMinfin(openFixture(t, "minfin_usd.html"), sourceUrl, now)
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	e := []model.BankRate{
+		{
+			Bank: "Приватбанк", Buy: 41.05, Sell: 41.55, BuyOnline: 41.1, SellOnline: 41.49,
+			LastUpdated: time.Date(2024, time.June, 10, 12, 34, 0, 0, kyiv),
+			Source:      sourceUrl,
+			SiteUrl:     "https://privatbank.ua/",
+		},
+		{
+			Bank: "monobank", Buy: 41.1, Sell: 41.6,
+			LastUpdated: time.Date(2024, time.June, 10, 9, 15, 0, 0, kyiv),
+			Source:      sourceUrl,
+			SiteUrl:     "https://minfin.com.ua/go/monobank/",
+		},
+		{
+			Bank: "Ощадбанк", Buy: 40.9, Sell: 41.6, BuyOnline: 40.95, SellOnline: 41.55,
+			LastUpdated: time.Date(2023, time.December, 31, 23, 50, 0, 0, kyiv),
+			Source:      sourceUrl,
+		},
+	}
+
+	if len(rates) != len(e) {
+		t.Fatalf("expected %v, got %v\n", e, rates)
+	}
+
+	for i := range e {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			res := rates[i]
+			if !res.LastUpdated.Equal(e[i].LastUpdated) {
+				t.Errorf("expected %v, got %v\n", e[i].LastUpdated, res.LastUpdated)
+			}
+
+			res.LastUpdated = e[i].LastUpdated
+			if res != e[i] {
+				t.Errorf("expected %v, got %v\n", e[i], res)
+			}
+		})
+	}
+}
+
+func TestParseMinfinEmpty(t *testing.T) {
+	_, err := ParseMinfin(openFixture(t, "minfin_empty.html"), MINFIN_URL+MINFIN_USD_PATH, time.Now())
+	if !errors.Is(err, ErrNoRates) {
+		t.Errorf("expected %v, got %v\n", ErrNoRates, err)
+	}
+}
+
+func TestParseMinfinTime(t *testing.T) {
+	type tt struct {
+		i   string
+		e   time.Time
+		err bool
+	}
+
+	now := time.Date(2024, time.January, 2, 10, 0, 0, 0, kyiv)
+	ts := []tt{
+		{i: "01.01.2024 08:30", e: time.Date(2024, time.January, 1, 8, 30, 0, 0, kyiv)},
+		{i: "2024-01-01 08:30", e: time.Date(2024, time.January, 1, 8, 30, 0, 0, kyiv)},
+		{i: "2024-01-01T06:30:00Z", e: time.Date(2024, time.January, 1, 8, 30, 0, 0, kyiv)},
+		{i: "01.01 08:30", e: time.Date(2024, time.January, 1, 8, 30, 0, 0, kyiv)},
+		{i: "31.12 23:00", e: time.Date(2023, time.December, 31, 23, 0, 0, 0, kyiv)},
+		{i: "09:45", e: time.Date(2024, time.January, 2, 9, 45, 0, 0, kyiv)},
+		{i: "", err: true},
+		{i: "вчора", err: true},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			res, err := parseMinfinTime(test.i, now)
+			if (err != nil) != test.err || !res.Equal(test.e) {
+				t.Errorf("expected %v %v, got %v %v\n", test.e, test.err, res, err)
+			}
+		})
+	}
+}
+
+func TestParseMinfinRate(t *testing.T) {
+	type tt struct {
+		i string
+		e float64
+	}
+
+	ts := []tt{
+		{i: "41,0500", e: 41.05},
+		{i: " 41.05\n", e: 41.05},
+		{i: "41,10 +0,05", e: 41.1},
+		{i: "-", e: 0},
+		{i: "", e: 0},
+		{i: "n/a", e: 0},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if res := parseMinfinRate(test.i); res != test.e {
+				t.Errorf("expected %v, got %v\n", test.e, res)
+			}
+		})
+	}
+}
+
+func TestMinfinFetch(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/minfin_usd.html")
+	if err != nil {
+		t.Fatalf("failed to read fixture: %s", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != MINFIN_USD_PATH {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write(fixture)
+	}))
+	defer srv.Close()
+
+	rates, err := NewMinfin(srv.URL+"/", time.Second).Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("failed to fetch: %s", err)
+	}
+
+	if len(rates) != 3 || rates[0].Source != srv.URL+MINFIN_USD_PATH || rates[0].SiteUrl != "https://privatbank.ua/" {
+		t.Errorf("expected 3 rates from %s, got %v\n", srv.URL, rates)
+	}
+
+	if _, err := NewMinfin(srv.URL+"/broken", time.Second).Fetch(context.Background()); err == nil {
+		t.Errorf("expected error, got %v\n", err)
+	}
+}
@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	MONOBANK_URL           = "https://api.monobank.ua"
+	MONOBANK_CURRENCY_PATH = "/bank/currency"
+	// MONOBANK_BANK is the name rates are stored under, same as on minfin
+	MONOBANK_BANK = "monobank"
+	// ISO_USD and ISO_UAH are ISO 4217 numeric currency codes
+	ISO_USD = 840
+	ISO_UAH = 980
+)
+
+var ErrNoUsdRate = errors.New("no USD rate found")
+
+type monobankRate struct {
+	CurrencyCodeA int     `json:"currencyCodeA"`
+	CurrencyCodeB int     `json:"currencyCodeB"`
+	Date          int64   `json:"date"`
+	RateBuy       float64 `json:"rateBuy"`
+	RateSell      float64 `json:"rateSell"`
+	RateCross     float64 `json:"rateCross"`
+}
+
+// Monobank reads public currency API, it is cached by monobank for 5 minutes and rate limited
+type Monobank struct {
+	BaseUrl string
+	client  *http.Client
+}
+
+func NewMonobank(baseUrl string, timeout time.Duration) *Monobank {
+	return &Monobank{BaseUrl: strings.TrimSuffix(baseUrl, "/"), client: newClient(timeout)}
+}
+
+func (m *Monobank) Name() string {
+	return "monobank"
+}
+
+// Fetch returns USD/UAH rate, monobank has no cash desks so card rate is both cash and online one
+func (m *Monobank) Fetch(ctx context.Context) ([]model.BankRate, error) {
+	sourceUrl := m.BaseUrl + MONOBANK_CURRENCY_PATH
+	body, err := get(ctx, m.client, sourceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	rates := []monobankRate{}
+	if err := json.Unmarshal(body, &rates); err != nil {
+		return nil, err
+	}
+
+	for _, rate := range rates {
+		if rate.CurrencyCodeA != ISO_USD || rate.CurrencyCodeB != ISO_UAH || rate.RateBuy <= 0 || rate.RateSell <= 0 {
+			continue
+		}
+
+		return []model.BankRate{{
+			Bank:        MONOBANK_BANK,
+			Buy:         rate.RateBuy,
+			Sell:        rate.RateSell,
+			BuyOnline:   rate.RateBuy,
+			SellOnline:  rate.RateSell,
+			LastUpdated: time.Unix(rate.Date, 0),
+			Source:      sourceUrl,
+			SiteUrl:     "https://www.monobank.ua/",
+		}}, nil
+	}
+
+	return nil, ErrNoUsdRate
+}
@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	NBU_URL           = "https://bank.gov.ua"
+	NBU_EXCHANGE_PATH = "/NBUStatService/v1/statdirectory/exchange"
+	// NBU_BANK is the name official rate is stored under, it is not listed among banks
+	NBU_BANK = "НБУ"
+	// NBU_DATE_LAYOUT is layout of exchangedate, the day rate is official for
+	NBU_DATE_LAYOUT = "02.01.2006"
+)
+
+type nbuRate struct {
+	R030         int     `json:"r030"`
+	Rate         float64 `json:"rate"`
+	Cc           string  `json:"cc"`
+	ExchangeDate string  `json:"exchangedate"`
+}
+
+// Nbu reads official rate of National Bank of Ukraine, which is a reference rather than an exchange offer
+type Nbu struct {
+	BaseUrl string
+	client  *http.Client
+}
+
+func NewNbu(baseUrl string, timeout time.Duration) *Nbu {
+	return &Nbu{BaseUrl: strings.TrimSuffix(baseUrl, "/"), client: newClient(timeout)}
+}
+
+func (n *Nbu) Name() string {
+	return "nbu"
+}
+
+// Fetch returns official rate as both buy and sell, updated at the start of the day it is official for.
+// The rate is marked official, so it is kept out of best rates, summaries and emails.
+func (n *Nbu) Fetch(ctx context.Context) ([]model.BankRate, error) {
+	sourceUrl := n.BaseUrl + NBU_EXCHANGE_PATH + "?valcode=USD&json"
+	body, err := get(ctx, n.client, sourceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	rates := []nbuRate{}
+	if err := json.Unmarshal(body, &rates); err != nil {
+		return nil, err
+	}
+
+	for _, rate := range rates {
+		if rate.Cc != "USD" || rate.Rate <= 0 {
+			continue
+		}
+
+		updateAt, err := time.ParseInLocation(NBU_DATE_LAYOUT, rate.ExchangeDate, kyiv)
+		if err != nil {
+			return nil, err
+		}
+
+		return []model.BankRate{{
+			Bank:        NBU_BANK,
+			Buy:         rate.Rate,
+			Sell:        rate.Rate,
+			LastUpdated: updateAt,
+			Source:      sourceUrl,
+			SiteUrl:     "https://bank.gov.ua/",
+			Official:    true,
+		}}, nil
+	}
+
+	return nil, ErrNoUsdRate
+}
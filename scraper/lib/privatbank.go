@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PRIVATBANK_URL           = "https://api.privatbank.ua"
+	PRIVATBANK_EXCHANGE_PATH = "/p24api/pubinfo"
+	// PRIVATBANK_BANK is the name rates are stored under, same as on minfin
+	PRIVATBANK_BANK = "Приватбанк"
+	// PRIVATBANK_CASH and PRIVATBANK_CASHLESS are coursid of branch and card rates
+	PRIVATBANK_CASH     = 5
+	PRIVATBANK_CASHLESS = 11
+)
+
+type privatbankRate struct {
+	Ccy     string `json:"ccy"`
+	BaseCcy string `json:"base_ccy"`
+	Buy     string `json:"buy"`
+	Sale    string `json:"sale"`
+}
+
+// PrivatBank reads exchange rates API of branches and cards. Rates have no time, so they are of the fetch time
+// and replace rates of the same bank scraped earlier, e.g. from minfin.
+type PrivatBank struct {
+	BaseUrl string
+	client  *http.Client
+}
+
+func NewPrivatBank(baseUrl string, timeout time.Duration) *PrivatBank {
+	return &PrivatBank{BaseUrl: strings.TrimSuffix(baseUrl, "/"), client: newClient(timeout)}
+}
+
+func (p *PrivatBank) Name() string {
+	return "privatbank"
+}
+
+func (p *PrivatBank) Fetch(ctx context.Context) ([]model.BankRate, error) {
+	sourceUrl := p.exchangeUrl(PRIVATBANK_CASH)
+	buy, sell, err := p.fetchUsd(ctx, sourceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	buyOnline, sellOnline, err := p.fetchUsd(ctx, p.exchangeUrl(PRIVATBANK_CASHLESS))
+	if err != nil {
+		return nil, err
+	}
+
+	return []model.BankRate{{
+		Bank:        PRIVATBANK_BANK,
+		Buy:         buy,
+		Sell:        sell,
+		BuyOnline:   buyOnline,
+		SellOnline:  sellOnline,
+		LastUpdated: time.Now(),
+		Source:      sourceUrl,
+		SiteUrl:     "https://privatbank.ua/",
+	}}, nil
+}
+
+func (p *PrivatBank) exchangeUrl(coursId int) string {
+	return p.BaseUrl + PRIVATBANK_EXCHANGE_PATH + "?exchange&json&coursid=" + strconv.Itoa(coursId)
+}
+
+// fetchUsd returns buy and sell USD/UAH rates, given as strings by the API
+func (p *PrivatBank) fetchUsd(ctx context.Context, url string) (float64, float64, error) {
+	body, err := get(ctx, p.client, url)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rates := []privatbankRate{}
+	if err := json.Unmarshal(body, &rates); err != nil {
+		return 0, 0, err
+	}
+
+	for _, rate := range rates {
+		if rate.Ccy != "USD" || rate.BaseCcy != "UAH" {
+			continue
+		}
+
+		buy, err := strconv.ParseFloat(rate.Buy, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		sell, err := strconv.ParseFloat(rate.Sale, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		return buy, sell, nil
+	}
+
+	return 0, 0, ErrNoUsdRate
+}
@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/logging"
+	"github.com/charkpep/usd_rate_api/shared/stream"
+	"github.com/charkpep/usd_rate_api/shared/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// Scrape fetches rates of every source and publishes them, failed sources do not stop the others
+func Scrape(ctx context.Context, sources []Source, publisher *stream.Publisher) error {
+	var errs []error
+	for _, source := range sources {
+		if err := scrapeSource(ctx, source, publisher); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source.Name(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// scrapeSource is traced as its own request, so consumption of its rates continues the trace
+func scrapeSource(ctx context.Context, source Source, publisher *stream.Publisher) (err error) {
+	ctx = logging.WithRequestId(ctx, logging.NewRequestId())
+	ctx, span := tracer.Start(ctx, "Scraper.scrape", trace.WithAttributes(attribute.String("source", source.Name())))
+	defer func() { tracing.End(span, err) }()
+	start := time.Now()
+	rates, err := source.Fetch(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to fetch rates", "source", source.Name(), "err", err)
+		return err
+	}
+
+	span.SetAttributes(attribute.Int("rates", len(rates)))
+	msgs := make([]stream.BankRateMessage, 0, len(rates))
+	for i := range rates {
+		msgs = append(msgs, stream.NewBankRateMessage(&rates[i]))
+	}
+
+	if _, err = publisher.PublishBulk(ctx, msgs); err != nil {
+		logger.ErrorContext(ctx, "failed to publish rates", "source", source.Name(), "err", err)
+		return err
+	}
+
+	logger.InfoContext(ctx, "scraped", "source", source.Name(), "rates", len(rates), "duration", time.Since(start))
+	return nil
+}
@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/logging"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"go.opentelemetry.io/otel"
+	"io"
+	"net/http"
+	"time"
+)
+
+var logger = logging.New("scraper")
+
+var tracer = otel.Tracer("github.com/charkpep/usd_rate_api/scraper")
+
+// USER_AGENT is sent with every source request, some sources refuse requests without one
+const USER_AGENT = "Mozilla/5.0 (compatible; usd-rate-scraper/1.0)"
+
+// Source is a provider of current bank rates
+type Source interface {
+	// Name identifies source in logs and config
+	Name() string
+	Fetch(ctx context.Context) ([]model.BankRate, error)
+}
+
+// get requests url and returns its body, non 2xx responses are errors
+func get(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", USER_AGENT)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s responded with %s", url, res.Status)
+	}
+
+	return io.ReadAll(res.Body)
+}
+
+func newClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout}
+}
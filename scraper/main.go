@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/scraper/lib"
+	"github.com/charkpep/usd_rate_api/shared/bus"
+	"github.com/charkpep/usd_rate_api/shared/logging"
+	"github.com/charkpep/usd_rate_api/shared/stream"
+	"github.com/charkpep/usd_rate_api/shared/tracing"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	// scratch image has no time zone database, minfin times are in Europe/Kyiv
+	_ "time/tzdata"
+)
+
+// SHUTDOWN_TIMEOUT is how long traces are flushed on exit
+const SHUTDOWN_TIMEOUT = 5 * time.Second
+
+func getEnvDefault(key, def string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+
+	return def
+}
+
+// newSources builds sources listed in SOURCES, comma separated
+func newSources(names string, timeout time.Duration) ([]lib.Source, error) {
+	sources := []lib.Source{}
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "minfin":
+			sources = append(sources, lib.NewMinfin(getEnvDefault("MINFIN_URL", lib.MINFIN_URL), timeout))
+		case "monobank":
+			sources = append(sources, lib.NewMonobank(getEnvDefault("MONOBANK_URL", lib.MONOBANK_URL), timeout))
+		case "privatbank":
+			sources = append(sources, lib.NewPrivatBank(getEnvDefault("PRIVATBANK_URL", lib.PRIVATBANK_URL), timeout))
+		case "nbu":
+			sources = append(sources, lib.NewNbu(getEnvDefault("NBU_URL", lib.NBU_URL), timeout))
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown source %q", name)
+		}
+	}
+
+	return sources, nil
+}
+
+// newBus connects to the bus set by BUS, redis or nats, REDIS_URL is required only for redis.
+// The stream is not trimmed on publish, the consumer trims it without losing entries its group has not processed.
+func newBus() (bus.Bus, func(), error) {
+	switch kind := getEnvDefault("BUS", "redis"); kind {
+	case "redis":
+		url, ok := os.LookupEnv("REDIS_URL")
+		if !ok {
+			return nil, nil, errors.New("missing REDIS_URL")
+		}
+
+		opt, err := redis.ParseURL(url)
+		if err != nil {
+			return nil, nil, fmt.Errorf("REDIS_URL: %w", err)
+		}
+
+		rdb := redis.NewClient(opt)
+		return bus.NewRedis(rdb, bus.RedisConfig{}), func() { rdb.Close() }, nil
+	case "nats":
+		url, ok := os.LookupEnv("NATS_URL")
+		if !ok {
+			return nil, nil, errors.New("missing NATS_URL")
+		}
+
+		nc, err := nats.Connect(url)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// stream limits are set by the consumer which creates the stream
+		b, err := bus.NewJetStream(nc, bus.JetStreamConfig{})
+		if err != nil {
+			nc.Close()
+			return nil, nil, err
+		}
+
+		// pending publishes are flushed before exit
+		return b, func() { nc.Drain() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown bus %q", kind)
+	}
+}
+
+func main() {
+	logger := logging.New("scraper")
+	slog.SetDefault(logger)
+	timeout, err := time.ParseDuration(getEnvDefault("SCRAPE_TIMEOUT", "60s"))
+	if err != nil {
+		logger.Error("failed to parse SCRAPE_TIMEOUT", "err", err)
+		os.Exit(1)
+	}
+
+	sources, err := newSources(getEnvDefault("SOURCES", "minfin"), timeout)
+	if err != nil {
+		logger.Error("failed to parse SOURCES", "err", err)
+		os.Exit(1)
+	}
+
+	b, closeBus, err := newBus()
+	if err != nil {
+		logger.Error("failed to connect to bus", "err", err)
+		os.Exit(1)
+	}
+	defer closeBus()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Init(ctx, "scraper")
+	if err != nil {
+		logger.Error("failed to init tracing", "err", err)
+		os.Exit(1)
+	}
+
+	start := time.Now()
+	publisher := stream.NewBusPublisher(b, stream.PublisherConfig{Stream: getEnvDefault("REDIS_STEAM", "rate:usd")})
+	scrapeErr := lib.Scrape(ctx, sources, publisher)
+	logger.Info("done", "duration", time.Since(start))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("failed to flush traces", "err", err)
+	}
+
+	if scrapeErr != nil {
+		logger.Error("scrape failed", "err", scrapeErr)
+		closeBus()
+		os.Exit(1)
+	}
+}
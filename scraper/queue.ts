@@ -1,36 +1,45 @@
 import Redis from "ioredis";
+import {randomBytes} from "node:crypto";
 
 export const rdb = new Redis(process.env["REDIS_URL"] ?? "")
-export const GetPush = (queue: string) => {
-    return async (msg: any) => {
-        await rdb.xadd(queue, "*", ...Object.getOwnPropertyNames(msg).reduce<any[]>((acc, currentValue) => {
-            if (!Number.isNaN(msg[currentValue])) {
-                acc.push(currentValue, msg[currentValue])
-                return acc
-            }
-            
-            acc.push(currentValue, -1)
+
+// SCHEMA_VERSION of published messages, see shared/stream/schema/bank_rate_message.v1.json
+export const SCHEMA_VERSION = "1"
+
+// every scraper run is a single trace, consumers continue it from W3C traceparent field of the message
+const traceId = randomBytes(16).toString("hex")
+const withTraceparent = (msg: Record<string, any>) => {
+    return {...msg, traceparent: `00-${traceId}-${randomBytes(8).toString("hex")}-01`}
+}
+
+// toFields flattens message to stream entry fields, missing values (NaN, null, invalid dates, empty strings) are omitted
+const toFields = (msg: Record<string, any>) => {
+    msg = {...withTraceparent(msg), schema_version: SCHEMA_VERSION}
+    return Object.getOwnPropertyNames(msg).reduce<any[]>((acc, currentValue) => {
+        let value = msg[currentValue]
+        if (value instanceof Date) {
+            value = Number.isNaN(value.getTime()) ? undefined : value.toISOString()
+        }
+
+        if (value === undefined || value === null || value === "" || Number.isNaN(value)) {
             return acc
-       }, []))
+        }
+
+        acc.push(currentValue, value)
+        return acc
+    }, [])
+}
+
+export const GetPush = (queue: string) => {
+    return async (msg: Record<string, any>) => {
+        await rdb.xadd(queue, "*", ...toFields(msg))
     }
 }
 export const GetBulkPush = (queue: string) => {
     return async (messages: Record<string, any>[]) => {
         const p = rdb.pipeline()
-        for (const msg of messages) {
-            p.xadd(queue, "*", ...Object.getOwnPropertyNames(msg).reduce<any[]>((acc, currentValue) => {
-                if (!Number.isNaN(msg[currentValue])) {
-                    if (msg[currentValue] instanceof Date) {
-                        acc.push(currentValue, (msg[currentValue] as Date).toISOString())
-                        return acc
-                    }
-                    acc.push(currentValue, msg[currentValue])
-                    return acc
-                }
-
-                acc.push(currentValue, null)
-                return acc
-            }, []))
+        for (const message of messages) {
+            p.xadd(queue, "*", ...toFields(message))
         }
 
         await p.exec()
@@ -0,0 +1,386 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/redis/go-redis/v9"
+	"strings"
+	"time"
+)
+
+const (
+	// API_KEY_USAGE_TTL keeps daily usage counter a day longer than the day it counts
+	API_KEY_USAGE_TTL = 48 * time.Hour
+	// MAIL_RUNS_MAX_LEN is approximate number of requested mail runs kept
+	MAIL_RUNS_MAX_LEN = 100
+)
+
+// ErrStreamNotFound is returned for a stream which does not exist
+var ErrStreamNotFound = errors.New("stream not found")
+
+type StreamInfo struct {
+	Stream    *redis.XInfoStream
+	Groups    []redis.XInfoGroup
+	Consumers []redis.XInfoConsumer
+	// Pending is summary of entries delivered to the group but not acknowledged
+	Pending *redis.XPending
+}
+
+func (db *Database) SetApiKey(ctx context.Context, key *model.ApiKey) error {
+	ctx, span := startSpan(ctx, "SetApiKey")
+	defer span.End()
+	keyBuff, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, fmt.Sprintf("apikey:%s", key.Id), string(keyBuff), 0)
+		pipe.SAdd(ctx, "apikeys", key.Id)
+		return nil
+	})
+
+	return err
+}
+
+// GetApiKey returns nil if key does not exist
+func (db *Database) GetApiKey(ctx context.Context, id string) (*model.ApiKey, error) {
+	ctx, span := startSpan(ctx, "GetApiKey")
+	defer span.End()
+	keyRaw, err := db.db.Get(ctx, fmt.Sprintf("apikey:%s", id)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	key := model.ApiKey{}
+	if err := json.Unmarshal([]byte(keyRaw), &key); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (db *Database) GetApiKeys(ctx context.Context) ([]model.ApiKey, error) {
+	ctx, span := startSpan(ctx, "GetApiKeys")
+	defer span.End()
+	ids, err := db.db.SMembers(ctx, "apikeys").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]model.ApiKey, 0, len(ids))
+	for _, id := range ids {
+		key, err := db.GetApiKey(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if key != nil {
+			keys = append(keys, *key)
+		}
+	}
+
+	return keys, nil
+}
+
+// DeleteApiKey returns false if key does not exist
+func (db *Database) DeleteApiKey(ctx context.Context, id string) (bool, error) {
+	ctx, span := startSpan(ctx, "DeleteApiKey")
+	defer span.End()
+	var deleted *redis.IntCmd
+	_, err := db.db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, fmt.Sprintf("apikey:%s", id))
+		pipe.Del(ctx, fmt.Sprintf("apikey:%s:usage", id), fmt.Sprintf("apikey:%s:usage:%s", id, usageDay(time.Now())))
+		pipe.SRem(ctx, "apikeys", id)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return deleted.Val() > 0, nil
+}
+
+// apiKeyUsageScript counts a request in the daily and total usage unless the daily quota is reached.
+// Returns 1 if request is counted, 0 if quota is exceeded.
+var apiKeyUsageScript = redis.NewScript(`
+local quota = tonumber(ARGV[1])
+if quota > 0 and tonumber(redis.call('GET', KEYS[1]) or '0') >= quota then
+	return 0
+end
+
+redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+redis.call('HINCRBY', KEYS[2], 'total', 1)
+redis.call('HSET', KEYS[2], 'last_used_at', ARGV[3])
+return 1
+`)
+
+// IncrApiKeyUsage counts a request made with the key unless quota of requests a day is reached, zero quota is unlimited.
+// Returns false if quota is exceeded, the request is not counted then.
+func (db *Database) IncrApiKeyUsage(ctx context.Context, id string, at time.Time, quota int64) (bool, error) {
+	ctx, span := startSpan(ctx, "IncrApiKeyUsage")
+	defer span.End()
+	keys := []string{fmt.Sprintf("apikey:%s:usage:%s", id, usageDay(at)), fmt.Sprintf("apikey:%s:usage", id)}
+	counted, err := apiKeyUsageScript.Run(ctx, db.db, keys, quota, API_KEY_USAGE_TTL.Milliseconds(), at.UnixMilli()).Int64()
+	if err != nil {
+		return false, err
+	}
+
+	return counted == 1, nil
+}
+
+func (db *Database) GetApiKeyUsage(ctx context.Context, id string, at time.Time) (*model.ApiKeyUsage, error) {
+	ctx, span := startSpan(ctx, "GetApiKeyUsage")
+	defer span.End()
+	usage := model.ApiKeyUsage{}
+	today, err := db.db.Get(ctx, fmt.Sprintf("apikey:%s:usage:%s", id, usageDay(at))).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	var total struct {
+		Total      int64 `redis:"total"`
+		LastUsedAt int64 `redis:"last_used_at"`
+	}
+	if err := db.db.HGetAll(ctx, fmt.Sprintf("apikey:%s:usage", id)).Scan(&total); err != nil {
+		return nil, err
+	}
+
+	usage.Today = today
+	usage.Total = total.Total
+	if total.LastUsedAt > 0 {
+		usage.LastUsedAt = time.UnixMilli(total.LastUsedAt)
+	}
+
+	return &usage, nil
+}
+
+// usageDay is UTC date quotas are counted by
+func usageDay(at time.Time) string {
+	return at.UTC().Format("20060102")
+}
+
+// SearchSubscribers returns up to limit subscribers which email or bank contains query, all if query is empty
+func (db *Database) SearchSubscribers(ctx context.Context, query string, limit int) ([]model.Subscriber, error) {
+	ctx, span := startSpan(ctx, "SearchSubscribers")
+	defer span.End()
+	match := "*"
+	if query != "" {
+		match = "*" + globEscaper.Replace(query) + "*"
+	}
+
+	subscribers := make([]model.Subscriber, 0)
+	iter := db.db.SScan(ctx, "rate:usd:subscribers", 0, match, 0).Iterator()
+	for iter.Next(ctx) && len(subscribers) < limit {
+		email, bank, ok := strings.Cut(iter.Val(), ":")
+		if !ok {
+			continue
+		}
+
+		subscribers = append(subscribers, model.Subscriber{Email: email, Bank: bank})
+	}
+
+	if iter.Err() != nil {
+		return nil, iter.Err()
+	}
+
+	return subscribers, nil
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// DeleteSubscriber returns false if email was not subscribed to the bank
+func (db *Database) DeleteSubscriber(ctx context.Context, email string, bank string) (bool, error) {
+	ctx, span := startSpan(ctx, "DeleteSubscriber")
+	defer span.End()
+	res, err := db.db.SRem(ctx, "rate:usd:subscribers", fmt.Sprintf("%s:%s", email, bank)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return res > 0, nil
+}
+
+// GetStreamInfo describes stream and its consumer group, group parts are empty if group does not exist.
+// Returns ErrStreamNotFound if stream does not exist.
+func (db *Database) GetStreamInfo(ctx context.Context, stream, group string) (*StreamInfo, error) {
+	ctx, span := startSpan(ctx, "GetStreamInfo")
+	defer span.End()
+	exists, err := db.db.Exists(ctx, stream).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if exists == 0 {
+		return nil, ErrStreamNotFound
+	}
+
+	info := StreamInfo{}
+	if info.Stream, err = db.db.XInfoStream(ctx, stream).Result(); err != nil {
+		return nil, err
+	}
+
+	if info.Groups, err = db.db.XInfoGroups(ctx, stream).Result(); err != nil {
+		return nil, err
+	}
+
+	for _, g := range info.Groups {
+		if g.Name != group {
+			continue
+		}
+
+		if info.Consumers, err = db.db.XInfoConsumers(ctx, stream, group).Result(); err != nil {
+			return nil, err
+		}
+
+		if info.Pending, err = db.db.XPending(ctx, stream, group).Result(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &info, nil
+}
+
+// RequestMailRun asks listening mailer to send emails, returns run id
+func (db *Database) RequestMailRun(ctx context.Context, run *model.MailRun) (string, error) {
+	ctx, span := startSpan(ctx, "RequestMailRun")
+	defer span.End()
+	runBuff, err := json.Marshal(run)
+	if err != nil {
+		return "", err
+	}
+
+	return db.db.XAdd(ctx, &redis.XAddArgs{
+		Stream: "mail:runs",
+		MaxLen: MAIL_RUNS_MAX_LEN,
+		Approx: true,
+		ID:     "*",
+		Values: map[string]interface{}{
+			"run": string(runBuff),
+		},
+	}).Result()
+}
+
+// ReadMailRuns returns runs requested after lastId, waiting up to block for new ones.
+// Returns no runs if none were requested in time.
+func (db *Database) ReadMailRuns(ctx context.Context, lastId string, block time.Duration) ([]model.MailRun, error) {
+	res, err := db.db.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{"mail:runs", lastId},
+		Block:   block,
+	}).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	runs := make([]model.MailRun, 0)
+	for _, stream := range res {
+		for _, msg := range stream.Messages {
+			runRaw, ok := msg.Values["run"].(string)
+			if !ok {
+				return nil, fmt.Errorf("mail run %s has no run", msg.ID)
+			}
+
+			run := model.MailRun{}
+			if err := json.Unmarshal([]byte(runRaw), &run); err != nil {
+				return nil, err
+			}
+
+			run.Id = msg.ID
+			runs = append(runs, run)
+		}
+	}
+
+	return runs, nil
+}
+
+// GetLastMailRunId returns id of the last run handled by mailer, empty if none was
+func (db *Database) GetLastMailRunId(ctx context.Context) (string, error) {
+	ctx, span := startSpan(ctx, "GetLastMailRunId")
+	defer span.End()
+	id, err := db.db.Get(ctx, "mail:runs:last_id").Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+
+	return id, err
+}
+
+// SetLastMailRunId stores id of the last run handled by mailer, so runs requested while it is down are not lost
+func (db *Database) SetLastMailRunId(ctx context.Context, id string) error {
+	ctx, span := startSpan(ctx, "SetLastMailRunId")
+	defer span.End()
+	return db.db.Set(ctx, "mail:runs:last_id", id, 0).Err()
+}
+
+// GetPendingEntries returns up to count entries of the group idle at least minIdle, oldest first
+func (db *Database) GetPendingEntries(ctx context.Context, stream, group string, minIdle time.Duration, count int64) ([]redis.XPendingExt, error) {
+	ctx, span := startSpan(ctx, "GetPendingEntries")
+	defer span.End()
+	pending, err := db.db.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  group,
+		Idle:   minIdle,
+		Start:  "-",
+		End:    "+",
+		Count:  count,
+	}).Result()
+	// some servers reply nil instead of empty list
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+
+	return pending, err
+}
+
+// ClaimEntries transfers pending entries idle at least minIdle to consumer, returns claimed entries
+func (db *Database) ClaimEntries(ctx context.Context, stream, group, consumer string, minIdle time.Duration, ids []string) ([]redis.XMessage, error) {
+	ctx, span := startSpan(ctx, "ClaimEntries")
+	defer span.End()
+	return db.db.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   stream,
+		Group:    group,
+		Consumer: consumer,
+		MinIdle:  minIdle,
+		Messages: ids,
+	}).Result()
+}
+
+// AckEntries returns number of entries acknowledged, entries not pending are ignored
+func (db *Database) AckEntries(ctx context.Context, stream, group string, ids []string) (int64, error) {
+	ctx, span := startSpan(ctx, "AckEntries")
+	defer span.End()
+	return db.db.XAck(ctx, stream, group, ids...).Result()
+}
+
+// GetStreamRange returns up to count entries with ids in [start, end], "-" and "+" are the ends of stream
+func (db *Database) GetStreamRange(ctx context.Context, stream, start, end string, count int64) ([]redis.XMessage, error) {
+	ctx, span := startSpan(ctx, "GetStreamRange")
+	defer span.End()
+	return db.db.XRangeN(ctx, stream, start, end, count).Result()
+}
+
+// GetStreamTail returns up to count last entries of stream, newest first
+func (db *Database) GetStreamTail(ctx context.Context, stream string, count int64) ([]redis.XMessage, error) {
+	ctx, span := startSpan(ctx, "GetStreamTail")
+	defer span.End()
+	return db.db.XRevRangeN(ctx, stream, "+", "-", count).Result()
+}
+
+// TrimStream deletes entries with ids less than minId, returns number of entries deleted
+func (db *Database) TrimStream(ctx context.Context, stream, minId string) (int64, error) {
+	ctx, span := startSpan(ctx, "TrimStream")
+	defer span.End()
+	return db.db.XTrimMinID(ctx, stream, minId).Result()
+}
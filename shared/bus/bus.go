@@ -0,0 +1,43 @@
+// Package bus abstracts the message stream between scrapers and consumer.
+// Redis Streams is the default backend, NATS JetStream is an alternative for deployments without Redis streams.
+package bus
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrClosed = errors.New("bus: subscription closed")
+
+// Message is an entry of topic, values are strings as published
+type Message struct {
+	Id     string
+	Values map[string]interface{}
+	// Deliveries is number of times message was delivered to the group, including this one
+	Deliveries int64
+}
+
+type Bus interface {
+	// Publish adds messages to topic in order, returns their ids
+	Publish(ctx context.Context, topic string, values ...map[string]interface{}) ([]string, error)
+	// Subscribe joins consumer to group of topic, the group is created reading topic from its start if missing.
+	// Every message is delivered to a single consumer of the group until acknowledged.
+	Subscribe(ctx context.Context, topic, group, consumer string) (Subscription, error)
+	Close() error
+}
+
+type Subscription interface {
+	// Messages is closed when subscription is closed or fails, see Err
+	Messages() <-chan Message
+	// Ack marks messages processed, so they are not delivered again
+	Ack(ctx context.Context, msgs ...Message) error
+	// Nack delivers messages again, e.g. if they failed to be processed
+	Nack(ctx context.Context, msgs ...Message) error
+	// Claim takes over messages delivered to other consumers of the group and not acknowledged within minIdle,
+	// e.g. of consumers which are gone. Returns number of messages claimed, they are delivered by Messages.
+	Claim(ctx context.Context, minIdle time.Duration) (int, error)
+	// Err is why Messages was closed, nil after Close
+	Err() error
+	Close() error
+}
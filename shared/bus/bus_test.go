@@ -0,0 +1,268 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/testenv"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"testing"
+	"time"
+)
+
+func newRedis(t *testing.T) Bus {
+	rdb, _ := testenv.NewRedis(t)
+	return NewRedis(rdb, RedisConfig{Block: 50 * time.Millisecond})
+}
+
+// newNats runs embedded NATS server with JetStream
+func newNats(t *testing.T) *nats.Conn {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server is not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func newJetStream(t *testing.T, conf JetStreamConfig) Bus {
+	b, err := NewJetStream(newNats(t), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func receive(t *testing.T, sub Subscription, n int) []Message {
+	t.Helper()
+	msgs := make([]Message, 0, n)
+	timeout := time.After(5 * time.Second)
+	for len(msgs) < n {
+		select {
+		case msg, ok := <-sub.Messages():
+			if !ok {
+				t.Fatalf("expected %d messages, subscription closed after %d: %v\n", n, len(msgs), sub.Err())
+			}
+			msgs = append(msgs, msg)
+		case <-timeout:
+			t.Fatalf("expected %d messages, got %d\n", n, len(msgs))
+		}
+	}
+
+	return msgs
+}
+
+func assertNone(t *testing.T, sub Subscription, wait time.Duration) {
+	t.Helper()
+	select {
+	case msg := <-sub.Messages():
+		t.Errorf("expected no messages, got %v\n", msg)
+	case <-time.After(wait):
+	}
+}
+
+func TestBus(t *testing.T) {
+	type tt struct {
+		name string
+		bus  func(t *testing.T) Bus
+	}
+
+	ts := []tt{
+		{name: "redis", bus: newRedis},
+		{name: "jetstream", bus: func(t *testing.T) Bus { return newJetStream(t, JetStreamConfig{}) }},
+	}
+
+	for _, test := range ts {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			b := test.bus(t)
+			sub, err := b.Subscribe(ctx, "rate:usd", "group", "c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+
+			ids, err := b.Publish(ctx, "rate:usd", map[string]interface{}{"bank": "a", "n": 1}, map[string]interface{}{"bank": "b"})
+			if err != nil || len(ids) != 2 {
+				t.Fatalf("expected 2 ids, got %v %v\n", ids, err)
+			}
+
+			msgs := receive(t, sub, 2)
+			for i, e := range []map[string]interface{}{{"bank": "a", "n": "1"}, {"bank": "b"}} {
+				if msgs[i].Id != ids[i] || fmt.Sprint(msgs[i].Values) != fmt.Sprint(e) || msgs[i].Deliveries != 1 {
+					t.Errorf("expected %s %v 1, got %+v\n", ids[i], e, msgs[i])
+				}
+			}
+
+			if err := sub.Ack(ctx, msgs[0]); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := sub.Nack(ctx, msgs[1]); err != nil {
+				t.Fatal(err)
+			}
+
+			redelivered := receive(t, sub, 1)[0]
+			if redelivered.Id != ids[1] || redelivered.Deliveries != 2 {
+				t.Errorf("expected %s delivered 2 times, got %+v\n", ids[1], redelivered)
+			}
+
+			if err := sub.Ack(ctx, redelivered); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := b.Publish(ctx, "rate:usd", map[string]interface{}{"bank": "c"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if msg := receive(t, sub, 1)[0]; msg.Values["bank"] != "c" {
+				t.Errorf("expected c, got %v\n", msg.Values)
+			}
+
+			assertNone(t, sub, 200*time.Millisecond)
+			if err := sub.Close(); err != nil || sub.Err() != nil {
+				t.Errorf("expected nil, got %v %v\n", err, sub.Err())
+			}
+		})
+	}
+}
+
+func TestRedisClaim(t *testing.T) {
+	ctx := context.Background()
+	b := newRedis(t)
+	if _, err := b.Publish(ctx, "rate:usd", map[string]interface{}{"bank": "a"}, map[string]interface{}{"bank": "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	gone, err := b.Subscribe(ctx, "rate:usd", "group", "gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive(t, gone, 2)
+	gone.Close()
+	sub, err := b.Subscribe(ctx, "rate:usd", "group", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if n, err := sub.Claim(ctx, time.Hour); n != 0 || err != nil {
+		t.Errorf("expected 0, got %d %v\n", n, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if n, err := sub.Claim(ctx, 10*time.Millisecond); n != 2 || err != nil {
+		t.Errorf("expected 2, got %d %v\n", n, err)
+	}
+
+	for _, msg := range receive(t, sub, 2) {
+		if msg.Deliveries != 2 {
+			t.Errorf("expected 2, got %d\n", msg.Deliveries)
+		}
+	}
+
+	// entries claimed but not acked are delivered again on restart
+	sub.Close()
+	restarted, err := b.Subscribe(ctx, "rate:usd", "group", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+
+	if msgs := receive(t, restarted, 2); msgs[0].Values["bank"] != "a" || msgs[1].Values["bank"] != "b" {
+		t.Errorf("expected a and b, got %v\n", msgs)
+	}
+}
+
+func TestJetStreamRedelivery(t *testing.T) {
+	ctx := context.Background()
+	b := newJetStream(t, JetStreamConfig{AckWait: 200 * time.Millisecond})
+	sub, err := b.Subscribe(ctx, "rate:usd", "group", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if _, err := b.Publish(ctx, "rate:usd", map[string]interface{}{"bank": "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, sub, 1)[0]
+	if second := receive(t, sub, 1)[0]; second.Id != first.Id || second.Deliveries != 2 {
+		t.Errorf("expected %s delivered 2 times, got %+v\n", first.Id, second)
+	}
+}
+
+func TestJetStreamConfig(t *testing.T) {
+	ctx := context.Background()
+	nc := newNats(t)
+	publisher, err := NewJetStream(nc, JetStreamConfig{MaxMsgs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := publisher.Publish(ctx, "rate:usd", map[string]interface{}{"bank": "a"}); !errors.Is(err, jetstream.ErrStreamNotFound) {
+		t.Errorf("expected %v, got %v\n", jetstream.ErrStreamNotFound, err)
+	}
+
+	subscriber, err := NewJetStream(nc, JetStreamConfig{MaxMsgs: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := subscriber.Subscribe(ctx, "rate:usd", "group", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := publisher.Publish(ctx, "rate:usd", map[string]interface{}{"bank": "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream, err := publisher.js.Stream(ctx, streamName("rate:usd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Config.MaxMsgs != 10 || info.Config.Retention != jetstream.InterestPolicy || info.State.Msgs != 3 {
+		t.Errorf("expected 10 %v 3, got %d %v %d\n", jetstream.InterestPolicy, info.Config.MaxMsgs, info.Config.Retention, info.State.Msgs)
+	}
+
+	if err := sub.Ack(ctx, receive(t, sub, 3)...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisAddArgs(t *testing.T) {
+	for i, maxLen := range []int64{0, 1000} {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			args := NewRedis(nil, RedisConfig{MaxLen: maxLen}).addArgs("rate:usd", map[string]interface{}{"bank": "a"})
+			if args.Stream != "rate:usd" || args.MaxLen != maxLen || args.Approx != (maxLen > 0) {
+				t.Errorf("expected stream rate:usd trimmed to %v, got %v %v %v\n", maxLen, args.Stream, args.MaxLen, args.Approx)
+			}
+		})
+	}
+}
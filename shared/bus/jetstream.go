@@ -0,0 +1,305 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DEFAULT_ACK_WAIT is how long JetStream waits for ack before delivering message again
+const DEFAULT_ACK_WAIT = 30 * time.Second
+
+// JetStreamConfig limits are applied by Subscribe only, publishers use the stream as configured by subscribers
+type JetStreamConfig struct {
+	AckWait time.Duration
+	// MaxMsgs keeps about this many latest messages of topic, not limited if zero
+	MaxMsgs int64
+	// MaxAge keeps messages published within it, not limited if zero
+	MaxAge time.Duration
+}
+
+// JetStream is the bus over NATS JetStream. Topic is subject of its own stream and group is durable pull consumer.
+// Message values are published as JSON object of strings.
+//
+// Streams are created by Subscribe with interest retention, so messages are removed once all groups acked them,
+// like group-safe trimming of Redis streams. Publish only binds to the stream and fails until it is created.
+type JetStream struct {
+	js   jetstream.JetStream
+	conf JetStreamConfig
+	// created are names of streams created by Subscribe, bound are names of streams known to exist
+	created sync.Map
+	bound   sync.Map
+}
+
+func NewJetStream(nc *nats.Conn, conf JetStreamConfig) (*JetStream, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.AckWait == 0 {
+		conf.AckWait = DEFAULT_ACK_WAIT
+	}
+
+	return &JetStream{js: js, conf: conf}, nil
+}
+
+// streamName is name of stream of topic, stream names can not contain dots
+func streamName(topic string) string {
+	return strings.NewReplacer(".", "_", ":", "_", "*", "_", ">", "_", "/", "_", "\\", "_", " ", "_").Replace(topic)
+}
+
+// createStream creates stream of topic or updates its limits, once per topic
+func (j *JetStream) createStream(ctx context.Context, topic string) (string, error) {
+	name := streamName(topic)
+	if _, ok := j.created.Load(name); ok {
+		return name, nil
+	}
+
+	conf := jetstream.StreamConfig{
+		Name:      name,
+		Subjects:  []string{topic},
+		Retention: jetstream.InterestPolicy,
+		MaxAge:    j.conf.MaxAge,
+		MaxMsgs:   -1,
+	}
+	if j.conf.MaxMsgs > 0 {
+		conf.MaxMsgs = j.conf.MaxMsgs
+	}
+
+	if _, err := j.js.CreateOrUpdateStream(ctx, conf); err != nil {
+		return "", fmt.Errorf("stream %s: %w", name, err)
+	}
+
+	j.created.Store(name, struct{}{})
+	j.bound.Store(name, struct{}{})
+	return name, nil
+}
+
+// bindStream checks stream of topic exists, its config is left to subscribers
+func (j *JetStream) bindStream(ctx context.Context, topic string) (string, error) {
+	name := streamName(topic)
+	if _, ok := j.bound.Load(name); ok {
+		return name, nil
+	}
+
+	if _, err := j.js.Stream(ctx, name); err != nil {
+		if errors.Is(err, jetstream.ErrStreamNotFound) {
+			return "", fmt.Errorf("stream %s is not created by subscribers yet: %w", name, err)
+		}
+
+		return "", fmt.Errorf("stream %s: %w", name, err)
+	}
+
+	j.bound.Store(name, struct{}{})
+	return name, nil
+}
+
+func (j *JetStream) Publish(ctx context.Context, topic string, values ...map[string]interface{}) ([]string, error) {
+	if _, err := j.bindStream(ctx, topic); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(values))
+	for _, v := range values {
+		fields := make(map[string]string, len(v))
+		for key, val := range v {
+			fields[key] = fmt.Sprint(val)
+		}
+
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return ids, err
+		}
+
+		ack, err := j.js.Publish(ctx, topic, data)
+		if err != nil {
+			return ids, err
+		}
+
+		ids = append(ids, strconv.FormatUint(ack.Sequence, 10))
+	}
+
+	return ids, nil
+}
+
+// Subscribe binds to durable consumer named after group, consumer name is not used as JetStream balances pulls itself
+func (j *JetStream) Subscribe(ctx context.Context, topic, group, consumer string) (Subscription, error) {
+	name, err := j.createStream(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	cons, err := j.js.CreateOrUpdateConsumer(ctx, name, jetstream.ConsumerConfig{
+		Durable:       group,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       j.conf.AckWait,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("consumer %s: %w", group, err)
+	}
+
+	it, err := cons.Messages()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &jetStreamSubscription{
+		it:      it,
+		msgs:    make(chan Message),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: map[string]jetstream.Msg{},
+	}
+
+	go s.read()
+	return s, nil
+}
+
+// Close does nothing, connection is closed by its owner
+func (j *JetStream) Close() error {
+	return nil
+}
+
+type jetStreamSubscription struct {
+	it   jetstream.MessagesContext
+	msgs chan Message
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+	mu   sync.Mutex
+	// pending are delivered messages by id, they are acked and nacked by JetStream message
+	pending map[string]jetstream.Msg
+	err     error
+}
+
+func (s *jetStreamSubscription) read() {
+	defer close(s.done)
+	defer close(s.msgs)
+	for {
+		msg, err := s.it.Next()
+		if errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+			return
+		}
+
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			return
+		}
+
+		res, err := toMessage(msg)
+		if err != nil {
+			// malformed message would be delivered forever
+			_ = msg.Term()
+			continue
+		}
+
+		s.mu.Lock()
+		s.pending[res.Id] = msg
+		s.mu.Unlock()
+		select {
+		case s.msgs <- res:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func toMessage(msg jetstream.Msg) (Message, error) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return Message{}, err
+	}
+
+	fields := map[string]string{}
+	if err := json.Unmarshal(msg.Data(), &fields); err != nil {
+		return Message{}, err
+	}
+
+	values := make(map[string]interface{}, len(fields))
+	for key, val := range fields {
+		values[key] = val
+	}
+
+	return Message{
+		Id:         strconv.FormatUint(meta.Sequence.Stream, 10),
+		Values:     values,
+		Deliveries: int64(meta.NumDelivered),
+	}, nil
+}
+
+func (s *jetStreamSubscription) Messages() <-chan Message {
+	return s.msgs
+}
+
+func (s *jetStreamSubscription) take(msg Message) (jetstream.Msg, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, ok := s.pending[msg.Id]
+	if !ok {
+		return nil, fmt.Errorf("message %s is not pending", msg.Id)
+	}
+
+	delete(s.pending, msg.Id)
+	return res, nil
+}
+
+func (s *jetStreamSubscription) Ack(ctx context.Context, msgs ...Message) error {
+	for _, msg := range msgs {
+		res, err := s.take(msg)
+		if err != nil {
+			return err
+		}
+
+		if err := res.Ack(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *jetStreamSubscription) Nack(ctx context.Context, msgs ...Message) error {
+	for _, msg := range msgs {
+		res, err := s.take(msg)
+		if err != nil {
+			return err
+		}
+
+		if err := res.Nak(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Claim claims nothing, JetStream delivers messages not acknowledged within AckWait again by itself
+func (s *jetStreamSubscription) Claim(ctx context.Context, minIdle time.Duration) (int, error) {
+	return 0, nil
+}
+
+func (s *jetStreamSubscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *jetStreamSubscription) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+		s.it.Stop()
+	})
+	<-s.done
+	return nil
+}
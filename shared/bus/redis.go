@@ -0,0 +1,290 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_BLOCK is how long a read waits for new messages, closing subscription waits up to it
+	DEFAULT_BLOCK = time.Second
+	// DEFAULT_COUNT is max number of messages read at once
+	DEFAULT_COUNT = 100
+)
+
+type RedisConfig struct {
+	// MaxLen trims topic to about this many entries on publish, not trimmed if zero
+	MaxLen int64
+	Block  time.Duration
+	Count  int64
+}
+
+// Redis is the bus over Redis Streams, topic is stream key and group is consumer group
+type Redis struct {
+	rdb  redis.Cmdable
+	conf RedisConfig
+}
+
+func NewRedis(rdb redis.Cmdable, conf RedisConfig) *Redis {
+	if conf.Block == 0 {
+		conf.Block = DEFAULT_BLOCK
+	}
+
+	if conf.Count == 0 {
+		conf.Count = DEFAULT_COUNT
+	}
+
+	return &Redis{rdb: rdb, conf: conf}
+}
+
+func (r *Redis) Publish(ctx context.Context, topic string, values ...map[string]interface{}) ([]string, error) {
+	cmds := make([]*redis.StringCmd, 0, len(values))
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, v := range values {
+			cmds = append(cmds, pipe.XAdd(ctx, r.addArgs(topic, v)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		ids = append(ids, cmd.Val())
+	}
+
+	return ids, nil
+}
+
+func (r *Redis) addArgs(topic string, values map[string]interface{}) *redis.XAddArgs {
+	args := &redis.XAddArgs{
+		Stream: topic,
+		ID:     "*",
+		Values: values,
+	}
+	if r.conf.MaxLen > 0 {
+		args.MaxLen = r.conf.MaxLen
+		args.Approx = true
+	}
+
+	return args
+}
+
+// Subscribe delivers entries pending for consumer since its previous run first, then new ones
+func (r *Redis) Subscribe(ctx context.Context, topic, group, consumer string) (Subscription, error) {
+	if err := r.rdb.XGroupCreateMkStream(ctx, topic, group, "0").Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+
+	subCtx, cancel := context.WithCancel(context.Background())
+	s := &redisSubscription{
+		rdb:      r.rdb,
+		conf:     r.conf,
+		topic:    topic,
+		group:    group,
+		consumer: consumer,
+		msgs:     make(chan Message),
+		done:     make(chan struct{}),
+		cancel:   cancel,
+	}
+
+	if _, err := s.claim(ctx, consumer, 0); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go s.read(subCtx)
+	return s, nil
+}
+
+// Close does nothing, client is closed by its owner
+func (r *Redis) Close() error {
+	return nil
+}
+
+type redisSubscription struct {
+	rdb      redis.Cmdable
+	conf     RedisConfig
+	topic    string
+	group    string
+	consumer string
+	msgs     chan Message
+	done     chan struct{}
+	cancel   context.CancelFunc
+	once     sync.Once
+	mu       sync.Mutex
+	// queue holds claimed and nacked messages, delivered before new ones
+	queue []Message
+	err   error
+}
+
+func (s *redisSubscription) read(ctx context.Context) {
+	defer close(s.done)
+	defer close(s.msgs)
+	for {
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+		for _, msg := range queue {
+			if !s.send(ctx, msg) {
+				return
+			}
+		}
+
+		res, err := s.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    s.group,
+			Consumer: s.consumer,
+			Streams:  []string{s.topic, ">"},
+			Count:    s.conf.Count,
+			Block:    s.conf.Block,
+		}).Result()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			return
+		}
+
+		for _, stream := range res {
+			for _, msg := range stream.Messages {
+				if !s.send(ctx, Message{Id: msg.ID, Values: msg.Values, Deliveries: 1}) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *redisSubscription) send(ctx context.Context, msg Message) bool {
+	select {
+	case s.msgs <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// claim queues messages pending for owner, any consumer but this one if empty, idle at least minIdle
+func (s *redisSubscription) claim(ctx context.Context, owner string, minIdle time.Duration) (int, error) {
+	claimed := 0
+	start := "-"
+	for {
+		pending, err := s.rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   s.topic,
+			Group:    s.group,
+			Idle:     minIdle,
+			Start:    start,
+			End:      "+",
+			Count:    s.conf.Count,
+			Consumer: owner,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			return claimed, nil
+		}
+
+		if err != nil {
+			return claimed, err
+		}
+
+		ids := make([]string, 0, len(pending))
+		deliveries := make(map[string]int64, len(pending))
+		for _, p := range pending {
+			if p.Consumer != s.consumer || owner != "" {
+				ids = append(ids, p.ID)
+				deliveries[p.ID] = p.RetryCount + 1
+			}
+		}
+
+		n, err := s.claimIds(ctx, minIdle, ids, deliveries)
+		claimed += n
+		if err != nil || int64(len(pending)) < s.conf.Count {
+			return claimed, err
+		}
+
+		start = "(" + pending[len(pending)-1].ID
+	}
+}
+
+// claimIds queues messages with ids in order, delivered as many times as in deliveries.
+// Entries trimmed from the stream are skipped.
+func (s *redisSubscription) claimIds(ctx context.Context, minIdle time.Duration, ids []string, deliveries map[string]int64) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	msgs, err := s.rdb.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   s.topic,
+		Group:    s.group,
+		Consumer: s.consumer,
+		MinIdle:  minIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		s.queue = append(s.queue, Message{Id: msg.ID, Values: msg.Values, Deliveries: deliveries[msg.ID]})
+	}
+
+	return len(msgs), nil
+}
+
+func (s *redisSubscription) Messages() <-chan Message {
+	return s.msgs
+}
+
+func (s *redisSubscription) Ack(ctx context.Context, msgs ...Message) error {
+	ids := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.Id)
+	}
+
+	return s.rdb.XAck(ctx, s.topic, s.group, ids...).Err()
+}
+
+// Nack claims messages again, which resets their idle time, and queues them
+func (s *redisSubscription) Nack(ctx context.Context, msgs ...Message) error {
+	ids := make([]string, 0, len(msgs))
+	deliveries := make(map[string]int64, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.Id)
+		deliveries[msg.Id] = msg.Deliveries + 1
+	}
+
+	_, err := s.claimIds(ctx, 0, ids, deliveries)
+	return err
+}
+
+// Claim takes over messages of other consumers, claimed messages are delivered after the current read
+func (s *redisSubscription) Claim(ctx context.Context, minIdle time.Duration) (int, error) {
+	return s.claim(ctx, "", minIdle)
+}
+
+func (s *redisSubscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *redisSubscription) Close() error {
+	s.once.Do(s.cancel)
+	<-s.done
+	return nil
+}
@@ -0,0 +1,212 @@
+// Package codec converts structs to and from flat string maps, such as redis stream entries and hashes.
+//
+// Fields are named by the struct tag, "gtrs" by default, or snake case of the field name:
+//
+//	Bank     string        `gtrs:"bank,required"`
+//	Interval time.Duration `gtrs:"interval,default=1m"`
+//	Date     time.Time     `gtrs:"date,layout=2006-01-02"`
+//	Note     *string       `gtrs:"note"`
+//
+// Missing and empty values leave fields zero (pointers nil) unless they have a default, missing required fields are errors.
+// Supported are strings, bools, ints, uints, floats, time.Duration, time.Time, encoding.TextUnmarshaler
+// and pointers to them. Options after name are "required", "default=" and "layout=", their values can not contain commas.
+package codec
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DEFAULT_TAG is the struct tag read if Config has none, gtrs consumers read the same tag
+const DEFAULT_TAG = "gtrs"
+
+// DefaultTimeLayouts are tried in order when decoding time, the first one is used to encode it
+var DefaultTimeLayouts = []string{time.RFC3339Nano, time.DateTime, time.DateOnly}
+
+var ErrMissing = errors.New("missing required field")
+
+var (
+	matchFirstCap = regexp.MustCompile("(.)([A-Z][a-z]+)")
+	matchAllCap   = regexp.MustCompile("([a-z0-9])([A-Z])")
+)
+
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// FieldError is an error of a single field, it unwraps to ErrMissing for missing required fields
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e FieldError) Error() string {
+	if errors.Is(e.Err, ErrMissing) {
+		return fmt.Sprintf("%s %s", e.Err, e.Field)
+	}
+
+	return fmt.Sprintf("field %s: %s", e.Field, e.Err)
+}
+
+func (e FieldError) Unwrap() error {
+	return e.Err
+}
+
+type Config struct {
+	// Tag is the struct tag read, DEFAULT_TAG if empty
+	Tag string
+	// TimeLayouts are tried in order when decoding, DefaultTimeLayouts if empty
+	TimeLayouts []string
+	// TimePrecision rounds decoded times, not rounded if zero
+	TimePrecision time.Duration
+	// LaxRequired lets required fields be absent, only present empty values are errors
+	LaxRequired bool
+}
+
+// Codec caches plan of every struct type it converted
+type Codec struct {
+	conf  Config
+	plans sync.Map
+}
+
+func New(conf Config) *Codec {
+	if conf.Tag == "" {
+		conf.Tag = DEFAULT_TAG
+	}
+
+	if len(conf.TimeLayouts) == 0 {
+		conf.TimeLayouts = DefaultTimeLayouts
+	}
+
+	return &Codec{conf: conf}
+}
+
+var std = New(Config{})
+
+// Unmarshal decodes v into dst, a pointer to struct, with the default codec
+func Unmarshal(v map[string]interface{}, dst any) error {
+	return std.Unmarshal(v, dst)
+}
+
+// Marshal encodes src, a struct or a pointer to it, with the default codec
+func Marshal(src any) (map[string]interface{}, error) {
+	return std.Marshal(src)
+}
+
+// Decode returns v decoded into a new T
+func Decode[T any](c *Codec, v map[string]interface{}) (T, error) {
+	var dst T
+	err := c.Unmarshal(v, &dst)
+	return dst, err
+}
+
+func (c *Codec) Unmarshal(v map[string]interface{}, dst any) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("codec: expected pointer to struct, got %T", dst)
+	}
+
+	p, err := c.plan(rv.Elem().Type())
+	if err != nil {
+		return err
+	}
+
+	rv = rv.Elem()
+	for i := range p.fields {
+		f := &p.fields[i]
+		val, present := v[f.name]
+		str, ok := stringValue(val)
+		if !ok {
+			switch {
+			case f.setDefault != nil:
+				f.setDefault(rv.FieldByIndex(f.index))
+			case f.required && (present || !c.conf.LaxRequired):
+				return FieldError{Field: f.goName, Err: ErrMissing}
+			}
+			continue
+		}
+
+		if err := f.decode(rv.FieldByIndex(f.index), str); err != nil {
+			return FieldError{Field: f.goName, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Marshal omits zero fields, as they are decoded back to zero, unless they have a default. Nil pointers are always omitted.
+func (c *Codec) Marshal(src any) (map[string]interface{}, error) {
+	rv := reflect.ValueOf(src)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("codec: expected struct, got %T", src)
+	}
+
+	p, err := c.plan(rv.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	v := make(map[string]interface{}, len(p.fields))
+	for i := range p.fields {
+		f := &p.fields[i]
+		field := rv.FieldByIndex(f.index)
+		if field.IsZero() && (f.setDefault == nil || field.Kind() == reflect.Pointer) {
+			if f.required {
+				return nil, FieldError{Field: f.goName, Err: ErrMissing}
+			}
+			continue
+		}
+
+		str, err := f.encode(field)
+		if err != nil {
+			return nil, FieldError{Field: f.goName, Err: err}
+		}
+
+		v[f.name] = str
+	}
+
+	return v, nil
+}
+
+// stringValue treats empty and not string values as missing
+func stringValue(val interface{}) (string, bool) {
+	switch str := val.(type) {
+	case string:
+		return str, str != ""
+	case []byte:
+		return string(str), len(str) > 0
+	}
+
+	return "", false
+}
+
+func toSnakeCase(str string) string {
+	snake := matchFirstCap.ReplaceAllString(str, "${1}_${2}")
+	snake = matchAllCap.ReplaceAllString(snake, "${1}_${2}")
+	return strings.ToLower(snake)
+}
+
+// parseInt accepts integers only, durations are also parsed as "1m30s"
+func parseInt(t reflect.Type, str string) (int64, error) {
+	if t == durationType {
+		if d, err := time.ParseDuration(str); err == nil {
+			return int64(d), nil
+		}
+	}
+
+	return strconv.ParseInt(str, 10, t.Bits())
+}
@@ -0,0 +1,272 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type Meta struct {
+	Source string `gtrs:"source"`
+}
+
+type sample struct {
+	Meta
+	Name      string        `gtrs:"name,required"`
+	Count     int           `gtrs:"count,default=3"`
+	Small     int8          `gtrs:"small"`
+	Size      uint32        `gtrs:"size"`
+	Ratio     float32       `gtrs:"ratio"`
+	Enabled   bool          `gtrs:"enabled"`
+	Interval  time.Duration `gtrs:"interval,default=1m"`
+	At        time.Time     `gtrs:"at"`
+	Day       time.Time     `gtrs:"day,layout=02.01.2006"`
+	Addr      netip.Addr    `gtrs:"addr"`
+	Note      *string       `gtrs:"note"`
+	Limit     *int          `gtrs:"limit,default=10"`
+	SnakeCase string
+	Skipped   string `gtrs:"-"`
+	private   string
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestUnmarshal(t *testing.T) {
+	type tt struct {
+		i   map[string]interface{}
+		e   sample
+		err error
+	}
+
+	at := time.Date(2024, time.June, 10, 12, 34, 56, 0, time.UTC)
+	ts := []tt{
+		{
+			i: map[string]interface{}{
+				"source": "src", "name": "n", "count": "5", "small": "-8", "size": "42", "ratio": "0.5", "enabled": "true",
+				"interval": "90s", "at": "2024-06-10T12:34:56Z", "day": "10.06.2024", "addr": "10.0.0.1", "note": "hi", "limit": "0",
+				"snake_case": "s", "Skipped": "x", "private": "x",
+			},
+			e: sample{
+				Meta: Meta{Source: "src"}, Name: "n", Count: 5, Small: -8, Size: 42, Ratio: 0.5, Enabled: true,
+				Interval: 90 * time.Second, At: at, Day: time.Date(2024, time.June, 10, 0, 0, 0, 0, time.UTC),
+				Addr: netip.MustParseAddr("10.0.0.1"), Note: ptr("hi"), Limit: ptr(0), SnakeCase: "s",
+			},
+		},
+		{
+			i: map[string]interface{}{"name": "n", "note": "", "interval": "1000", "at": "2024-06-10 12:34:56"},
+			e: sample{Name: "n", Count: 3, Interval: 1000, At: at, Limit: ptr(10)},
+		},
+		{
+			i: map[string]interface{}{"name": []byte("n"), "at": "2024-06-10", "count": 7},
+			e: sample{Name: "n", Count: 3, Interval: time.Minute, At: time.Date(2024, time.June, 10, 0, 0, 0, 0, time.UTC), Limit: ptr(10)},
+		},
+		{i: map[string]interface{}{"count": "1"}, err: ErrMissing},
+		{i: map[string]interface{}{"name": ""}, err: ErrMissing},
+		{i: map[string]interface{}{"name": "n", "count": "many"}, err: FieldError{}},
+		{i: map[string]interface{}{"name": "n", "small": "300"}, err: FieldError{}},
+		{i: map[string]interface{}{"name": "n", "at": "yesterday"}, err: FieldError{}},
+		{i: map[string]interface{}{"name": "n", "addr": "localhost"}, err: FieldError{}},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			res := sample{}
+			err := Unmarshal(test.i, &res)
+			if test.err != nil {
+				if !errors.As(err, &FieldError{}) || (errors.Is(test.err, ErrMissing) && !errors.Is(err, ErrMissing)) {
+					t.Errorf("expected %v, got %v\n", test.err, err)
+				}
+				return
+			}
+
+			if err != nil || !reflect.DeepEqual(res, test.e) {
+				t.Errorf("expected %+v, got %+v %v\n", test.e, res, err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalConfig(t *testing.T) {
+	type message struct {
+		Id string    `json:"id,required"`
+		At time.Time `json:"at"`
+	}
+
+	type tt struct {
+		conf Config
+		i    map[string]interface{}
+		e    message
+		err  bool
+	}
+
+	ts := []tt{
+		{
+			conf: Config{Tag: "json", TimePrecision: time.Millisecond},
+			i:    map[string]interface{}{"id": "1", "at": "2024-06-10T12:34:56.0006Z"},
+			e:    message{Id: "1", At: time.Date(2024, time.June, 10, 12, 34, 56, 1000000, time.UTC)},
+		},
+		{
+			conf: Config{Tag: "json", TimeLayouts: []string{time.Kitchen}},
+			i:    map[string]interface{}{"id": "1", "at": "3:04PM"},
+			e:    message{Id: "1", At: time.Date(0, time.January, 1, 15, 4, 0, 0, time.UTC)},
+		},
+		{conf: Config{Tag: "json"}, i: map[string]interface{}{"at": "2024-06-10T12:34:56Z"}, err: true},
+		{conf: Config{Tag: "json", LaxRequired: true}, i: map[string]interface{}{}, e: message{}},
+		{conf: Config{Tag: "json", LaxRequired: true}, i: map[string]interface{}{"id": ""}, err: true},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			res, err := Decode[message](New(test.conf), test.i)
+			if (err != nil) != test.err || res != test.e {
+				t.Errorf("expected %v %v, got %v %v\n", test.e, test.err, res, err)
+			}
+		})
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	type tt struct {
+		i   any
+		e   map[string]interface{}
+		err bool
+	}
+
+	at := time.Date(2024, time.June, 10, 12, 34, 56, 789, time.UTC)
+	ts := []tt{
+		{
+			i: sample{
+				Meta: Meta{Source: "src"}, Name: "n", Count: 0, Small: -8, Size: 42, Ratio: 0.5, Enabled: true,
+				Interval: 90 * time.Second, At: at, Day: at, Addr: netip.MustParseAddr("10.0.0.1"), Note: ptr("hi"), Limit: ptr(0),
+				SnakeCase: "s", Skipped: "x", private: "x",
+			},
+			e: map[string]interface{}{
+				"source": "src", "name": "n", "count": "0", "small": "-8", "size": "42", "ratio": "0.5", "enabled": "true",
+				"interval": "1m30s", "at": "2024-06-10T12:34:56.000000789Z", "day": "10.06.2024", "addr": "10.0.0.1", "note": "hi", "limit": "0",
+				"snake_case": "s",
+			},
+		},
+		{
+			i: &sample{Name: "n", Note: ptr("")},
+			e: map[string]interface{}{"name": "n", "count": "0", "interval": "0s", "note": ""},
+		},
+		{i: sample{Count: 1}, err: true},
+		{i: "not a struct", err: true},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			res, err := Marshal(test.i)
+			if (err != nil) != test.err || (!test.err && !reflect.DeepEqual(res, test.e)) {
+				t.Errorf("expected %v %v, got %v %v\n", test.e, test.err, res, err)
+			}
+		})
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	i := sample{
+		Meta: Meta{Source: "src"}, Name: "n", Count: 0, Small: -8, Size: 42, Ratio: 0.25, Enabled: true,
+		Interval: 0, At: time.Date(2024, time.June, 10, 12, 34, 56, 789, time.UTC), Day: time.Date(2024, time.June, 10, 0, 0, 0, 0, time.UTC),
+		Addr: netip.MustParseAddr("::1"), Note: ptr("hi"), Limit: ptr(0), SnakeCase: "s",
+	}
+
+	v, err := Marshal(&i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := sample{}
+	if err := Unmarshal(v, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(res, i) {
+		t.Errorf("expected %+v, got %+v\n", i, res)
+	}
+}
+
+func TestPlanErrors(t *testing.T) {
+	type unsupported struct {
+		Values map[string]string
+	}
+
+	type badDefault struct {
+		Count int `gtrs:"count,default=many"`
+	}
+
+	type unknownOption struct {
+		Count int `gtrs:"count,omitempty"`
+	}
+
+	c := New(Config{})
+	for i, dst := range []any{&unsupported{}, &badDefault{}, &unknownOption{}, unsupported{}, nil} {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if err := c.Unmarshal(map[string]interface{}{}, dst); err == nil {
+				t.Errorf("expected error, got %v\n", err)
+			}
+		})
+	}
+}
+
+func TestPlanCache(t *testing.T) {
+	c := New(Config{})
+	first, err := c.plan(reflect.TypeOf(sample{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, _ := c.plan(reflect.TypeOf(sample{}))
+	if first != second {
+		t.Errorf("expected %p, got %p\n", first, second)
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	v := map[string]interface{}{"name": "n", "count": "5", "ratio": "0.5", "at": "2024-06-10T12:34:56Z", "note": "hi"}
+	for i := 0; i < b.N; i += 1 {
+		res := sample{}
+		if err := Unmarshal(v, &res); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	type tt struct {
+		conf     Config
+		field    string
+		e        map[string]interface{}
+		required []string
+	}
+
+	ts := []tt{
+		{field: "name", e: map[string]interface{}{"type": "string", "minLength": 1}, required: []string{"name"}},
+		{field: "small", e: map[string]interface{}{"type": "string", "minLength": 1, "pattern": INT_PATTERN}, required: []string{"name"}},
+		{field: "size", e: map[string]interface{}{"type": "string", "minLength": 1, "pattern": UINT_PATTERN}, required: []string{"name"}},
+		{field: "ratio", e: map[string]interface{}{"type": "string", "minLength": 1, "pattern": FLOAT_PATTERN}, required: []string{"name"}},
+		{field: "at", e: map[string]interface{}{"type": "string", "minLength": 1, "format": "date-time"}, required: []string{"name"}},
+		{field: "day", e: map[string]interface{}{"type": "string", "minLength": 1}, required: []string{"name"}},
+		{field: "limit", e: map[string]interface{}{"type": "string", "minLength": 1, "pattern": INT_PATTERN}, required: []string{"name"}},
+		{conf: Config{LaxRequired: true}, field: "source", e: map[string]interface{}{"type": "string", "minLength": 1}, required: []string{}},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			schema, err := New(test.conf).Schema(&sample{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := schema["properties"].(map[string]interface{})[test.field]
+			if !reflect.DeepEqual(res, test.e) || !reflect.DeepEqual(schema["required"], test.required) {
+				t.Errorf("expected %v %v, got %v %v\n", test.e, test.required, res, schema["required"])
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package codec
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type decodeFunc func(field reflect.Value, str string) error
+
+type encodeFunc func(field reflect.Value) (string, error)
+
+// fieldPlan is how a single struct field is read and written
+type fieldPlan struct {
+	index    []int
+	name     string
+	goName   string
+	required bool
+	typ      reflect.Type
+	layouts  []string
+	// setDefault is nil for fields without default
+	setDefault func(field reflect.Value)
+	decode     decodeFunc
+	encode     encodeFunc
+}
+
+type plan struct {
+	fields []fieldPlan
+}
+
+// planResult caches errors as well, a type that failed once always fails
+type planResult struct {
+	p   *plan
+	err error
+}
+
+func (c *Codec) plan(t reflect.Type) (*plan, error) {
+	if cached, ok := c.plans.Load(t); ok {
+		res := cached.(planResult)
+		return res.p, res.err
+	}
+
+	p := &plan{}
+	err := c.addFields(p, t, nil)
+	if err != nil {
+		p = nil
+	}
+
+	c.plans.Store(t, planResult{p: p, err: err})
+	return p, err
+}
+
+// addFields adds exported fields of t, fields of embedded structs without tag are added as fields of t
+func (c *Codec) addFields(p *plan, t reflect.Type, index []int) error {
+	for i := 0; i < t.NumField(); i += 1 {
+		sf := t.Field(i)
+		tag, hasTag := sf.Tag.Lookup(c.conf.Tag)
+		if !sf.IsExported() || tag == "-" {
+			continue
+		}
+
+		fieldIndex := append(append([]int{}, index...), i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct && !hasTag {
+			if err := c.addFields(p, sf.Type, fieldIndex); err != nil {
+				return err
+			}
+			continue
+		}
+
+		f, err := c.fieldPlan(sf, tag)
+		if err != nil {
+			return fmt.Errorf("codec: field %s of %s: %w", sf.Name, t, err)
+		}
+
+		f.index = fieldIndex
+		p.fields = append(p.fields, f)
+	}
+
+	return nil
+}
+
+func (c *Codec) fieldPlan(sf reflect.StructField, tag string) (fieldPlan, error) {
+	f := fieldPlan{goName: sf.Name}
+	opts := strings.Split(strings.TrimSpace(tag), ",")
+	f.name = opts[0]
+	if f.name == "" {
+		f.name = toSnakeCase(sf.Name)
+	}
+
+	layouts := c.conf.TimeLayouts
+	var def string
+	hasDef := false
+	for _, opt := range opts[1:] {
+		switch {
+		case opt == "required":
+			f.required = true
+		case strings.HasPrefix(opt, "default="):
+			def, hasDef = strings.TrimPrefix(opt, "default="), true
+		case strings.HasPrefix(opt, "layout="):
+			layouts = []string{strings.TrimPrefix(opt, "layout=")}
+		default:
+			return f, fmt.Errorf("unknown option %q", opt)
+		}
+	}
+
+	f.typ, f.layouts = sf.Type, layouts
+	var err error
+	if f.decode, f.encode, err = c.typeCodec(sf.Type, layouts); err != nil {
+		return f, err
+	}
+
+	if hasDef {
+		defVal := reflect.New(sf.Type).Elem()
+		if err := f.decode(defVal, def); err != nil {
+			return f, fmt.Errorf("default %q: %w", def, err)
+		}
+
+		if sf.Type.Kind() == reflect.Pointer {
+			// decoded structs must not share default
+			elem := defVal.Elem()
+			f.setDefault = func(field reflect.Value) {
+				ptr := reflect.New(elem.Type())
+				ptr.Elem().Set(elem)
+				field.Set(ptr)
+			}
+		} else {
+			f.setDefault = func(field reflect.Value) {
+				field.Set(defVal)
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// typeCodec returns functions reading and writing values of t
+func (c *Codec) typeCodec(t reflect.Type, layouts []string) (decodeFunc, encodeFunc, error) {
+	if t.Kind() == reflect.Pointer {
+		decode, encode, err := c.typeCodec(t.Elem(), layouts)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return func(field reflect.Value, str string) error {
+				if field.IsNil() {
+					field.Set(reflect.New(t.Elem()))
+				}
+
+				return decode(field.Elem(), str)
+			}, func(field reflect.Value) (string, error) {
+				return encode(field.Elem())
+			}, nil
+	}
+
+	if t == timeType {
+		return c.timeCodec(layouts)
+	}
+
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return textCodec(t)
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return func(field reflect.Value, str string) error {
+				field.SetString(str)
+				return nil
+			}, func(field reflect.Value) (string, error) {
+				return field.String(), nil
+			}, nil
+	case reflect.Bool:
+		return func(field reflect.Value, str string) error {
+				b, err := strconv.ParseBool(str)
+				field.SetBool(b)
+				return err
+			}, func(field reflect.Value) (string, error) {
+				return strconv.FormatBool(field.Bool()), nil
+			}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(field reflect.Value, str string) error {
+				i, err := parseInt(t, str)
+				field.SetInt(i)
+				return err
+			}, func(field reflect.Value) (string, error) {
+				if t == durationType {
+					return time.Duration(field.Int()).String(), nil
+				}
+
+				return strconv.FormatInt(field.Int(), 10), nil
+			}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return func(field reflect.Value, str string) error {
+				u, err := strconv.ParseUint(str, 10, t.Bits())
+				field.SetUint(u)
+				return err
+			}, func(field reflect.Value) (string, error) {
+				return strconv.FormatUint(field.Uint(), 10), nil
+			}, nil
+	case reflect.Float32, reflect.Float64:
+		return func(field reflect.Value, str string) error {
+				f, err := strconv.ParseFloat(str, t.Bits())
+				field.SetFloat(f)
+				return err
+			}, func(field reflect.Value) (string, error) {
+				return strconv.FormatFloat(field.Float(), 'f', -1, t.Bits()), nil
+			}, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported type %s", t)
+}
+
+// timeCodec tries layouts in order and rounds to TimePrecision, time is encoded in the first layout
+func (c *Codec) timeCodec(layouts []string) (decodeFunc, encodeFunc, error) {
+	return func(field reflect.Value, str string) error {
+			var err error
+			for _, layout := range layouts {
+				var at time.Time
+				if at, err = time.Parse(layout, str); err == nil {
+					if c.conf.TimePrecision > 0 {
+						at = at.Round(c.conf.TimePrecision)
+					}
+
+					field.Set(reflect.ValueOf(at))
+					return nil
+				}
+			}
+
+			return err
+		}, func(field reflect.Value) (string, error) {
+			return field.Interface().(time.Time).Format(layouts[0]), nil
+		}, nil
+}
+
+// textCodec is for types implementing encoding.TextUnmarshaler, encoded with encoding.TextMarshaler if implemented
+func textCodec(t reflect.Type) (decodeFunc, encodeFunc, error) {
+	decode := func(field reflect.Value, str string) error {
+		return field.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(str))
+	}
+
+	if !t.Implements(textMarshalerType) && !reflect.PointerTo(t).Implements(textMarshalerType) {
+		if t.Kind() != reflect.String {
+			return nil, nil, fmt.Errorf("%s implements encoding.TextUnmarshaler but not encoding.TextMarshaler", t)
+		}
+
+		return decode, func(field reflect.Value) (string, error) {
+			return field.String(), nil
+		}, nil
+	}
+
+	return decode, func(field reflect.Value) (string, error) {
+		// field may be not addressable, copy lets pointer receivers marshal it
+		ptr := reflect.New(t)
+		ptr.Elem().Set(field)
+		text, err := ptr.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}, nil
+}
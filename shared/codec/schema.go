@@ -0,0 +1,74 @@
+package codec
+
+import (
+	"reflect"
+	"time"
+)
+
+// JSON_SCHEMA_DRAFT is the JSON Schema dialect of generated schemas
+const JSON_SCHEMA_DRAFT = "https://json-schema.org/draft/2020-12/schema"
+
+// Patterns of values written by the encoder
+const (
+	INT_PATTERN   = `^-?[0-9]+$`
+	UINT_PATTERN  = `^[0-9]+$`
+	FLOAT_PATTERN = `^-?[0-9]+(\.[0-9]+)?$`
+	BOOL_PATTERN  = `^(1|t|T|TRUE|true|True|0|f|F|FALSE|false|False)$`
+)
+
+// Schema returns JSON Schema of maps v is encoded to, an object of string properties.
+// Required fields are required unless LaxRequired, values of all fields have to be non-empty.
+// Unknown properties are allowed, so producers can add fields before consumers read them.
+func (c *Codec) Schema(v any) (map[string]interface{}, error) {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	p, err := c.plan(t)
+	if err != nil {
+		return nil, err
+	}
+
+	properties := map[string]interface{}{}
+	required := []string{}
+	for _, f := range p.fields {
+		properties[f.name] = c.propertySchema(f.typ, f.layouts)
+		if f.required && !c.conf.LaxRequired {
+			required = append(required, f.name)
+		}
+	}
+
+	return map[string]interface{}{
+		"$schema":    JSON_SCHEMA_DRAFT,
+		"title":      t.Name(),
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}, nil
+}
+
+func (c *Codec) propertySchema(t reflect.Type, layouts []string) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	schema := map[string]interface{}{"type": "string", "minLength": 1}
+	switch {
+	case t == timeType:
+		if layouts[0] == time.RFC3339 || layouts[0] == time.RFC3339Nano {
+			schema["format"] = "date-time"
+		}
+	case t == durationType, reflect.PointerTo(t).Implements(textUnmarshalerType):
+	case t.Kind() == reflect.Bool:
+		schema["pattern"] = BOOL_PATTERN
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+		schema["pattern"] = INT_PATTERN
+	case t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uint64:
+		schema["pattern"] = UINT_PATTERN
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		schema["pattern"] = FLOAT_PATTERN
+	}
+
+	return schema
+}
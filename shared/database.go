@@ -5,16 +5,53 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/logging"
 	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/charkpep/usd_rate_api/shared/tracing"
 	"github.com/go-redsync/redsync/v4"
 	"github.com/go-redsync/redsync/v4/redis/goredis/v9"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	// UPDATES_MAX_LEN is approximate number of rate updates kept for subscribers to resume from
+	UPDATES_MAX_LEN = 1000
+	// RATES_NAMESPACE is the key prefix of live rates and their history
+	RATES_NAMESPACE = "rate:usd"
+	// HISTORY_RETENTION is how long bank prices are kept in history before the latest added one
+	HISTORY_RETENTION = 90 * 24 * time.Hour
+)
+
+type RateUpdate struct {
+	Id   string
+	Rate model.BankRate
+	// RequestId is id of the request which produced the update, empty if unknown
+	RequestId string
+	// Trace holds trace context of the update, see tracing.Extract
+	Trace tracing.StreamCarrier
+}
+
+var tracer = otel.Tracer("github.com/charkpep/usd_rate_api/shared")
+
+// startSpan starts span of a database call, named after the method
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "Database."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "redis")),
+	)
+}
+
 type Database struct {
 	db  *redis.Client
 	Mux *redsync.Mutex
+	// ns prefixes keys of rates and their history
+	ns string
 }
 
 func NewDb(rdb *redis.Client) *Database {
@@ -24,11 +61,38 @@ func NewDb(rdb *redis.Client) *Database {
 	return &Database{
 		db:  rdb,
 		Mux: mux,
+		ns:  RATES_NAMESPACE,
+	}
+}
+
+// NewMutex returns lock of name, held for expiry unless extended
+func (db *Database) NewMutex(name string, expiry time.Duration) *redsync.Mutex {
+	return redsync.New(goredis.NewPool(db.db)).NewMutex(name, redsync.WithExpiry(expiry))
+}
+
+// InNamespace returns database keeping rates and their history under ns instead of RATES_NAMESPACE.
+// Subscribers, updates and other data are shared with db.
+func (db *Database) InNamespace(ns string) *Database {
+	return &Database{
+		db:  db.db,
+		Mux: db.Mux,
+		ns:  ns,
 	}
 }
 
+// Namespace is the key prefix of rates and their history
+func (db *Database) Namespace() string {
+	return db.ns
+}
+
+// GetBanks iterates over banks with rates, excluding official ones.
+// It has no span of its own, as scans run while the iterator is used after return.
 func (db *Database) GetBanks(ctx context.Context) (*redis.ScanIterator, error) {
-	res := db.db.Scan(ctx, 0, "bank:*", 0).Iterator()
+	if err := db.backfillBanks(ctx); err != nil {
+		return nil, err
+	}
+
+	res := db.db.SScan(ctx, db.ns+":banks", 0, "*", 0).Iterator()
 	if res.Err() != nil {
 		return nil, res.Err()
 	}
@@ -36,7 +100,46 @@ func (db *Database) GetBanks(ctx context.Context) (*redis.ScanIterator, error) {
 	return res, nil
 }
 
+// backfillBanks lists banks of rates stored before banks were kept in sets, it does nothing once any bank is listed
+func (db *Database) backfillBanks(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "backfillBanks")
+	defer span.End()
+	listed, err := db.db.Exists(ctx, db.ns+":banks", db.ns+":banks:official").Result()
+	if err != nil || listed != 0 {
+		return err
+	}
+
+	prefix := db.ns + ":"
+	iter := db.db.ScanType(ctx, 0, prefix+"*", 0, "string").Iterator()
+	for iter.Next(ctx) {
+		bank := strings.TrimPrefix(iter.Val(), prefix)
+		// other keys of the namespace, e.g. trace, history or dedup ones, have a further prefix
+		if strings.Contains(bank, ":") {
+			continue
+		}
+
+		price, err := db.GetBankPrice(ctx, bank)
+		if err != nil || price == nil || price.Bank != bank {
+			// not a rate, e.g. a lock
+			continue
+		}
+
+		list := db.ns + ":banks"
+		if price.Official {
+			list = db.ns + ":banks:official"
+		}
+
+		if err := db.db.SAdd(ctx, list, bank).Err(); err != nil {
+			return err
+		}
+	}
+
+	return iter.Err()
+}
+
 func (db *Database) AddSubscriber(ctx context.Context, email string, bank string) (bool, error) {
+	ctx, span := startSpan(ctx, "AddSubscriber")
+	defer span.End()
 	res, err := db.db.SAdd(ctx, "rate:usd:subscribers", fmt.Sprintf("%s:%s", email, bank)).Result()
 	if err != nil {
 		return false, err
@@ -50,7 +153,9 @@ func (db *Database) AddSubscriber(ctx context.Context, email string, bank string
 }
 
 func (db *Database) GetBankPrice(ctx context.Context, bank string) (*model.BankRate, error) {
-	priceRaw, err := db.db.Get(ctx, fmt.Sprintf("rate:usd:%s", bank)).Result()
+	ctx, span := startSpan(ctx, "GetBankPrice")
+	defer span.End()
+	priceRaw, err := db.db.Get(ctx, fmt.Sprintf("%s:%s", db.ns, bank)).Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			return nil, nil
@@ -67,20 +172,208 @@ func (db *Database) GetBankPrice(ctx context.Context, bank string) (*model.BankR
 	return &price, nil
 }
 
+// SetBankPrice stores the current bank price along with trace context of ctx,
+// so later readers, e.g. mailer, can continue the trace. Official rates are not listed by GetBanks.
 func (db *Database) SetBankPrice(ctx context.Context, price *model.BankRate) error {
+	carrier := make(tracing.StreamCarrier)
+	tracing.Inject(ctx, carrier)
+	ctx, span := startSpan(ctx, "SetBankPrice")
+	defer span.End()
 	priceBuff, err := json.Marshal(price)
 	if err != nil {
 		return err
 	}
 
-	if err := db.db.Set(ctx, fmt.Sprintf("rate:usd:%s", price.Bank), string(priceBuff), 0).Err(); err != nil {
+	if err := db.db.Set(ctx, fmt.Sprintf("%s:%s", db.ns, price.Bank), string(priceBuff), 0).Err(); err != nil {
+		return err
+	}
+
+	// official rates are listed apart from banks, so they are not compared with exchange offers
+	list, other := db.ns+":banks", db.ns+":banks:official"
+	if price.Official {
+		list, other = other, list
+	}
+
+	if err := db.db.SAdd(ctx, list, price.Bank).Err(); err != nil {
+		return err
+	}
+
+	if err := db.db.SRem(ctx, other, price.Bank).Err(); err != nil {
 		return err
 	}
 
-	return nil
+	if len(carrier) == 0 {
+		return db.db.Del(ctx, fmt.Sprintf("%s:trace:%s", db.ns, price.Bank)).Err()
+	}
+
+	return db.db.HSet(ctx, fmt.Sprintf("%s:trace:%s", db.ns, price.Bank), map[string]interface{}(carrier)).Err()
+}
+
+// GetBankPriceTrace returns ctx with trace context the current bank price was set with, ctx as is if there is none
+func (db *Database) GetBankPriceTrace(ctx context.Context, bank string) (context.Context, error) {
+	res, err := db.db.HGetAll(ctx, fmt.Sprintf("%s:trace:%s", db.ns, bank)).Result()
+	if err != nil {
+		return ctx, err
+	}
+
+	carrier := make(tracing.StreamCarrier, len(res))
+	for key, val := range res {
+		carrier[key] = val
+	}
+
+	return tracing.Extract(ctx, carrier), nil
+}
+
+// GetBankPrices returns current rates of all known banks
+func (db *Database) GetBankPrices(ctx context.Context) ([]model.BankRate, error) {
+	ctx, span := startSpan(ctx, "GetBankPrices")
+	defer span.End()
+	iter, err := db.GetBanks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	prices := make([]model.BankRate, 0)
+	for iter.Next(ctx) {
+		price, err := db.GetBankPrice(ctx, iter.Val())
+		if err != nil {
+			return nil, err
+		}
+
+		if price == nil {
+			continue
+		}
+
+		prices = append(prices, *price)
+	}
+
+	if iter.Err() != nil {
+		return nil, iter.Err()
+	}
+
+	return prices, nil
+}
+
+// AddBankPriceHistory stores price in bank history, scored by update time.
+// Prices older than HISTORY_RETENTION before price are removed.
+func (db *Database) AddBankPriceHistory(ctx context.Context, price *model.BankRate) error {
+	ctx, span := startSpan(ctx, "AddBankPriceHistory")
+	defer span.End()
+	priceBuff, err := json.Marshal(price)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s:history:%s", db.ns, price.Bank)
+	_, err = db.db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, redis.Z{
+			Score:  float64(price.LastUpdated.UnixMilli()),
+			Member: string(priceBuff),
+		})
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(price.LastUpdated.Add(-HISTORY_RETENTION).UnixMilli(), 10))
+		return nil
+	})
+
+	return err
+}
+
+// GetBankPriceHistory returns bank prices updated in [from, to], ordered by update time
+func (db *Database) GetBankPriceHistory(ctx context.Context, bank string, from, to time.Time) ([]model.BankRate, error) {
+	ctx, span := startSpan(ctx, "GetBankPriceHistory")
+	defer span.End()
+	res, err := db.db.ZRangeByScore(ctx, fmt.Sprintf("%s:history:%s", db.ns, bank), &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.UnixMilli(), 10),
+		Max: strconv.FormatInt(to.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	prices := make([]model.BankRate, 0, len(res))
+	for _, priceRaw := range res {
+		price := model.BankRate{}
+		if err := json.Unmarshal([]byte(priceRaw), &price); err != nil {
+			return nil, err
+		}
+
+		prices = append(prices, price)
+	}
+
+	return prices, nil
+}
+
+// GetBankPriceAt returns the latest bank price updated not later than at, nil if there is none
+func (db *Database) GetBankPriceAt(ctx context.Context, bank string, at time.Time) (*model.BankRate, error) {
+	ctx, span := startSpan(ctx, "GetBankPriceAt")
+	defer span.End()
+	res, err := db.db.ZRevRangeByScore(ctx, fmt.Sprintf("%s:history:%s", db.ns, bank), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(at.UnixMilli(), 10),
+		Count: 1,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) == 0 {
+		return nil, nil
+	}
+
+	price := model.BankRate{}
+	if err := json.Unmarshal([]byte(res[0]), &price); err != nil {
+		return nil, err
+	}
+
+	return &price, nil
+}
+
+// CountBankPriceHistory returns number of bank prices in bank history
+func (db *Database) CountBankPriceHistory(ctx context.Context, bank string) (int64, error) {
+	ctx, span := startSpan(ctx, "CountBankPriceHistory")
+	defer span.End()
+	return db.db.ZCard(ctx, fmt.Sprintf("%s:history:%s", db.ns, bank)).Result()
+}
+
+// DeleteBankPrices deletes rates, their trace and history of all known banks, returns number of banks deleted
+func (db *Database) DeleteBankPrices(ctx context.Context) (int, error) {
+	ctx, span := startSpan(ctx, "DeleteBankPrices")
+	defer span.End()
+	banks, err := db.db.SUnion(ctx, db.ns+":banks", db.ns+":banks:official").Result()
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make([]string, 0, 3*len(banks)+2)
+	for _, bank := range banks {
+		keys = append(keys, fmt.Sprintf("%s:%s", db.ns, bank), fmt.Sprintf("%s:trace:%s", db.ns, bank), fmt.Sprintf("%s:history:%s", db.ns, bank))
+	}
+
+	keys = append(keys, db.ns+":banks", db.ns+":banks:official")
+	if err := db.db.Del(ctx, keys...).Err(); err != nil {
+		return 0, err
+	}
+
+	return len(banks), nil
+}
+
+// IsProcessed returns whether message with hash was marked processed within its ttl
+func (db *Database) IsProcessed(ctx context.Context, hash string) (bool, error) {
+	ctx, span := startSpan(ctx, "IsProcessed")
+	defer span.End()
+	n, err := db.db.Exists(ctx, fmt.Sprintf("%s:processed:%s", db.ns, hash)).Result()
+	return n > 0, err
+}
+
+// MarkProcessed remembers message hash for ttl, it should be called only once the message is processed
+func (db *Database) MarkProcessed(ctx context.Context, hash string, ttl time.Duration) error {
+	ctx, span := startSpan(ctx, "MarkProcessed")
+	defer span.End()
+	return db.db.Set(ctx, fmt.Sprintf("%s:processed:%s", db.ns, hash), 1, ttl).Err()
 }
 
 func (db *Database) GetSubscriberMails(ctx context.Context) (*redis.ScanIterator, error) {
+	ctx, span := startSpan(ctx, "GetSubscriberMails")
+	defer span.End()
 	res := db.db.SScan(ctx, "rate:usd:subscribers", 0, "*:*", 0).Iterator()
 	if res.Err() != nil {
 		return nil, res.Err()
@@ -88,3 +381,120 @@ func (db *Database) GetSubscriberMails(ctx context.Context) (*redis.ScanIterator
 
 	return res, nil
 }
+
+// PublishBankPrice notifies subscribers about the new bank price, returns update id.
+// Request id of ctx is published along, so the update can be traced to its origin.
+func (db *Database) PublishBankPrice(ctx context.Context, price *model.BankRate) (string, error) {
+	ctx, span := startSpan(ctx, "PublishBankPrice")
+	defer span.End()
+	priceBuff, err := json.Marshal(price)
+	if err != nil {
+		return "", err
+	}
+
+	values := map[string]interface{}{
+		"rate": string(priceBuff),
+	}
+	if id := logging.RequestId(ctx); id != "" {
+		values["request_id"] = id
+	}
+
+	tracing.Inject(ctx, values)
+
+	return db.db.XAdd(ctx, &redis.XAddArgs{
+		Stream: "rate:usd:updates",
+		MaxLen: UPDATES_MAX_LEN,
+		Approx: true,
+		ID:     "*",
+		Values: values,
+	}).Result()
+}
+
+// LastBankPriceUpdateId returns id of the latest published update, "0-0" if there were none
+func (db *Database) LastBankPriceUpdateId(ctx context.Context) (string, error) {
+	ctx, span := startSpan(ctx, "LastBankPriceUpdateId")
+	defer span.End()
+	res, err := db.db.XRevRangeN(ctx, "rate:usd:updates", "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+
+	if len(res) == 0 {
+		return "0-0", nil
+	}
+
+	return res[0].ID, nil
+}
+
+// ReadBankPriceUpdates returns updates published after lastId, waiting up to block for new ones.
+// Returns no updates if none were published in time.
+func (db *Database) ReadBankPriceUpdates(ctx context.Context, lastId string, block time.Duration) ([]RateUpdate, error) {
+	res, err := db.db.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{"rate:usd:updates", lastId},
+		Block:   block,
+	}).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	updates := make([]RateUpdate, 0)
+	for _, stream := range res {
+		for _, msg := range stream.Messages {
+			update, err := parseRateUpdate(msg)
+			if err != nil {
+				return nil, err
+			}
+
+			updates = append(updates, update)
+		}
+	}
+
+	return updates, nil
+}
+
+// GetBankPriceUpdates returns updates published after afterId up to toId inclusive, e.g. to resume reading
+func (db *Database) GetBankPriceUpdates(ctx context.Context, afterId, toId string) ([]RateUpdate, error) {
+	ctx, span := startSpan(ctx, "GetBankPriceUpdates")
+	defer span.End()
+	res, err := db.db.XRange(ctx, "rate:usd:updates", "("+afterId, toId).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make([]RateUpdate, 0, len(res))
+	for _, msg := range res {
+		update, err := parseRateUpdate(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		updates = append(updates, update)
+	}
+
+	return updates, nil
+}
+
+func parseRateUpdate(msg redis.XMessage) (RateUpdate, error) {
+	update := RateUpdate{Id: msg.ID}
+	update.RequestId, _ = msg.Values["request_id"].(string)
+	update.Trace = make(tracing.StreamCarrier)
+	for _, key := range otel.GetTextMapPropagator().Fields() {
+		if val, ok := msg.Values[key]; ok {
+			update.Trace[key] = val
+		}
+	}
+	priceRaw, ok := msg.Values["rate"].(string)
+	if !ok {
+		return update, fmt.Errorf("update %s has no rate", msg.ID)
+	}
+
+	if err := json.Unmarshal([]byte(priceRaw), &update.Rate); err != nil {
+		return update, err
+	}
+
+	return update, nil
+}
@@ -0,0 +1,190 @@
+package health
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CHECK_TIMEOUT bounds all readiness checks together
+const CHECK_TIMEOUT = 2 * time.Second
+
+type Check func(ctx context.Context) error
+
+type Checker struct {
+	mu       sync.Mutex
+	names    []string
+	checks   map[string]Check
+	draining atomic.Bool
+}
+
+type Status struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func NewChecker() *Checker {
+	return &Checker{
+		checks: make(map[string]Check),
+	}
+}
+
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+
+	c.checks[name] = check
+}
+
+// SetDraining makes service not ready, so no new work is routed while it shuts down
+func (c *Checker) SetDraining() {
+	c.draining.Store(true)
+}
+
+// Register adds GET /healthz and GET /readyz to mux
+func (c *Checker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", c.HandleHealthz)
+	mux.HandleFunc("GET /readyz", c.HandleReadyz)
+}
+
+// HandleHealthz reports that process is alive
+func (c *Checker) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Status{Status: "ok"})
+}
+
+// HandleReadyz runs all checks and responds with 503 if any of them fails
+func (c *Checker) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), CHECK_TIMEOUT)
+	defer cancel()
+	status := c.Run(ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+// Run executes checks concurrently
+func (c *Checker) Run(ctx context.Context) Status {
+	c.mu.Lock()
+	names := append([]string(nil), c.names...)
+	checks := make([]Check, 0, len(names))
+	for _, name := range names {
+		checks = append(checks, c.checks[name])
+	}
+	c.mu.Unlock()
+
+	results := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = check(ctx)
+		}(i, check)
+	}
+
+	wg.Wait()
+	status := Status{
+		Status: "ok",
+		Checks: make(map[string]string, len(names)),
+	}
+
+	if c.draining.Load() {
+		status.Status = "draining"
+	}
+
+	for i, name := range names {
+		if results[i] != nil {
+			status.Checks[name] = results[i].Error()
+			status.Status = "failing"
+			continue
+		}
+
+		status.Checks[name] = "ok"
+	}
+
+	return status
+}
+
+func RedisCheck(rdb *redis.Client) Check {
+	return func(ctx context.Context) error {
+		return rdb.Ping(ctx).Err()
+	}
+}
+
+// StreamLagCheck fails if group has more than maxLag entries not yet delivered
+func StreamLagCheck(rdb *redis.Client, stream, group string, maxLag int64) Check {
+	return func(ctx context.Context) error {
+		groups, err := rdb.XInfoGroups(ctx, stream).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, g := range groups {
+			if g.Name != group {
+				continue
+			}
+
+			if g.Lag > maxLag {
+				return fmt.Errorf("group %s lag %d exceeds %d", group, g.Lag, maxLag)
+			}
+
+			return nil
+		}
+
+		return fmt.Errorf("group %s not found", group)
+	}
+}
+
+// SmtpCheck connects to the server and expects its greeting
+func SmtpCheck(addr string) Check {
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(line, "220") {
+			return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+		}
+
+		conn.Write([]byte("QUIT\r\n"))
+		return nil
+	}
+}
+
+// NewAdminServer returns server for worker services exposing mux on a separate port
+func NewAdminServer(addr string, mux *http.ServeMux) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+	}
+}
@@ -0,0 +1,108 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	type tt struct {
+		checks   map[string]Check
+		draining bool
+		status   int
+		e        Status
+	}
+
+	ok := func(ctx context.Context) error { return nil }
+	failing := func(ctx context.Context) error { return errors.New("unreachable") }
+	ts := []tt{
+		{
+			checks: map[string]Check{"redis": ok},
+			status: http.StatusOK,
+			e:      Status{Status: "ok", Checks: map[string]string{"redis": "ok"}},
+		},
+		{
+			checks: map[string]Check{"redis": ok, "smtp": failing},
+			status: http.StatusServiceUnavailable,
+			e:      Status{Status: "failing", Checks: map[string]string{"redis": "ok", "smtp": "unreachable"}},
+		},
+		{
+			checks:   map[string]Check{"redis": ok},
+			draining: true,
+			status:   http.StatusServiceUnavailable,
+			e:        Status{Status: "draining", Checks: map[string]string{"redis": "ok"}},
+		},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			c := NewChecker()
+			for name, check := range test.checks {
+				c.Add(name, check)
+			}
+
+			if test.draining {
+				c.SetDraining()
+			}
+
+			res := httptest.NewRecorder()
+			c.HandleReadyz(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if res.Code != test.status {
+				t.Errorf("expected status %d, got %d\n", test.status, res.Code)
+			}
+
+			status := Status{}
+			if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+
+			if fmt.Sprint(status) != fmt.Sprint(test.e) {
+				t.Errorf("expected %#v, got %#v\n", test.e, status)
+			}
+		})
+	}
+}
+
+func TestSmtpCheck(t *testing.T) {
+	type tt struct {
+		greeting string
+		fails    bool
+	}
+
+	ts := []tt{
+		{greeting: "220 smtp.example.com ESMTP\r\n", fails: false},
+		{greeting: "554 no service\r\n", fails: true},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer l.Close()
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+
+				defer conn.Close()
+				conn.Write([]byte(test.greeting))
+				conn.Read(make([]byte, 16))
+			}()
+
+			err = SmtpCheck(l.Addr().String())(context.Background())
+			if (err != nil) != test.fails {
+				t.Errorf("expected failure %v, got %v\n", test.fails, err)
+			}
+		})
+	}
+}
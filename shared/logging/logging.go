@@ -0,0 +1,121 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// REDACTED replaces values of secret attributes
+const REDACTED = "[REDACTED]"
+
+var emailPattern = regexp.MustCompile(`([A-Za-z0-9._%+\-])[A-Za-z0-9._%+\-]*@([A-Za-z0-9.\-]+\.[A-Za-z]{2,})`)
+
+// secretKeys are attribute keys which values are never logged, matched case insensitively by suffix
+var secretKeys = []string{"password", "pass", "secret", "token", "authorization", "api_key", "apikey"}
+
+type requestIdKey struct{}
+
+// New returns JSON logger of the service writing to stdout, level is read from LOG_LEVEL
+func New(service string) *slog.Logger {
+	return slog.New(NewHandler(os.Stdout, ParseLevel(os.Getenv("LOG_LEVEL")))).With("service", service)
+}
+
+// NewHandler returns JSON handler which redacts secrets and emails and adds request and trace ids from context
+func NewHandler(w io.Writer, level slog.Level) slog.Handler {
+	return contextHandler{
+		Handler: slog.NewJSONHandler(w, &slog.HandlerOptions{
+			Level:       level,
+			ReplaceAttr: Redact,
+		}),
+	}
+}
+
+// ParseLevel returns info level for empty or unknown level
+func ParseLevel(level string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo
+	}
+
+	return l
+}
+
+// Redact is the central redaction policy: values of secret keys are dropped, emails in strings and errors are masked
+func Redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, secret := range secretKeys {
+		if strings.HasSuffix(key, secret) {
+			return slog.String(a.Key, REDACTED)
+		}
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, MaskEmails(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, MaskEmails(err.Error()))
+		}
+	}
+
+	return a
+}
+
+// MaskEmails keeps only the first letter of local part, e.g. "j***@gmail.com"
+func MaskEmails(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+
+	return emailPattern.ReplaceAllString(s, "$1***@$2")
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestId(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestId returns empty string if context carries none
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+func NewRequestId() string {
+	buff := make([]byte, 16)
+	if _, err := rand.Read(buff); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(buff)
+}
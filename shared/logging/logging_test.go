@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestMaskEmails(t *testing.T) {
+	type tt struct {
+		i string
+		e string
+	}
+
+	ts := []tt{
+		{i: "john.doe@gmail.com", e: "j***@gmail.com"},
+		{i: "send to a@b.co in 1s", e: "send to a***@b.co in 1s"},
+		{i: "john.doe@gmail.com:Приватбанк", e: "j***@gmail.com:Приватбанк"},
+		{i: "no emails here", e: "no emails here"},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if res := MaskEmails(test.i); res != test.e {
+				t.Errorf("expected %q, got %q\n", test.e, res)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var buff bytes.Buffer
+	logger := slog.New(NewHandler(&buff, slog.LevelInfo))
+	ctx := WithRequestId(context.Background(), "req-1")
+	logger.InfoContext(ctx, "subscribed",
+		"email", "john.doe@gmail.com",
+		"smtp_pass", "hunter2",
+		"err", errors.New("mail to john.doe@gmail.com failed"),
+	)
+	logger.Debug("not logged")
+
+	out := buff.String()
+	for _, e := range []string{`"request_id":"req-1"`, `"email":"j***@gmail.com"`, `"smtp_pass":"[REDACTED]"`, `"err":"mail to j***@gmail.com failed"`} {
+		if !strings.Contains(out, e) {
+			t.Errorf("expected %s in %s\n", e, out)
+		}
+	}
+
+	if strings.Contains(out, "hunter2") || strings.Contains(out, "john.doe") || strings.Contains(out, "not logged") {
+		t.Errorf("unexpected output %s\n", out)
+	}
+}
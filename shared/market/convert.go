@@ -0,0 +1,107 @@
+package market
+
+import (
+	"errors"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"time"
+)
+
+const (
+	UAH = "UAH"
+	USD = "USD"
+
+	CASH   = "cash"
+	ONLINE = "online"
+)
+
+var (
+	ErrUnsupported = errors.New("conversion is not supported")
+	ErrNotQuoted   = errors.New("rate is not quoted")
+)
+
+type Conversion struct {
+	Amount  float64 `json:"amount"`
+	From    string  `json:"from"`
+	To      string  `json:"to"`
+	Result  float64 `json:"result"`
+	Bank    string  `json:"bank"`
+	Channel string  `json:"channel"`
+	// bank rate used, UAH per USD
+	Rate          float64   `json:"rate"`
+	RateUpdatedAt time.Time `json:"rate_updated_at"`
+}
+
+// Convert exchanges amount with the bank: UAH to USD at the bank sell rate, USD to UAH at the bank buy rate
+func Convert(rate model.BankRate, amount float64, from, to, channel string) (Conversion, error) {
+	c := Conversion{
+		Amount:        amount,
+		From:          from,
+		To:            to,
+		Bank:          rate.Bank,
+		Channel:       channel,
+		RateUpdatedAt: rate.LastUpdated,
+	}
+
+	if channel != CASH && channel != ONLINE {
+		return c, ErrUnsupported
+	}
+
+	switch {
+	case from == UAH && to == USD:
+		c.Rate = rate.Sell
+		if channel == ONLINE {
+			c.Rate = rate.SellOnline
+		}
+
+		if c.Rate <= 0 {
+			return c, ErrNotQuoted
+		}
+
+		c.Result = amount / c.Rate
+	case from == USD && to == UAH:
+		c.Rate = rate.Buy
+		if channel == ONLINE {
+			c.Rate = rate.BuyOnline
+		}
+
+		if c.Rate <= 0 {
+			return c, ErrNotQuoted
+		}
+
+		c.Result = amount * c.Rate
+	default:
+		return c, ErrUnsupported
+	}
+
+	return c, nil
+}
+
+// BestConversion returns conversion with the biggest result among banks, ErrNotQuoted if none of them quotes it
+func BestConversion(rates []model.BankRate, amount float64, from, to, channel string) (Conversion, error) {
+	var (
+		best  Conversion
+		found bool
+	)
+
+	for _, rate := range rates {
+		c, err := Convert(rate, amount, from, to, channel)
+		if err != nil {
+			if errors.Is(err, ErrNotQuoted) {
+				continue
+			}
+
+			return c, err
+		}
+
+		if !found || c.Result > best.Result {
+			best = c
+			found = true
+		}
+	}
+
+	if !found {
+		return best, ErrNotQuoted
+	}
+
+	return best, nil
+}
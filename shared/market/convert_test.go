@@ -0,0 +1,61 @@
+package market
+
+import (
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	type tt struct {
+		amount   float64
+		from, to string
+		channel  string
+		e        float64
+		err      error
+	}
+
+	rate := model.BankRate{Bank: "bank", Buy: 40, Sell: 50, BuyOnline: 41, SellOnline: 0}
+	ts := []tt{
+		{amount: 1000, from: UAH, to: USD, channel: CASH, e: 20},
+		{amount: 10, from: USD, to: UAH, channel: CASH, e: 400},
+		{amount: 10, from: USD, to: UAH, channel: ONLINE, e: 410},
+		{amount: 1000, from: UAH, to: USD, channel: ONLINE, err: ErrNotQuoted},
+		{amount: 1000, from: UAH, to: "EUR", channel: CASH, err: ErrUnsupported},
+		{amount: 1000, from: UAH, to: USD, channel: "card", err: ErrUnsupported},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			c, err := Convert(rate, test.amount, test.from, test.to, test.channel)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v\n", test.err, err)
+			}
+
+			if err == nil && c.Result != test.e {
+				t.Errorf("expected %v, got %v\n", test.e, c.Result)
+			}
+		})
+	}
+}
+
+func TestBestConversion(t *testing.T) {
+	rates := []model.BankRate{
+		{Bank: "a", Buy: 40, Sell: 50},
+		{Bank: "b", Buy: 41, Sell: 0},
+		{Bank: "c", Buy: 39, Sell: 40},
+	}
+
+	if c, err := BestConversion(rates, 1000, UAH, USD, CASH); err != nil || c.Bank != "c" {
+		t.Errorf("expected bank c, got %#v, %v\n", c, err)
+	}
+
+	if c, err := BestConversion(rates, 10, USD, UAH, CASH); err != nil || c.Bank != "b" {
+		t.Errorf("expected bank b, got %#v, %v\n", c, err)
+	}
+
+	if _, err := BestConversion(rates, 10, USD, UAH, ONLINE); !errors.Is(err, ErrNotQuoted) {
+		t.Errorf("expected %v, got %v\n", ErrNotQuoted, err)
+	}
+}
@@ -0,0 +1,136 @@
+package market
+
+import (
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"slices"
+	"time"
+)
+
+// Best holds banks with the highest buy and the lowest sell rates, nil if none of the banks quotes the rate
+type Best struct {
+	Buy        *model.BankRate `json:"buy"`
+	Sell       *model.BankRate `json:"sell"`
+	BuyOnline  *model.BankRate `json:"buy_online"`
+	SellOnline *model.BankRate `json:"sell_online"`
+}
+
+type Stats struct {
+	Count  int     `json:"count"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Median float64 `json:"median"`
+	Mean   float64 `json:"mean"`
+}
+
+type Summary struct {
+	Banks      int   `json:"banks"`
+	Buy        Stats `json:"buy"`
+	Sell       Stats `json:"sell"`
+	BuyOnline  Stats `json:"buy_online"`
+	SellOnline Stats `json:"sell_online"`
+	// difference between sell and buy of the same bank
+	Spread       Stats `json:"spread"`
+	SpreadOnline Stats `json:"spread_online"`
+}
+
+// Fresh returns rates updated not earlier than maxAge before now
+func Fresh(rates []model.BankRate, now time.Time, maxAge time.Duration) []model.BankRate {
+	fresh := make([]model.BankRate, 0, len(rates))
+	for _, rate := range rates {
+		if now.Sub(rate.LastUpdated) <= maxAge {
+			fresh = append(fresh, rate)
+		}
+	}
+
+	return fresh
+}
+
+// FindBest ignores not quoted (zero) rates
+func FindBest(rates []model.BankRate) Best {
+	b := Best{}
+	for i := range rates {
+		rate := &rates[i]
+		if rate.Buy > 0 && (b.Buy == nil || rate.Buy > b.Buy.Buy) {
+			b.Buy = rate
+		}
+
+		if rate.Sell > 0 && (b.Sell == nil || rate.Sell < b.Sell.Sell) {
+			b.Sell = rate
+		}
+
+		if rate.BuyOnline > 0 && (b.BuyOnline == nil || rate.BuyOnline > b.BuyOnline.BuyOnline) {
+			b.BuyOnline = rate
+		}
+
+		if rate.SellOnline > 0 && (b.SellOnline == nil || rate.SellOnline < b.SellOnline.SellOnline) {
+			b.SellOnline = rate
+		}
+	}
+
+	return b
+}
+
+// Summarize ignores not quoted (zero) rates
+func Summarize(rates []model.BankRate) Summary {
+	var buy, sell, buyOnline, sellOnline, spread, spreadOnline []float64
+	for _, rate := range rates {
+		buy = appendQuoted(buy, rate.Buy)
+		sell = appendQuoted(sell, rate.Sell)
+		buyOnline = appendQuoted(buyOnline, rate.BuyOnline)
+		sellOnline = appendQuoted(sellOnline, rate.SellOnline)
+		if rate.Buy > 0 && rate.Sell > 0 {
+			spread = append(spread, rate.Sell-rate.Buy)
+		}
+
+		if rate.BuyOnline > 0 && rate.SellOnline > 0 {
+			spreadOnline = append(spreadOnline, rate.SellOnline-rate.BuyOnline)
+		}
+	}
+
+	return Summary{
+		Banks:        len(rates),
+		Buy:          NewStats(buy),
+		Sell:         NewStats(sell),
+		BuyOnline:    NewStats(buyOnline),
+		SellOnline:   NewStats(sellOnline),
+		Spread:       NewStats(spread),
+		SpreadOnline: NewStats(spreadOnline),
+	}
+}
+
+func appendQuoted(values []float64, v float64) []float64 {
+	if v > 0 {
+		return append(values, v)
+	}
+
+	return values
+}
+
+// NewStats returns zero Stats for no values
+func NewStats(values []float64) Stats {
+	if len(values) == 0 {
+		return Stats{}
+	}
+
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	s := Stats{
+		Count: len(sorted),
+		Min:   sorted[0],
+		Max:   sorted[len(sorted)-1],
+	}
+
+	if len(sorted)%2 == 0 {
+		s.Median = (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	} else {
+		s.Median = sorted[len(sorted)/2]
+	}
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+
+	s.Mean = sum / float64(len(sorted))
+	return s
+}
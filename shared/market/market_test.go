@@ -0,0 +1,78 @@
+package market
+
+import (
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"testing"
+	"time"
+)
+
+func TestFindBest(t *testing.T) {
+	rates := []model.BankRate{
+		{Bank: "a", Buy: 41.0, Sell: 41.6, BuyOnline: 41.1, SellOnline: 41.5},
+		{Bank: "b", Buy: 41.2, Sell: 0, BuyOnline: 0, SellOnline: 41.45},
+		{Bank: "c", Buy: 40.9, Sell: 41.4, BuyOnline: 41.3, SellOnline: 0},
+	}
+
+	b := FindBest(rates)
+	if b.Buy.Bank != "b" || b.Sell.Bank != "c" || b.BuyOnline.Bank != "c" || b.SellOnline.Bank != "b" {
+		t.Errorf("unexpected best %#v\n", b)
+	}
+
+	if b = FindBest(nil); b.Buy != nil || b.Sell != nil || b.BuyOnline != nil || b.SellOnline != nil {
+		t.Errorf("expected no best rates, got %#v\n", b)
+	}
+}
+
+func TestNewStats(t *testing.T) {
+	type tt struct {
+		i []float64
+		e Stats
+	}
+
+	ts := []tt{
+		{
+			i: nil,
+			e: Stats{},
+		},
+		{
+			i: []float64{3, 1, 2},
+			e: Stats{Count: 3, Min: 1, Max: 3, Median: 2, Mean: 2},
+		},
+		{
+			i: []float64{4, 1, 2, 1},
+			e: Stats{Count: 4, Min: 1, Max: 4, Median: 1.5, Mean: 2},
+		},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			if s := NewStats(test.i); s != test.e {
+				t.Errorf("expected %#v, got %#v\n", test.e, s)
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	now := time.Now()
+	rates := []model.BankRate{
+		{Bank: "a", Buy: 41.0, Sell: 41.5, LastUpdated: now},
+		{Bank: "b", Buy: 41.2, Sell: 0, LastUpdated: now.Add(-time.Hour)},
+		{Bank: "c", Buy: 40.8, Sell: 41.6, LastUpdated: now.Add(-48 * time.Hour)},
+	}
+
+	fresh := Fresh(rates, now, 24*time.Hour)
+	if len(fresh) != 2 {
+		t.Fatalf("expected 2 fresh rates, got %d\n", len(fresh))
+	}
+
+	s := Summarize(fresh)
+	if s.Banks != 2 || s.Buy.Count != 2 || s.Sell.Count != 1 || s.Spread.Count != 1 || s.BuyOnline.Count != 0 {
+		t.Errorf("unexpected summary %#v\n", s)
+	}
+
+	if s.Spread.Mean != 0.5 {
+		t.Errorf("expected spread 0.5, got %v\n", s.Spread.Mean)
+	}
+}
@@ -0,0 +1,36 @@
+package model
+
+import (
+	"time"
+)
+
+type ApiKey struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// sha256 of the key secret, the key itself is shown only once on creation
+	Hash   string   `json:"hash,omitempty"`
+	Scopes []string `json:"scopes"`
+	// Quota is number of requests allowed per UTC day, unlimited if zero
+	Quota     int64     `json:"quota"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ApiKeyUsage struct {
+	Today      int64     `json:"today"`
+	Total      int64     `json:"total"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+type Subscriber struct {
+	Email string `json:"email"`
+	Bank  string `json:"bank"`
+}
+
+type MailRun struct {
+	Id     string `json:"id"`
+	Digest bool   `json:"digest"`
+	// DryRun logs emails instead of sending them
+	DryRun      bool      `json:"dry_run"`
+	RequestedBy string    `json:"requested_by"`
+	RequestedAt time.Time `json:"requested_at"`
+}
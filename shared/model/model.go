@@ -5,13 +5,15 @@ import (
 )
 
 type BankRate struct {
-	Bank        string    `json:"bank"`
-	Buy         float64   `json:"buy"`
-	BuyOnline   float64   `json:"buy_online"`
-	Sell        float64   `json:"sell"`
-	SellOnline  float64   `json:"sell_online"`
-	LastUpdated time.Time `json:"update_at"`
+	Bank        string    `json:"bank" xml:"bank"`
+	Buy         float64   `json:"buy" xml:"buy"`
+	BuyOnline   float64   `json:"buy_online" xml:"buy_online"`
+	Sell        float64   `json:"sell" xml:"sell"`
+	SellOnline  float64   `json:"sell_online" xml:"sell_online"`
+	LastUpdated time.Time `json:"update_at" xml:"update_at"`
 	// last update source url
-	Source  string `json:"source"`
-	SiteUrl string `json:"site_url"`
+	Source  string `json:"source" xml:"source"`
+	SiteUrl string `json:"site_url" xml:"site_url"`
+	// Official rate is a reference of the central bank rather than an exchange offer, it is not listed among banks
+	Official bool `json:"official,omitempty" xml:"official,omitempty"`
 }
@@ -0,0 +1,31 @@
+package model
+
+import (
+	"time"
+)
+
+type Webhook struct {
+	Id  string `json:"id"`
+	Url string `json:"url"`
+	// empty bank matches all banks
+	Bank     string  `json:"bank,omitempty"`
+	Currency string  `json:"currency"`
+	MinDelta float64 `json:"min_delta"`
+	// used to sign deliveries, shown only once on creation
+	Secret    string    `json:"secret,omitempty"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+	// Owner is id of the api key which created webhook, only the owner and admins can see or delete it
+	Owner string `json:"owner"`
+}
+
+type WebhookDelivery struct {
+	Event    string `json:"event"`
+	Bank     string `json:"bank"`
+	Attempts int    `json:"attempts"`
+	// last response status, 0 if no response received
+	Status      int       `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	Success     bool      `json:"success"`
+	DeliveredAt time.Time `json:"delivered_at"`
+}
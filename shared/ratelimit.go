@@ -0,0 +1,89 @@
+package shared
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+type RateLimit struct {
+	// Key identifies the window, e.g. "subscribe:ip:127.0.0.1"
+	Key    string
+	Limit  int64
+	Window time.Duration
+}
+
+// slidingWindowScript checks all windows first and records the request in each of them only if none is exceeded.
+// Returns 0 if request is allowed, otherwise milliseconds until the earliest request leaves the exceeded window.
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local member = ARGV[2]
+local wait = 0
+for i, key in ipairs(KEYS) do
+	local limit = tonumber(ARGV[1 + i * 2])
+	local window = tonumber(ARGV[2 + i * 2])
+	redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+	if redis.call('ZCARD', key) >= limit then
+		local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+		local w = window
+		if oldest[2] then
+			w = tonumber(oldest[2]) + window - now
+		end
+		if w > wait then
+			wait = w
+		end
+	end
+end
+
+if wait > 0 then
+	return wait
+end
+
+for i, key in ipairs(KEYS) do
+	redis.call('ZADD', key, now, member)
+	redis.call('PEXPIRE', key, tonumber(ARGV[2 + i * 2]))
+end
+
+return 0
+`)
+
+// AllowRequest records a request in sliding windows of the limits atomically.
+// Returns time to wait before the next attempt if any limit is exceeded, the request is not recorded then.
+func (db *Database) AllowRequest(ctx context.Context, limits []RateLimit) (time.Duration, error) {
+	ctx, span := startSpan(ctx, "AllowRequest")
+	defer span.End()
+	if len(limits) == 0 {
+		return 0, nil
+	}
+
+	// member has to be unique, so concurrent requests are counted separately
+	buff := make([]byte, 8)
+	if _, err := rand.Read(buff); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	keys := make([]string, 0, len(limits))
+	args := []interface{}{now.UnixMilli(), fmt.Sprintf("%d-%s", now.UnixNano(), hex.EncodeToString(buff))}
+	for _, limit := range limits {
+		keys = append(keys, fmt.Sprintf("ratelimit:%s", limit.Key))
+		args = append(args, limit.Limit, limit.Window.Milliseconds())
+	}
+
+	wait, err := slidingWindowScript.Run(ctx, db.db, keys, args...).Int64()
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+// UseChallenge marks challenge as used until ttl passes, returns false if it was used already
+func (db *Database) UseChallenge(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	ctx, span := startSpan(ctx, "UseChallenge")
+	defer span.End()
+	return db.db.SetNX(ctx, fmt.Sprintf("challenge:used:%s", id), 1, ttl).Result()
+}
@@ -0,0 +1,93 @@
+package stream
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/redis/go-redis/v9"
+	"io"
+)
+
+// ArchiveEntry is a line of stream archive, NDJSON of entries in stream order, optionally gzipped
+type ArchiveEntry struct {
+	Id     string                 `json:"id"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// ArchiveReader reads entries of archive written by ArchiveWriter
+type ArchiveReader struct {
+	dec *json.Decoder
+	gz  *gzip.Reader
+}
+
+// NewArchiveReader reads plain or gzipped archive, gzip is detected by its header
+func NewArchiveReader(r io.Reader) (*ArchiveReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ArchiveReader{dec: json.NewDecoder(gz), gz: gz}, nil
+	}
+
+	return &ArchiveReader{dec: json.NewDecoder(br)}, nil
+}
+
+// Next returns the next entry, io.EOF after the last one
+func (a *ArchiveReader) Next() (redis.XMessage, error) {
+	entry := ArchiveEntry{}
+	if err := a.dec.Decode(&entry); err != nil {
+		return redis.XMessage{}, err
+	}
+
+	return redis.XMessage{ID: entry.Id, Values: entry.Values}, nil
+}
+
+func (a *ArchiveReader) Close() error {
+	if a.gz != nil {
+		return a.gz.Close()
+	}
+
+	return nil
+}
+
+// ArchiveWriter writes entries as NDJSON, gzipped if requested
+type ArchiveWriter struct {
+	enc *json.Encoder
+	gz  *gzip.Writer
+}
+
+func NewArchiveWriter(w io.Writer, compress bool) *ArchiveWriter {
+	if compress {
+		gz := gzip.NewWriter(w)
+		return &ArchiveWriter{enc: json.NewEncoder(gz), gz: gz}
+	}
+
+	return &ArchiveWriter{enc: json.NewEncoder(w)}
+}
+
+func (a *ArchiveWriter) Write(entries ...redis.XMessage) error {
+	for _, entry := range entries {
+		if err := a.enc.Encode(ArchiveEntry{Id: entry.ID, Values: entry.Values}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close flushes gzip stream, the underlying writer is not closed
+func (a *ArchiveWriter) Close() error {
+	if a.gz != nil {
+		return a.gz.Close()
+	}
+
+	return nil
+}
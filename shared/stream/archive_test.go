@@ -0,0 +1,55 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	entries := []redis.XMessage{
+		{ID: "1718022896000-0", Values: map[string]interface{}{"bank": "monobank", "buy": "41.1"}},
+		{ID: "1718022896000-1", Values: map[string]interface{}{"bank": "НБУ", "schema_version": "1"}},
+	}
+
+	for i, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			aw := NewArchiveWriter(buf, compress)
+			if err := aw.Write(entries...); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := aw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			ar, err := NewArchiveReader(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ar.Close()
+
+			res := []redis.XMessage{}
+			for {
+				entry, err := ar.Next()
+				if err == io.EOF {
+					break
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				res = append(res, entry)
+			}
+
+			if !reflect.DeepEqual(res, entries) {
+				t.Errorf("expected %v, got %v\n", entries, res)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package stream
+
+import (
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/dranikpg/gtrs"
+	"time"
+)
+
+// BankRateMessage is a rate update in the scraper stream
+type BankRateMessage struct {
+	Bank       string    `gtrs:"bank,required"`
+	Buy        float64   `gtrs:"buy"`
+	BuyOnline  float64   `gtrs:"buy_online"`
+	Sell       float64   `gtrs:"sell"`
+	SellOnline float64   `gtrs:"sell_online"`
+	UpdateAt   time.Time `gtrs:"update_at,required"`
+	SiteUrl    string    `gtrs:"site_url"`
+	SourceUrl  string    `gtrs:"source_url,required"`
+	// Official is set for reference rates of the central bank, see model.BankRate
+	Official bool `gtrs:"official"`
+	// RequestId is set by producer to trace the update, generated on consumption if missing
+	RequestId string `gtrs:"request_id"`
+	// Traceparent and Tracestate are W3C trace context of producer, so consumption continues its trace
+	Traceparent string `gtrs:"traceparent"`
+	Tracestate  string `gtrs:"tracestate"`
+	// SchemaVersion picks decoder of the message, see Schema
+	SchemaVersion string `gtrs:"schema_version"`
+}
+
+// NewBankRateMessage is the message updating rate
+func NewBankRateMessage(rate *model.BankRate) BankRateMessage {
+	return BankRateMessage{
+		Bank:       rate.Bank,
+		Buy:        rate.Buy,
+		BuyOnline:  rate.BuyOnline,
+		Sell:       rate.Sell,
+		SellOnline: rate.SellOnline,
+		UpdateAt:   rate.LastUpdated,
+		SiteUrl:    rate.SiteUrl,
+		SourceUrl:  rate.Source,
+		Official:   rate.Official,
+	}
+}
+
+// Unmarshal decodes v with decoder of its schema version.
+// Returns gtrs.ParseError if v is malformed or of unknown version, so gtrs consumers skip it.
+func (b *BankRateMessage) Unmarshal(v map[string]interface{}) error {
+	if err := decodeMessage(v, b); err != nil {
+		return gtrs.ParseError{
+			Data: v,
+			Err:  err,
+		}
+	}
+
+	return nil
+}
+
+// Marshal is the reverse of Unmarshal, zero fields are omitted as Unmarshal leaves missing fields zero
+func (b *BankRateMessage) Marshal() (map[string]interface{}, error) {
+	return messageCodec.Marshal(b)
+}
+
+func (b *BankRateMessage) FromMap(v map[string]any) error {
+	if err := b.Unmarshal(v); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ToMap lets gtrs streams add messages
+func (b BankRateMessage) ToMap() (map[string]any, error) {
+	return b.Marshal()
+}
@@ -0,0 +1,136 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/logging"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	updateTime := time.Date(2024, time.June, 10, 12, 34, 56, 789000000, time.UTC)
+	ts := []BankRateMessage{
+		{
+			Bank:       "Приватбанк",
+			Buy:        41.05,
+			BuyOnline:  41.1,
+			Sell:       41.55,
+			SellOnline: 41.49,
+			UpdateAt:   updateTime,
+			SiteUrl:    "https://privatbank.ua/",
+			SourceUrl:  "https://minfin.com.ua/ua/currency/banks/usd/",
+			RequestId:  "req-1",
+		},
+		{
+			Bank:        "monobank",
+			Buy:         41.1,
+			UpdateAt:    updateTime,
+			SourceUrl:   "https://api.monobank.ua/bank/currency",
+			Traceparent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		},
+		NewBankRateMessage(&model.BankRate{Bank: "НБУ", Buy: 40.5698, Sell: 40.5698, LastUpdated: updateTime, Source: "https://bank.gov.ua/"}),
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			v, err := test.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b := BankRateMessage{}
+			if err := b.Unmarshal(v); err != nil {
+				t.Fatal(err)
+			}
+
+			if !b.UpdateAt.Equal(test.UpdateAt) {
+				t.Errorf("expected %v, got %v\n", test.UpdateAt, b.UpdateAt)
+			}
+
+			b.UpdateAt = test.UpdateAt
+			if b != test {
+				t.Errorf("expected %#v, got %#v\n", test, b)
+			}
+		})
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	type tt struct {
+		i   BankRateMessage
+		e   map[string]interface{}
+		err bool
+	}
+
+	updateTime := time.Date(2024, time.June, 10, 12, 34, 0, 0, time.UTC)
+	ts := []tt{
+		{
+			i: BankRateMessage{Bank: "bank", Buy: 1, SellOnline: 1.05, UpdateAt: updateTime, SourceUrl: "aggregator.com"},
+			e: map[string]interface{}{
+				"bank": "bank", "buy": "1", "sell_online": "1.05", "update_at": "2024-06-10T12:34:00Z", "source_url": "aggregator.com",
+			},
+		},
+		{i: BankRateMessage{Bank: "bank", UpdateAt: updateTime}, err: true},
+		{i: BankRateMessage{UpdateAt: updateTime, SourceUrl: "aggregator.com"}, err: true},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			res, err := test.i.Marshal()
+			if (err != nil) != test.err || (!test.err && !reflect.DeepEqual(res, test.e)) {
+				t.Errorf("expected %v %v, got %v %v\n", test.e, test.err, res, err)
+			}
+		})
+	}
+}
+
+func TestPublisherValues(t *testing.T) {
+	type tt struct {
+		ctx    context.Context
+		i      BankRateMessage
+		maxLen int64
+		e      map[string]interface{}
+	}
+
+	updateTime := time.Date(2024, time.June, 10, 12, 34, 0, 0, time.UTC)
+	ts := []tt{
+		{
+			ctx: context.Background(),
+			i:   BankRateMessage{Bank: "bank", Buy: 1, UpdateAt: updateTime, SourceUrl: "aggregator.com"},
+			e: map[string]interface{}{
+				"bank": "bank", "buy": "1", "update_at": "2024-06-10T12:34:00Z", "source_url": "aggregator.com", "schema_version": SCHEMA_VERSION,
+			},
+		},
+		{
+			ctx:    logging.WithRequestId(context.Background(), "req-ctx"),
+			i:      BankRateMessage{Bank: "bank", Buy: 1, UpdateAt: updateTime, SourceUrl: "aggregator.com"},
+			maxLen: 1000,
+			e: map[string]interface{}{
+				"bank": "bank", "buy": "1", "update_at": "2024-06-10T12:34:00Z", "source_url": "aggregator.com", "schema_version": SCHEMA_VERSION,
+				"request_id": "req-ctx",
+			},
+		},
+		{
+			ctx: logging.WithRequestId(context.Background(), "req-ctx"),
+			i:   BankRateMessage{Bank: "bank", Buy: 1, UpdateAt: updateTime, SourceUrl: "aggregator.com", RequestId: "req-msg"},
+			e: map[string]interface{}{
+				"bank": "bank", "buy": "1", "update_at": "2024-06-10T12:34:00Z", "source_url": "aggregator.com", "schema_version": SCHEMA_VERSION,
+				"request_id": "req-msg",
+			},
+		},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			p := NewPublisher(nil, PublisherConfig{Stream: "rate:usd", MaxLen: test.maxLen})
+			values, err := p.values(test.ctx, test.i)
+			if err != nil || !reflect.DeepEqual(values, test.e) {
+				t.Errorf("expected %v, got %v %v\n", test.e, values, err)
+			}
+
+		})
+	}
+}
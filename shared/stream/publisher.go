@@ -0,0 +1,95 @@
+package stream
+
+import (
+	"context"
+	"github.com/charkpep/usd_rate_api/shared/bus"
+	"github.com/charkpep/usd_rate_api/shared/logging"
+	"github.com/charkpep/usd_rate_api/shared/tracing"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/charkpep/usd_rate_api/shared/stream")
+
+type PublisherConfig struct {
+	Stream string
+	// MaxLen trims stream to about this many entries on publish, not trimmed if zero
+	MaxLen int64
+}
+
+// Publisher adds rate updates to the stream read by consumer
+type Publisher struct {
+	bus  bus.Bus
+	conf PublisherConfig
+}
+
+// NewPublisher publishes to Redis stream
+func NewPublisher(rdb redis.Cmdable, conf PublisherConfig) *Publisher {
+	return NewBusPublisher(bus.NewRedis(rdb, bus.RedisConfig{MaxLen: conf.MaxLen}), conf)
+}
+
+// NewBusPublisher publishes to topic Stream of b, MaxLen is not applied as b has its own limits
+func NewBusPublisher(b bus.Bus, conf PublisherConfig) *Publisher {
+	return &Publisher{bus: b, conf: conf}
+}
+
+// Publish adds message of the current schema version and returns its entry id.
+// Request id and trace context of ctx are published along unless message has its own.
+func (p *Publisher) Publish(ctx context.Context, msg BankRateMessage) (string, error) {
+	ctx, span := tracer.Start(ctx, "Publisher.Publish", trace.WithSpanKind(trace.SpanKindProducer))
+	values, err := p.values(ctx, msg)
+	if err != nil {
+		tracing.End(span, err)
+		return "", err
+	}
+
+	ids, err := p.bus.Publish(ctx, p.conf.Stream, values)
+	tracing.End(span, err)
+	if err != nil {
+		return "", err
+	}
+
+	return ids[0], nil
+}
+
+// PublishBulk adds messages at once, in one pipeline for Redis, and returns their ids in order.
+// Nothing is published if any message can not be marshaled.
+func (p *Publisher) PublishBulk(ctx context.Context, msgs []BankRateMessage) (ids []string, err error) {
+	ctx, span := tracer.Start(ctx, "Publisher.PublishBulk",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.Int("messages", len(msgs))),
+	)
+	defer func() { tracing.End(span, err) }()
+	values := make([]map[string]interface{}, 0, len(msgs))
+	for _, msg := range msgs {
+		v, err := p.values(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, v)
+	}
+
+	return p.bus.Publish(ctx, p.conf.Stream, values...)
+}
+
+func (p *Publisher) values(ctx context.Context, msg BankRateMessage) (map[string]interface{}, error) {
+	if msg.RequestId == "" {
+		msg.RequestId = logging.RequestId(ctx)
+	}
+
+	msg.SchemaVersion = SCHEMA_VERSION
+
+	values, err := msg.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Traceparent == "" {
+		tracing.Inject(ctx, values)
+	}
+
+	return values, nil
+}
@@ -0,0 +1,128 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/codec"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"maps"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	// SCHEMA_VERSION is the version of BankRateMessage fields written by Marshal, stamped by Publisher
+	SCHEMA_VERSION = "1"
+	// SCHEMA_VERSION_FIELD is the stream entry field holding schema version
+	SCHEMA_VERSION_FIELD = "schema_version"
+	// RATE_PATTERN is the pattern of rates since version 1, missing rates are omitted instead of being negative
+	RATE_PATTERN = `^[0-9]+(\.[0-9]+)?$`
+)
+
+var ErrUnknownVersion = errors.New("unknown schema version")
+
+var rateFields = []string{"buy", "sell", "buy_online", "sell_online"}
+
+// messageCodec rounds times to milliseconds, the precision rates are compared with
+var messageCodec = codec.New(codec.Config{TimePrecision: time.Millisecond})
+
+// legacyCodec lets required fields be absent, as consumer always accepted such messages before versioning
+var legacyCodec = codec.New(codec.Config{TimePrecision: time.Millisecond, LaxRequired: true})
+
+type decoder func(v map[string]interface{}, b *BankRateMessage) error
+
+// decoders read every schema version, so producers are not broken by newer versions.
+// Messages without version are of the TS scraper published before versioning.
+var decoders = map[string]decoder{
+	"":             decodeLegacy,
+	SCHEMA_VERSION: decodeV1,
+}
+
+var schemaV1 = mustCompileSchema(SCHEMA_VERSION)
+
+// Schema returns JSON Schema document of version, generated from BankRateMessage
+func Schema(version string) (map[string]interface{}, error) {
+	if version != SCHEMA_VERSION {
+		return nil, fmt.Errorf("%w %q", ErrUnknownVersion, version)
+	}
+
+	schema, err := messageCodec.Schema(BankRateMessage{})
+	if err != nil {
+		return nil, err
+	}
+
+	schema["$id"] = schemaId(version)
+	properties := schema["properties"].(map[string]interface{})
+	properties[SCHEMA_VERSION_FIELD] = map[string]interface{}{"const": version}
+	for _, field := range rateFields {
+		properties[field].(map[string]interface{})["pattern"] = RATE_PATTERN
+	}
+
+	schema["required"] = append(schema["required"].([]string), SCHEMA_VERSION_FIELD)
+	return schema, nil
+}
+
+func schemaId(version string) string {
+	return "bank_rate_message.v" + version + ".json"
+}
+
+func mustCompileSchema(version string) *jsonschema.Schema {
+	schema, err := Schema(version)
+	if err != nil {
+		panic(err)
+	}
+
+	doc, err := json.Marshal(schema)
+	if err != nil {
+		panic(err)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat = true
+	if err := compiler.AddResource(schemaId(version), bytes.NewReader(doc)); err != nil {
+		panic(err)
+	}
+
+	return compiler.MustCompile(schemaId(version))
+}
+
+// decodeMessage routes v to decoder of its schema version
+func decodeMessage(v map[string]interface{}, b *BankRateMessage) error {
+	version, _ := v[SCHEMA_VERSION_FIELD].(string)
+	decode, ok := decoders[version]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownVersion, version)
+	}
+
+	return decode(v, b)
+}
+
+// decodeV1 accepts only messages valid against the schema
+func decodeV1(v map[string]interface{}, b *BankRateMessage) error {
+	if err := schemaV1.Validate(v); err != nil {
+		return err
+	}
+
+	return messageCodec.Unmarshal(v, b)
+}
+
+// decodeLegacy treats rates the TS scraper pushed for NaN ("-1", "null", "NaN") as missing
+func decodeLegacy(v map[string]interface{}, b *BankRateMessage) error {
+	v = maps.Clone(v)
+	for _, field := range rateFields {
+		str, ok := v[field].(string)
+		if !ok {
+			continue
+		}
+
+		rate, err := strconv.ParseFloat(str, 64)
+		if str == "null" || (err == nil && (math.IsNaN(rate) || rate < 0)) {
+			delete(v, field)
+		}
+	}
+
+	return legacyCodec.Unmarshal(v, b)
+}
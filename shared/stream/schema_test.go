@@ -0,0 +1,110 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dranikpg/gtrs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite schema files from BankRateMessage")
+
+func TestSchemaFile(t *testing.T) {
+	schema, err := Schema(SCHEMA_VERSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc = append(doc, '\n')
+	path := filepath.Join("schema", schemaId(SCHEMA_VERSION))
+	if *update {
+		if err := os.WriteFile(path, doc, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(file, doc) {
+		t.Errorf("%s is outdated, run go test ./stream -run TestSchemaFile -update\n", path)
+	}
+}
+
+func TestUnmarshalVersions(t *testing.T) {
+	type tt struct {
+		i   map[string]interface{}
+		e   BankRateMessage
+		err bool
+	}
+
+	updateTime := time.Date(2024, time.June, 10, 12, 34, 56, 0, time.UTC)
+	v1 := func(v map[string]interface{}) map[string]interface{} {
+		res := map[string]interface{}{"bank": "bank", "update_at": "2024-06-10T12:34:56Z", "source_url": "src", "schema_version": "1"}
+		for key, value := range v {
+			res[key] = value
+		}
+		return res
+	}
+
+	ts := []tt{
+		{
+			i: v1(map[string]interface{}{"buy": "41.05", "sell": "41.5", "extra": "ignored"}),
+			e: BankRateMessage{Bank: "bank", Buy: 41.05, Sell: 41.5, UpdateAt: updateTime, SourceUrl: "src", SchemaVersion: "1"},
+		},
+		{i: v1(map[string]interface{}{"buy": "-1"}), err: true},
+		{i: v1(map[string]interface{}{"sell": "NaN"}), err: true},
+		{i: v1(map[string]interface{}{"site_url": ""}), err: true},
+		{i: v1(map[string]interface{}{"update_at": "10.06.2024"}), err: true},
+		{i: map[string]interface{}{"bank": "bank", "update_at": "2024-06-10T12:34:56Z", "schema_version": "1"}, err: true},
+		{
+			i: map[string]interface{}{"bank": "bank", "buy": "-1", "sell": "null", "buy_online": "NaN", "sell_online": "41.5", "update_at": "2024-06-10T12:34:56Z"},
+			e: BankRateMessage{Bank: "bank", SellOnline: 41.5, UpdateAt: updateTime},
+		},
+		{i: map[string]interface{}{"bank": "bank", "buy": "many", "update_at": "2024-06-10T12:34:56Z"}, err: true},
+		{i: v1(map[string]interface{}{"schema_version": "2"}), err: true},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			b := BankRateMessage{}
+			err := b.Unmarshal(test.i)
+			if test.err {
+				if !errors.As(err, &gtrs.ParseError{}) {
+					t.Errorf("expected gtrs.ParseError, got %v\n", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b.UpdateAt = b.UpdateAt.UTC()
+			if b != test.e {
+				t.Errorf("expected %#v, got %#v\n", test.e, b)
+			}
+		})
+	}
+}
+
+func TestUnknownVersion(t *testing.T) {
+	b := BankRateMessage{}
+	err := b.Unmarshal(map[string]interface{}{"bank": "bank", "schema_version": "2"})
+	if !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("expected %v, got %v\n", ErrUnknownVersion, err)
+	}
+}
@@ -0,0 +1,18 @@
+// Package testenv runs in-memory replacements of services the application depends on, so tests need no Docker.
+package testenv
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"testing"
+)
+
+// NewRedis starts in-memory Redis server, both the server and the client are closed when test ends.
+// The server is returned to manipulate time or inspect keys.
+func NewRedis(t testing.TB) (*redis.Client, *miniredis.Miniredis) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return rdb, m
+}
@@ -0,0 +1,266 @@
+package testenv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// MAIL_WAIT is how long assertions wait for emails
+const MAIL_WAIT = 5 * time.Second
+
+// Mail is an email received by SMTPServer, Subject and Body are decoded, lines of Body end with LF
+type Mail struct {
+	From    string
+	To      []string
+	Subject string
+	Body    string
+}
+
+// SMTPServer is a fake SMTP server on localhost. It accepts any credentials without TLS and keeps received emails.
+type SMTPServer struct {
+	ln    net.Listener
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	mails []Mail
+}
+
+// NewSMTPServer starts server stopped when test ends
+func NewSMTPServer(t testing.TB) *SMTPServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &SMTPServer{ln: ln}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *SMTPServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Host is always a loopback address, so clients allow plain auth without TLS
+func (s *SMTPServer) Host() string {
+	return s.ln.Addr().(*net.TCPAddr).IP.String()
+}
+
+func (s *SMTPServer) Port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops accepting connections and waits for the open ones
+func (s *SMTPServer) Close() {
+	s.ln.Close()
+	s.wg.Wait()
+}
+
+// Mails returns emails received so far in order
+func (s *SMTPServer) Mails() []Mail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Mail{}, s.mails...)
+}
+
+// WaitMails waits up to MAIL_WAIT until at least n emails are received
+func (s *SMTPServer) WaitMails(t testing.TB, n int) []Mail {
+	t.Helper()
+	deadline := time.Now().Add(MAIL_WAIT)
+	for {
+		mails := s.Mails()
+		if len(mails) >= n {
+			return mails
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d mails, got %d\n", n, len(mails))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// AssertMail waits up to MAIL_WAIT for an email to `to` with subject or body containing text
+func (s *SMTPServer) AssertMail(t testing.TB, to, text string) Mail {
+	t.Helper()
+	deadline := time.Now().Add(MAIL_WAIT)
+	for {
+		mails := s.Mails()
+		for _, m := range mails {
+			if (strings.Contains(m.Subject, text) || strings.Contains(m.Body, text)) && contains(m.To, to) {
+				return m
+			}
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected mail to %s with %q, got %+v\n", to, text, mails)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func contains(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *SMTPServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// handle speaks just enough SMTP for net/smtp clients, one email per MAIL, RCPT and DATA sequence
+func (s *SMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	// connections left open by clients are dropped, so Close does not hang
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost ESMTP fake")
+	m := Mail{}
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO":
+			c.PrintfLine("250-localhost")
+			c.PrintfLine("250 AUTH PLAIN LOGIN")
+		case "HELO":
+			c.PrintfLine("250 localhost")
+		case "AUTH":
+			if !s.auth(c, arg) {
+				return
+			}
+
+			c.PrintfLine("235 2.7.0 Authentication successful")
+		case "MAIL":
+			m = Mail{From: address(arg)}
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			m.To = append(m.To, address(arg))
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+
+			if m.Subject, m.Body, err = parseMail(data); err != nil {
+				c.PrintfLine("554 %s", err)
+				continue
+			}
+
+			s.mu.Lock()
+			s.mails = append(s.mails, m)
+			s.mu.Unlock()
+			m = Mail{}
+			c.PrintfLine("250 OK")
+		case "RSET":
+			m = Mail{}
+			c.PrintfLine("250 OK")
+		case "NOOP":
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// auth reads credentials of PLAIN or LOGIN mechanism and accepts them, false if connection is broken
+func (s *SMTPServer) auth(c *textproto.Conn, arg string) bool {
+	mech, initial, _ := strings.Cut(arg, " ")
+	prompts := []string{}
+	switch {
+	case strings.EqualFold(mech, "LOGIN"):
+		// "Username:" and "Password:"
+		prompts = []string{"VXNlcm5hbWU6", "UGFzc3dvcmQ6"}
+	case initial == "":
+		prompts = []string{""}
+	}
+
+	for _, prompt := range prompts {
+		c.PrintfLine("334 %s", prompt)
+		if _, err := c.ReadLine(); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// address extracts address from "FROM:<address>" argument
+func address(arg string) string {
+	_, addr, _ := strings.Cut(arg, "<")
+	addr, _, _ = strings.Cut(addr, ">")
+	return addr
+}
+
+// parseMail decodes subject and single part body
+func parseMail(data []byte) (string, string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", "", err
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return "", "", err
+	}
+
+	body := msg.Body
+	switch encoding := strings.ToLower(msg.Header.Get("Content-Transfer-Encoding")); encoding {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "", "7bit", "8bit", "binary":
+	default:
+		return "", "", errors.New("unknown transfer encoding " + strconv.Quote(encoding))
+	}
+
+	res, err := io.ReadAll(body)
+	if err != nil {
+		return "", "", err
+	}
+
+	return subject, string(res), nil
+}
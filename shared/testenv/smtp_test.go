@@ -0,0 +1,53 @@
+package testenv
+
+import (
+	"fmt"
+	"net/smtp"
+	"testing"
+)
+
+func TestSMTPServer(t *testing.T) {
+	type tt struct {
+		msg  string
+		auth bool
+		e    Mail
+	}
+
+	ts := []tt{
+		{
+			msg: "Subject: rate\r\n\r\nBuy: 41.05\r\n",
+			e:   Mail{From: "from@example.com", To: []string{"to@example.com"}, Subject: "rate", Body: "Buy: 41.05\n"},
+		},
+		{
+			msg:  "Subject: =?UTF-8?q?=D0=9A=D1=83=D1=80=D1=81?=\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n<b>=D0=9D=D0=91=D0=A3</b>, Buy: 41=\r\n.05",
+			auth: true,
+			e:    Mail{From: "from@example.com", To: []string{"to@example.com"}, Subject: "Курс", Body: "<b>НБУ</b>, Buy: 41.05\n"},
+		},
+		{
+			msg:  "Subject: digest\r\nContent-Transfer-Encoding: base64\r\n\r\nQnV5OiA0\r\nMS4wNQ==\r\n",
+			auth: true,
+			e:    Mail{From: "from@example.com", To: []string{"to@example.com"}, Subject: "digest", Body: "Buy: 41.05"},
+		},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			s := NewSMTPServer(t)
+			var auth smtp.Auth
+			if test.auth {
+				auth = smtp.PlainAuth("", "user", "password", s.Host())
+			}
+
+			if err := smtp.SendMail(s.Addr(), auth, test.e.From, test.e.To, []byte(test.msg)); err != nil {
+				t.Fatal(err)
+			}
+
+			mails := s.WaitMails(t, 1)
+			if fmt.Sprintf("%q", mails) != fmt.Sprintf("%q", []Mail{test.e}) {
+				t.Errorf("expected %q, got %q\n", []Mail{test.e}, mails)
+			}
+
+			s.AssertMail(t, "to@example.com", "41.05")
+		})
+	}
+}
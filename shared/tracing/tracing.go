@@ -0,0 +1,113 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+)
+
+const (
+	EXPORTER_OTLP   = "otlp"
+	EXPORTER_STDOUT = "stdout"
+	EXPORTER_NONE   = "none"
+)
+
+// Init sets global tracer provider of the service and W3C trace context propagator.
+// Exporter is picked by OTEL_TRACES_EXPORTER, otlp by default if OTEL_EXPORTER_OTLP_ENDPOINT is set,
+// none otherwise. Returned function flushes pending spans.
+func Init(ctx context.Context, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporter, err := newExporter(ctx, os.Getenv("OTEL_TRACES_EXPORTER"))
+	if err != nil {
+		return nil, err
+	}
+
+	if exporter == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", service)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// newExporter returns nil exporter if tracing is disabled
+func newExporter(ctx context.Context, name string) (sdktrace.SpanExporter, error) {
+	if name == "" {
+		name = EXPORTER_NONE
+		if _, ok := os.LookupEnv("OTEL_EXPORTER_OTLP_ENDPOINT"); ok {
+			name = EXPORTER_OTLP
+		}
+	}
+
+	switch name {
+	case EXPORTER_OTLP:
+		// endpoint, headers and timeout are read by exporter from standard OTEL_EXPORTER_OTLP_* variables
+		return otlptracehttp.New(ctx)
+	case EXPORTER_STDOUT:
+		return stdouttrace.New()
+	case EXPORTER_NONE:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown traces exporter %q", name)
+	}
+}
+
+// StreamCarrier adapts fields of a stream message to propagation.TextMapCarrier
+type StreamCarrier map[string]interface{}
+
+func (c StreamCarrier) Get(key string) string {
+	val, _ := c[key].(string)
+	return val
+}
+
+func (c StreamCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c StreamCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// Inject adds trace context of ctx to stream message fields
+func Inject(ctx context.Context, values map[string]interface{}) {
+	otel.GetTextMapPropagator().Inject(ctx, StreamCarrier(values))
+}
+
+// Extract returns ctx with trace context read from stream message fields
+func Extract(ctx context.Context, values map[string]interface{}) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, StreamCarrier(values))
+}
+
+// End records err on span if any and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
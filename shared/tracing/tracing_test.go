@@ -0,0 +1,47 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+)
+
+func TestPropagation(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	traceId, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanId, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceId,
+		SpanID:     spanId,
+		TraceFlags: trace.FlagsSampled,
+	})
+
+	type tt struct {
+		ctx    context.Context
+		fields int
+	}
+
+	ts := []tt{
+		{ctx: trace.ContextWithSpanContext(context.Background(), sc), fields: 2},
+		{ctx: context.Background(), fields: 1},
+	}
+
+	for i, test := range ts {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			values := map[string]interface{}{"rate": "{}"}
+			Inject(test.ctx, values)
+			if len(values) != test.fields {
+				t.Errorf("expected %v, got %v\n", test.fields, values)
+			}
+
+			res := trace.SpanContextFromContext(Extract(context.Background(), values))
+			expected := trace.SpanContextFromContext(test.ctx)
+			if res.TraceID() != expected.TraceID() || res.SpanID() != expected.SpanID() {
+				t.Errorf("expected %v, got %v\n", expected, res)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/charkpep/usd_rate_api/shared/model"
+	"github.com/redis/go-redis/v9"
+)
+
+// WEBHOOK_DELIVERIES_LEN is number of the latest deliveries kept per webhook
+const WEBHOOK_DELIVERIES_LEN = 100
+
+func (db *Database) SetWebhook(ctx context.Context, hook *model.Webhook) error {
+	ctx, span := startSpan(ctx, "SetWebhook")
+	defer span.End()
+	hookBuff, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, fmt.Sprintf("webhook:%s", hook.Id), string(hookBuff), 0)
+		pipe.SAdd(ctx, "webhooks", hook.Id)
+		return nil
+	})
+
+	return err
+}
+
+// GetWebhook returns nil if webhook does not exist
+func (db *Database) GetWebhook(ctx context.Context, id string) (*model.Webhook, error) {
+	ctx, span := startSpan(ctx, "GetWebhook")
+	defer span.End()
+	hookRaw, err := db.db.Get(ctx, fmt.Sprintf("webhook:%s", id)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	hook := model.Webhook{}
+	if err := json.Unmarshal([]byte(hookRaw), &hook); err != nil {
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
+func (db *Database) GetWebhooks(ctx context.Context) ([]model.Webhook, error) {
+	ctx, span := startSpan(ctx, "GetWebhooks")
+	defer span.End()
+	ids, err := db.db.SMembers(ctx, "webhooks").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make([]model.Webhook, 0, len(ids))
+	for _, id := range ids {
+		hook, err := db.GetWebhook(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if hook == nil {
+			continue
+		}
+
+		hooks = append(hooks, *hook)
+	}
+
+	return hooks, nil
+}
+
+// DisableWebhook marks webhook disabled unless it was deleted meanwhile, returns false if it does not exist
+func (db *Database) DisableWebhook(ctx context.Context, id string) (bool, error) {
+	ctx, span := startSpan(ctx, "DisableWebhook")
+	defer span.End()
+	return db.setWebhookDisabled(ctx, id, true)
+}
+
+// EnableWebhook delivers events to a disabled webhook again and resets its failures, returns false if it does not exist
+func (db *Database) EnableWebhook(ctx context.Context, id string) (bool, error) {
+	ctx, span := startSpan(ctx, "EnableWebhook")
+	defer span.End()
+	return db.setWebhookDisabled(ctx, id, false)
+}
+
+func (db *Database) setWebhookDisabled(ctx context.Context, id string, disabled bool) (bool, error) {
+	key := fmt.Sprintf("webhook:%s", id)
+	exists := false
+	// webhook is set only if it was not changed or deleted since it was read
+	err := db.db.Watch(ctx, func(tx *redis.Tx) error {
+		hookRaw, err := tx.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		hook := model.Webhook{}
+		if err := json.Unmarshal([]byte(hookRaw), &hook); err != nil {
+			return err
+		}
+
+		hook.Disabled = disabled
+		hookBuff, err := json.Marshal(hook)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, string(hookBuff), 0)
+			if !disabled {
+				pipe.Del(ctx, fmt.Sprintf("webhook:%s:failures", id))
+			}
+			return nil
+		})
+		exists = err == nil
+		return err
+	}, key)
+
+	return exists, err
+}
+
+// DeleteWebhook returns false if webhook does not exist
+func (db *Database) DeleteWebhook(ctx context.Context, id string) (bool, error) {
+	ctx, span := startSpan(ctx, "DeleteWebhook")
+	defer span.End()
+	res, err := db.db.SRem(ctx, "webhooks", id).Result()
+	if err != nil {
+		return false, err
+	}
+
+	keys := []string{fmt.Sprintf("webhook:%s", id)}
+	iter := db.db.Scan(ctx, 0, fmt.Sprintf("webhook:%s:*", id), 0).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+
+	if iter.Err() != nil {
+		return false, iter.Err()
+	}
+
+	if err := db.db.Del(ctx, keys...).Err(); err != nil {
+		return false, err
+	}
+
+	return res != 0, nil
+}
+
+// IncrWebhookFailures returns number of consecutive failed deliveries
+func (db *Database) IncrWebhookFailures(ctx context.Context, id string) (int64, error) {
+	ctx, span := startSpan(ctx, "IncrWebhookFailures")
+	defer span.End()
+	return db.db.Incr(ctx, fmt.Sprintf("webhook:%s:failures", id)).Result()
+}
+
+func (db *Database) ResetWebhookFailures(ctx context.Context, id string) error {
+	ctx, span := startSpan(ctx, "ResetWebhookFailures")
+	defer span.End()
+	return db.db.Del(ctx, fmt.Sprintf("webhook:%s:failures", id)).Err()
+}
+
+func (db *Database) AddWebhookDelivery(ctx context.Context, id string, delivery *model.WebhookDelivery) error {
+	ctx, span := startSpan(ctx, "AddWebhookDelivery")
+	defer span.End()
+	deliveryBuff, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("webhook:%s:deliveries", id)
+	_, err = db.db.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, key, string(deliveryBuff))
+		pipe.LTrim(ctx, key, 0, WEBHOOK_DELIVERIES_LEN-1)
+		return nil
+	})
+
+	return err
+}
+
+// GetWebhookDeliveries returns the latest deliveries first
+func (db *Database) GetWebhookDeliveries(ctx context.Context, id string) ([]model.WebhookDelivery, error) {
+	ctx, span := startSpan(ctx, "GetWebhookDeliveries")
+	defer span.End()
+	res, err := db.db.LRange(ctx, fmt.Sprintf("webhook:%s:deliveries", id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]model.WebhookDelivery, 0, len(res))
+	for _, deliveryRaw := range res {
+		delivery := model.WebhookDelivery{}
+		if err := json.Unmarshal([]byte(deliveryRaw), &delivery); err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// GetWebhookLastRate returns the last rate of bank delivered by webhook, nil if none was
+func (db *Database) GetWebhookLastRate(ctx context.Context, id, bank string) (*model.BankRate, error) {
+	ctx, span := startSpan(ctx, "GetWebhookLastRate")
+	defer span.End()
+	priceRaw, err := db.db.Get(ctx, fmt.Sprintf("webhook:%s:last:%s", id, bank)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	price := model.BankRate{}
+	if err := json.Unmarshal([]byte(priceRaw), &price); err != nil {
+		return nil, err
+	}
+
+	return &price, nil
+}
+
+func (db *Database) SetWebhookLastRate(ctx context.Context, id string, price *model.BankRate) error {
+	ctx, span := startSpan(ctx, "SetWebhookLastRate")
+	defer span.End()
+	priceBuff, err := json.Marshal(price)
+	if err != nil {
+		return err
+	}
+
+	return db.db.Set(ctx, fmt.Sprintf("webhook:%s:last:%s", id, price.Bank), string(priceBuff), 0).Err()
+}
+
+// GetLastDispatchedUpdateId returns id of the last rate update delivered to webhooks, empty if none was
+func (db *Database) GetLastDispatchedUpdateId(ctx context.Context) (string, error) {
+	ctx, span := startSpan(ctx, "GetLastDispatchedUpdateId")
+	defer span.End()
+	id, err := db.db.Get(ctx, "webhooks:last_id").Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+
+	return id, err
+}
+
+// SetLastDispatchedUpdateId stores id of the last rate update delivered to webhooks, so dispatching resumes after it
+func (db *Database) SetLastDispatchedUpdateId(ctx context.Context, id string) error {
+	ctx, span := startSpan(ctx, "SetLastDispatchedUpdateId")
+	defer span.End()
+	return db.db.Set(ctx, "webhooks:last_id", id, 0).Err()
+}